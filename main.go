@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/sixstone-qq/chroot-wrapper/task"
 )
@@ -12,10 +16,38 @@ import (
 func main() {
 	if os.Args[0] == task.TaskForkName {
 		// Create the view of the system and exec
-		var wd string
+		var wd, mounts, network, seccomp string
+		container := new(task.Container)
 		flag.StringVar(&wd, "wd", "", "Working directory to exec")
+		flag.StringVar(&container.LowerDir, "lowerdir", "", "Read-only lower directory of the root overlay")
+		flag.StringVar(&container.UpperDir, "upperdir", "", "Writable upper directory of the root overlay")
+		flag.StringVar(&container.WorkDir, "workdir", "", "Work directory of the root overlay")
+		flag.StringVar(&mounts, "mounts", "", "Standard filesystems to mount inside the jail")
+		flag.Var((*volumeList)(&container.Volumes), "v", "Host path bind mounted inside the jail")
+		flag.Var((*pathList)(&container.Tmpfs), "tmpfs", "Path inside the jail where a writable tmpfs is mounted")
+		flag.BoolVar(&container.ReadOnly, "read-only", false, "Remount the root read-only")
+		flag.StringVar(&network, "net", "host", "Network of the namespace")
+		flag.StringVar(&container.Hostname, "hostname", "", "Hostname of the UTS namespace")
+		flag.StringVar(&seccomp, "seccomp", "", "JSON seccomp profile installed before the exec")
 		flag.Parse()
-		if err := task.RunContainer(wd); err != nil {
+		container.Args = flag.Args()
+		var err error
+		if container.Mounts, err = task.ParseSystemMounts(mounts); err != nil {
+			log.Fatal(err)
+		}
+		if container.Network, err = task.ParseNetworkMode(network); err != nil {
+			log.Fatal(err)
+		}
+		if seccomp != "" {
+			container.Seccomp = new(task.SeccompProfile)
+			if err = json.Unmarshal([]byte(seccomp), container.Seccomp); err != nil {
+				log.Fatalf("Seccomp profile: %v", err)
+			}
+		}
+		if container.Network == task.NetworkSlirp {
+			container.TapSocket = os.NewFile(task.TapSocketFd, "tap-socket")
+		}
+		if err = container.Run(wd); err != nil {
 			log.Fatalf("Run container error: %v", err)
 		}
 		os.Exit(0)
@@ -26,33 +58,126 @@ func main() {
 
 	switch opts.Command {
 	case "run":
-		// URL Command Args
-		if len(opts.Args) < 2 {
-			switch len(opts.Args) {
-			case 0:
-				fmt.Fprintf(os.Stderr, "Missing URL and command to run\n")
-			case 1:
-				fmt.Fprintf(os.Stderr, "Missing Command to run\n")
-			}
+		// URL [Command Args]
+		if len(opts.Args) < 1 {
+			fmt.Fprintf(os.Stderr, "Missing URL and command to run\n")
 			opts.Usage()
 			break
 		}
+		// The command may come from the image config
+		var command string
+		var args []string
+		if len(opts.Args) > 1 {
+			command, args = opts.Args[1], opts.Args[2:]
+		}
+
+		taskOpts := task.Options{
+			Digest:        opts.Digest,
+			Scratch:       opts.Scratch,
+			Overlay:       opts.Overlay,
+			TrustedXattrs: opts.TrustedXattrs,
+			Volumes:       opts.Volumes,
+			ReadOnly:      opts.ReadOnly,
+			Tmpfs:         opts.Tmpfs,
+			Hostname:      opts.Hostname,
+			Resources: task.Resources{
+				CPUs: opts.CPUs,
+				Pids: opts.Pids,
+			},
+			PortForwards: opts.PortForwards,
+		}
+		if taskOpts.SignaturePolicy, err = task.ParseSignaturePolicy(opts.Verify); err != nil {
+			log.Fatal(err)
+		}
+		if taskOpts.Ownership, err = task.ParseOwnership(opts.Ownership); err != nil {
+			log.Fatal(err)
+		}
+		if taskOpts.Network, err = task.ParseNetworkMode(opts.Network); err != nil {
+			log.Fatal(err)
+		}
+		switch opts.Seccomp {
+		case "default":
+			// Only the unprivileged tasks are filtered, do not warn
+			// about the default
+			if os.Geteuid() != 0 {
+				taskOpts.Seccomp = task.DefaultSeccompProfile()
+			}
+		case "unconfined":
+		default:
+			if taskOpts.Seccomp, err = task.LoadSeccompProfile(opts.Seccomp); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if opts.Memory != "" {
+			if taskOpts.Resources.Memory, err = task.ParseMemory(opts.Memory); err != nil {
+				log.Fatal(err)
+			}
+		}
+		var mounts task.SystemMounts
+		if mounts, err = task.ParseSystemMounts(opts.Mounts); err != nil {
+			log.Fatal(err)
+		}
+		taskOpts.SkipMounts = task.AllSystemMounts &^ mounts
+		if opts.TrustedKeys != "" {
+			if taskOpts.TrustedKeys, err = task.LoadTrustedKeys(opts.TrustedKeys); err != nil {
+				log.Fatalf("Impossible to load the trusted keys: %v", err)
+			}
+		}
+
+		var cache *task.Cache
+		if opts.CacheDir != "" {
+			if cache, err = task.OpenCache(opts.CacheDir); err != nil {
+				log.Fatalf("Impossible to open the cache: %v", err)
+			}
+		}
+
+		// Only the leaves of the cgroup hierarchy have processes, this
+		// one moves to a leaf to create the task cgroup next to it
+		var supervisorCgroup *task.SupervisorCgroup
+		if taskOpts.Resources.Limited() {
+			if supervisorCgroup, err = task.EnterSupervisorCgroup(); err != nil {
+				log.Fatalf("Impossible to limit the resources: %v", err)
+			}
+		}
+		leaveCgroup := func() {
+			if supervisorCgroup != nil {
+				if err := supervisorCgroup.Leave(); err != nil {
+					log.Printf("WARN: %v", err)
+				}
+			}
+		}
 
 		done := make(chan struct{})
 		tc := make(chan *task.Task)
 		go func(taskChan chan *task.Task, end chan struct{}) {
 			defer close(end)
 			defer close(taskChan)
-			task, err := task.CreateTask(opts.Args[0], opts.Args[1], opts.Args[2:]...)
+			task, err := task.CreateTaskWithOptions(opts.Args[0], taskOpts, command, args...)
 			if err != nil {
+				leaveCgroup()
 				log.Fatalf("Impossible to create task: %v", err)
 			}
 			defer task.Close()
+			task.Cache = cache
 			taskChan <- task
 
-			err = task.StartChroot(opts.Dir,
-				append(opts.Environ(), os.Environ()...))
+			if err = task.Prepare(); err != nil {
+				task.Close()
+				leaveCgroup()
+				log.Fatalf("Impossible to prepare the image: %v", err)
+			}
+			// Like docker, the host environment is not inherited
+			// when the image has a config
+			env := opts.Environ()
+			if task.ImageConfig() == nil {
+				env = append(os.Environ(), env...)
+			}
+			err = task.StartChroot(opts.Dir, env)
 			if err != nil {
+				// Fatal skips the deferred Close unmounting the
+				// volumes of privileged tasks
+				task.Close()
+				leaveCgroup()
 				log.Fatalf("Impossible to start task: %v", err)
 			}
 
@@ -72,11 +197,26 @@ func main() {
 
 		// Wait for the task to exit
 		<-done
+		leaveCgroup()
+	case "cache":
+		err = cacheCommand(opts)
 	case "ps":
 		if err = task.QuerySupervisor(opts.ListeningPort, task.StatusQuery); err != nil {
 
 			err = fmt.Errorf("Error querying task status: %v", err)
 		}
+	case "stats":
+		statsFlags := flag.NewFlagSet("stats", flag.ExitOnError)
+		watch := statsFlags.Bool("watch", false, "Stream the statistics until the task finishes")
+		interval := statsFlags.Duration("interval", time.Second, "Interval between the streamed statistics")
+		statsFlags.Parse(opts.Args)
+		var args []string
+		if *watch {
+			args = append(args, interval.String())
+		}
+		if err = task.QuerySupervisor(opts.ListeningPort, task.StatsQuery, args...); err != nil {
+			err = fmt.Errorf("Error querying task statistics: %v", err)
+		}
 	case "kill":
 		var signal string
 		if len(opts.Args) >= 1 {
@@ -90,13 +230,63 @@ func main() {
 		}
 	default:
 		fmt.Fprintf(os.Stderr, "Missing subcommand parameter, available subcommands:\n\n")
-		fmt.Fprintf(os.Stderr, "  run, ps, kill\n")
+		fmt.Fprintf(os.Stderr, "  %s\n", strings.Join(subcommands, ", "))
 	}
 	if err != nil {
-		if opts.Command == "ps" || opts.Command == "kill" {
+		if opts.Command == "cache" {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+		if opts.Command == "ps" || opts.Command == "stats" || opts.Command == "kill" {
 			// Give some hint
 			fmt.Fprintf(os.Stderr, "%s\nIs task running or in a different port?\n", err)
 		}
 		os.Exit(1)
 	}
 }
+
+// cacheCommand lists or prunes the image cache
+func cacheCommand(opts *Options) error {
+	if opts.CacheDir == "" {
+		return fmt.Errorf("Cache is disabled")
+	}
+	cache, err := task.OpenCache(opts.CacheDir)
+	if err != nil {
+		return err
+	}
+	var action string
+	if len(opts.Args) > 0 {
+		action = opts.Args[0]
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	switch action {
+	case "ls":
+		blobs, err := cache.List()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "DIGEST\tSIZE\tLAST USED\tURL")
+		for _, b := range blobs {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", b.Digest, b.Size,
+				b.LastUsed.Format(time.RFC3339), strings.Join(b.URLs, ","))
+		}
+	case "prune":
+		var unused time.Duration
+		if len(opts.Args) > 1 {
+			if unused, err = time.ParseDuration(opts.Args[1]); err != nil {
+				return err
+			}
+		}
+		removed, err := cache.Prune(unused)
+		var size int64
+		for _, b := range removed {
+			size += b.Size
+		}
+		fmt.Fprintf(w, "Removed %d blobs, %d bytes\n", len(removed), size)
+		return err
+	default:
+		opts.Usage()
+		return fmt.Errorf("Invalid cache action %q, available: ls, prune", action)
+	}
+	return nil
+}
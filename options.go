@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"os"
 	"strings"
+
+	"github.com/sixstone-qq/chroot-wrapper/task"
 )
 
 // Options are the arguments given from command line
@@ -18,16 +20,116 @@ type Options struct {
 	flagset *flag.FlagSet
 	// Listening port for the supervisor, having different ports
 	// allowed us to have different tasks running at the same time
-	ListeningPort int `cfg: "port"`
+	ListeningPort int `cfg:"port"`
 	// Environment variables to pass to the task
-	env map[string]string `cfg: "env"`
+	env map[string]string `cfg:"env"`
 	// Working directory for the task
 	Dir string
+	// Directory of the image cache, empty to disable it
+	CacheDir string `cfg:"cache"`
+	// Expected digest of the image
+	Digest string `cfg:"digest"`
+	// Signature policy: skip, warn or require
+	Verify string `cfg:"verify"`
+	// Trust store with the public keys to verify signatures
+	TrustedKeys string `cfg:"trusted-keys"`
+	// Run a local root directory over a discarded writable layer
+	Scratch bool `cfg:"scratch"`
+	// Share the image extracted in the cache through an overlay
+	Overlay bool `cfg:"overlay"`
+	// Owners of the extracted files: faithful or squash
+	Ownership string `cfg:"ownership"`
+	// Restore the trusted and security extended attributes
+	TrustedXattrs bool `cfg:"trusted-xattrs"`
+	// Standard filesystems mounted inside the jail
+	Mounts string `cfg:"mounts"`
+	// Host paths bind mounted inside the jail
+	Volumes []task.Volume
+	// Mount the root filesystem read-only
+	ReadOnly bool `cfg:"read-only"`
+	// Writable tmpfs paths inside the jail
+	Tmpfs []string
+	// Network of the task: host, none or slirp
+	Network string `cfg:"net"`
+	// Host addresses forwarded to the task with slirp network
+	PortForwards []task.PortForward
+	// Hostname of the task
+	Hostname string `cfg:"hostname"`
+	// Maximum memory of the task with an optional k, m or g suffix
+	Memory string `cfg:"memory"`
+	// CPU bandwidth of the task in number of CPUs
+	CPUs float64 `cfg:"cpus"`
+	// Maximum number of processes of the task
+	Pids int64 `cfg:"pids"`
+	// Seccomp profile of the task: default, unconfined or a JSON file
+	Seccomp string `cfg:"seccomp"`
+}
+
+// volumeList is the value of repeated -v flags
+type volumeList []task.Volume
+
+func (l *volumeList) String() string {
+	if l == nil {
+		return ""
+	}
+	specs := make([]string, len(*l))
+	for i, v := range *l {
+		specs[i] = v.String()
+	}
+	return strings.Join(specs, ",")
+}
+
+func (l *volumeList) Set(spec string) error {
+	v, err := task.ParseVolume(spec)
+	if err == nil {
+		*l = append(*l, v)
+	}
+	return err
+}
+
+// portForwardList is the value of repeated -p flags
+type portForwardList []task.PortForward
+
+func (l *portForwardList) String() string {
+	if l == nil {
+		return ""
+	}
+	specs := make([]string, len(*l))
+	for i, f := range *l {
+		specs[i] = f.String()
+	}
+	return strings.Join(specs, ",")
+}
+
+func (l *portForwardList) Set(spec string) error {
+	f, err := task.ParsePortForward(spec)
+	if err == nil {
+		*l = append(*l, f)
+	}
+	return err
+}
+
+// pathList is the value of repeated path flags
+type pathList []string
+
+func (l *pathList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *pathList) Set(path string) error {
+	*l = append(*l, path)
+	return nil
 }
 
 // DefaultListeningPort is the port used by the supervisor to accept queries on tasks
 const DefaultListeningPort = 6969
 
+// subcommands are the available subcommands listed in the usage
+var subcommands = []string{"run", "cache", "ps", "stats", "kill"}
+
 // Usage prints usage from the options
 func (o *Options) Usage() {
 	o.flagset.Usage()
@@ -36,7 +138,7 @@ func (o *Options) Usage() {
 // Environ returns the environment variables from command line flags
 // in key=value form
 func (o *Options) Environ() []string {
-	res := make([]string, len(o.env))
+	res := make([]string, 0, len(o.env))
 	for k, v := range o.env {
 		res = append(res, fmt.Sprintf("%s=%s", k, v))
 	}
@@ -45,10 +147,14 @@ func (o *Options) Environ() []string {
 
 // PrintSubcommandsUsage prints the usage of subcommands
 func PrintSubcommandsUsage() {
-	fmt.Fprintf(os.Stderr, "\t [-env=[]|-wd] run URL|path cmd [args...]\n\n")
-	fmt.Fprintf(os.Stderr, "\t\tRun cmd inside an image (jailed) which is available at the given URL.\n\t\tOnly file and HTTP(S) schemes are supported.\n\t\tOnly TAR images compressed or not with GZ are supported\n\n")
+	fmt.Fprintf(os.Stderr, "\t [-env=[]|-wd|-digest|-verify|-trusted-keys|-scratch|-overlay|-ownership|-trusted-xattrs|-mounts|-v=[]|-read-only|-tmpfs=[]|-net|-p=[]|-hostname|-memory|-cpus|-pids|-seccomp] run URL|path [cmd [args...]]\n\n")
+	fmt.Fprintf(os.Stderr, "\t\tRun cmd inside an image (jailed) which is available at the given URL.\n\t\tSupported schemes are file, HTTP(S), docker and oci (registries).\n\t\tTAR images compressed or not (gz, bz2, xz, zst) are supported, also docker save\n\t\tarchives and OCI image layouts (select an image with #tag=name:tag)\n\t\tA directory path is used as the root filesystem in place\n\t\tThe image config gives the default cmd, environment, working directory and user\n\n")
+	fmt.Fprintf(os.Stderr, "\t [-cache] cache ls|prune [unused-duration]\n\n")
+	fmt.Fprintf(os.Stderr, "\t\tList the images in the cache or remove the ones not used in the given duration (all by default)\n\n")
 	fmt.Fprintf(os.Stderr, "\t ps\n\n")
 	fmt.Fprintf(os.Stderr, "\t\tGet the status of task launched with run subcommand\n\n")
+	fmt.Fprintf(os.Stderr, "\t stats [--watch [--interval duration]]\n\n")
+	fmt.Fprintf(os.Stderr, "\t\tGet the CPU time, peak RSS, I/O bytes and processes of the task launched with run subcommand,\n\t\tstreamed every interval (1s by default) until it finishes with --watch\n\n")
 	fmt.Fprintf(os.Stderr, "\t kill [signal]\n\n")
 	fmt.Fprintf(os.Stderr, "\t\tSend signal to the task launched with run subcommand\n")
 	fmt.Fprintf(os.Stderr, "\t\tPossible signal values: SIGKILL (default), SIGTERM, SIGUSR1, SIGUSR2, SIGSTOP, SIGCONT, SIGINT\n")
@@ -66,9 +172,28 @@ func setupUserOptions(args []string, errorHandling flag.ErrorHandling) *Options
 	flagSet.Int("port", opts.ListeningPort, "Supervisor listening port to query task")
 	flagSet.String("env", "", "New environment variables available for the task")
 	flagSet.String("wd", "", "Working directory to run the task")
+	flagSet.String("digest", "", "Expected digest of the image (sha256:hex or sha512:hex)")
+	flagSet.String("verify", "skip", "Policy for the image detached signature (URL.sig): skip, warn or require")
+	flagSet.String("trusted-keys", "", "File or directory with the ed25519 public keys to verify signatures")
+	flagSet.Bool("scratch", false, "Discard the changes to a root directory with a writable overlay")
+	flagSet.Bool("overlay", false, "Extract the image once in the cache and share it with an overlay")
+	flagSet.String("ownership", "faithful", "Owners of the extracted files: faithful to the image or squash to the current user")
+	flagSet.Bool("trusted-xattrs", false, "Restore the trusted and security extended attributes of the image, only the file capabilities by default")
+	flagSet.String("mounts", task.AllSystemMounts.String(), "Standard filesystems mounted inside the jail without privileges: proc, dev, sys and tmp")
+	flagSet.Var(new(volumeList), "v", "Host path bind mounted inside the jail as host:container[:ro], it can be repeated")
+	flagSet.Bool("read-only", false, "Mount the root filesystem read-only")
+	flagSet.Var(new(pathList), "tmpfs", "Path inside the jail where a writable tmpfs is mounted, it can be repeated")
+	flagSet.String("net", "host", "Network of the task: host, none to isolate it with only a loopback or slirp to relay its connections")
+	flagSet.Var(new(portForwardList), "p", "Host address forwarded to a task port with slirp network as [host:]port:taskport, it can be repeated")
+	flagSet.String("hostname", "", "Hostname of the task, the one of the host by default")
+	flagSet.String("memory", "", "Maximum memory of the task in bytes or with a k, m or g suffix, unlimited by default")
+	flagSet.Float64("cpus", 0, "CPU bandwidth of the task in number of CPUs, unlimited by default")
+	flagSet.Int64("pids", 0, "Maximum number of processes and threads of the task, unlimited by default")
+	flagSet.String("seccomp", "default", "Seccomp profile of the unprivileged tasks: default, unconfined or the path of a JSON profile in the Docker format")
+	flagSet.String("cache", task.DefaultCacheDir(), "Directory to cache the images, empty to disable it")
 	flagSet.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage %s [flags] <subcommand> [arguments]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  Available subcommands: run, ps, kill\n\n")
+		fmt.Fprintf(os.Stderr, "  Available subcommands: %s\n\n", strings.Join(subcommands, ", "))
 		PrintSubcommandsUsage()
 		flagSet.PrintDefaults()
 	}
@@ -101,6 +226,25 @@ func setupUserOptions(args []string, errorHandling flag.ErrorHandling) *Options
 		}
 	}
 	opts.Dir = flagSet.Lookup("wd").Value.String()
+	opts.CacheDir = flagSet.Lookup("cache").Value.String()
+	opts.Digest = flagSet.Lookup("digest").Value.String()
+	opts.Verify = flagSet.Lookup("verify").Value.String()
+	opts.TrustedKeys = flagSet.Lookup("trusted-keys").Value.String()
+	opts.Scratch = flagSet.Lookup("scratch").Value.(flag.Getter).Get().(bool)
+	opts.Overlay = flagSet.Lookup("overlay").Value.(flag.Getter).Get().(bool)
+	opts.Ownership = flagSet.Lookup("ownership").Value.String()
+	opts.TrustedXattrs = flagSet.Lookup("trusted-xattrs").Value.(flag.Getter).Get().(bool)
+	opts.Mounts = flagSet.Lookup("mounts").Value.String()
+	opts.Volumes = *flagSet.Lookup("v").Value.(*volumeList)
+	opts.ReadOnly = flagSet.Lookup("read-only").Value.(flag.Getter).Get().(bool)
+	opts.Tmpfs = *flagSet.Lookup("tmpfs").Value.(*pathList)
+	opts.Network = flagSet.Lookup("net").Value.String()
+	opts.PortForwards = *flagSet.Lookup("p").Value.(*portForwardList)
+	opts.Hostname = flagSet.Lookup("hostname").Value.String()
+	opts.Memory = flagSet.Lookup("memory").Value.String()
+	opts.CPUs = flagSet.Lookup("cpus").Value.(flag.Getter).Get().(float64)
+	opts.Pids = flagSet.Lookup("pids").Value.(flag.Getter).Get().(int64)
+	opts.Seccomp = flagSet.Lookup("seccomp").Value.String()
 
 	return opts
 }
@@ -0,0 +1,262 @@
+package task
+
+// Attributes of the extracted files: ownership, permissions, timestamps
+// and extended attributes. Without privileges, the owners are mapped
+// through the ID mappings of the task user namespace.
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Ownership decides who owns the extracted files
+type Ownership int
+
+const (
+	// OwnershipFaithful restores the owners from the archive. Without
+	// privileges, they are mapped to the IDs seen from the host through
+	// the task user namespace and unmapped owners are reported.
+	OwnershipFaithful Ownership = iota
+	// OwnershipSquash leaves every file owned by the current user
+	OwnershipSquash
+)
+
+var ownershipStrs = [...]string{"faithful", "squash"}
+
+func (o Ownership) String() string {
+	return ownershipStrs[o]
+}
+
+// ParseOwnership returns the ownership mode from its name
+func ParseOwnership(name string) (Ownership, error) {
+	for i, s := range ownershipStrs {
+		if s == name {
+			return Ownership(i), nil
+		}
+	}
+	return OwnershipFaithful, fmt.Errorf("Invalid ownership %q, choices: %s",
+		name, strings.Join(ownershipStrs[:], ", "))
+}
+
+// PAX record prefixes of the extended attributes written by GNU tar
+// and libarchive (bsdtar)
+const (
+	paxSchilyXattr     = "SCHILY.xattr."
+	paxLibarchiveXattr = "LIBARCHIVE.xattr."
+)
+
+// uidMappings returns the user ID mappings of the task user namespace
+func uidMappings() []syscall.SysProcIDMap {
+	return []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}}
+}
+
+// gidMappings returns the group ID mappings of the task user namespace
+func gidMappings() []syscall.SysProcIDMap {
+	return []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}}
+}
+
+// hostID returns the ID seen from the host of a task ID. Privileged
+// tasks do not have a user namespace.
+func hostID(mappings []syscall.SysProcIDMap, id int) (int, bool) {
+	if os.Geteuid() == 0 {
+		return id, true
+	}
+	for _, m := range mappings {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+// attrTarget sets the attributes of an extracted entry
+type attrTarget interface {
+	chown(uid, gid int) error
+	chmod(mode uint32) error
+	setxattr(attr string, value []byte) error
+	utimes(ts *[2]syscall.Timespec) error
+}
+
+// entryAt is the entry name in dir, never followed if it is a symlink
+type entryAt struct {
+	dir  *dirHandle
+	name string
+}
+
+func (e entryAt) chown(uid, gid int) error {
+	return e.wrap("chown", syscall.Fchownat(e.dir.fd, e.name, uid, gid, atSymlinkNofollow))
+}
+
+func (e entryAt) chmod(mode uint32) error {
+	return e.wrap("chmod", syscall.Fchmodat(e.dir.fd, e.name, mode, 0))
+}
+
+func (e entryAt) setxattr(attr string, value []byte) error {
+	return syscall.Setxattr(e.dir.procPath(e.name), attr, value, 0)
+}
+
+func (e entryAt) utimes(ts *[2]syscall.Timespec) error {
+	return e.wrap("utimensat", utimensat(e.dir.fd, e.name, ts, atSymlinkNofollow))
+}
+
+func (e entryAt) wrap(op string, err error) error {
+	if err != nil {
+		return e.dir.pathError(op, e.name, err)
+	}
+	return nil
+}
+
+// openFile is an extracted regular file still open
+type openFile struct {
+	*os.File
+}
+
+func (f openFile) chown(uid, gid int) error {
+	return f.Chown(uid, gid)
+}
+
+func (f openFile) chmod(mode uint32) error {
+	return f.wrap("chmod", syscall.Fchmod(int(f.Fd()), mode))
+}
+
+func (f openFile) setxattr(attr string, value []byte) error {
+	return fsetxattr(int(f.Fd()), attr, value, 0)
+}
+
+func (f openFile) utimes(ts *[2]syscall.Timespec) error {
+	return f.wrap("futimens", futimens(int(f.Fd()), ts))
+}
+
+func (f openFile) wrap(op string, err error) error {
+	if err != nil {
+		return &os.PathError{Op: op, Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// restoreAttrs sets the owner, the permissions and the extended
+// attributes of the entry extracted at path. The owner goes first as
+// changing it clears the setuid bits and the file capabilities.
+// Attributes which cannot be restored are reported.
+func (t *Task) restoreAttrs(target attrTarget, path string, hdr *tar.Header) error {
+	restored := true
+	if t.Options.Ownership == OwnershipFaithful {
+		uid, uok := hostID(uidMappings(), hdr.Uid)
+		gid, gok := hostID(gidMappings(), hdr.Gid)
+		if uok && gok {
+			if err := target.chown(uid, gid); err != nil {
+				return err
+			}
+		} else {
+			// Left owned by the current user
+			t.reportEntry(&t.report.Squashed, path)
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		// Symlinks have no permissions and the extended attributes
+		// would be set on their targets
+		return nil
+	}
+	if err := target.chmod(uint32(hdr.Mode & 07777)); err != nil {
+		return err
+	}
+	xattrs, err := headerXattrs(hdr)
+	if err != nil {
+		return fmt.Errorf("Extended attributes of %s: %v", path, err)
+	}
+	for attr, value := range xattrs {
+		if !t.restorableXattr(attr) {
+			continue
+		}
+		if err = target.setxattr(attr, value); err != nil {
+			// Unprivileged users cannot set security ones and some
+			// filesystems do not support them
+			restored = false
+		}
+	}
+	if !restored {
+		t.reportEntry(&t.report.Unrestored, path)
+	}
+	return nil
+}
+
+// restorableXattr returns if an extended attribute of the image is
+// restored. Overlay ones would change what the overlays of the host
+// show, the other trusted and security ones must be trusted, except
+// the file capabilities.
+func (t *Task) restorableXattr(attr string) bool {
+	switch {
+	case strings.HasPrefix(attr, "trusted.overlay."):
+		return false
+	case attr == "security.capability":
+		return true
+	case strings.HasPrefix(attr, "trusted."), strings.HasPrefix(attr, "security."):
+		return t.Options.TrustedXattrs
+	}
+	return true
+}
+
+// headerXattrs returns the extended attributes from the PAX records
+func headerXattrs(hdr *tar.Header) (map[string][]byte, error) {
+	xattrs := make(map[string][]byte)
+	for key, value := range hdr.PAXRecords {
+		switch {
+		case strings.HasPrefix(key, paxSchilyXattr):
+			xattrs[strings.TrimPrefix(key, paxSchilyXattr)] = []byte(value)
+		case strings.HasPrefix(key, paxLibarchiveXattr):
+			// URL encoded names with base64 encoded values
+			name, err := url.QueryUnescape(strings.TrimPrefix(key, paxLibarchiveXattr))
+			if err != nil {
+				return nil, err
+			}
+			data, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				if data, err = base64.RawStdEncoding.DecodeString(value); err != nil {
+					return nil, err
+				}
+			}
+			xattrs[name] = data
+		}
+	}
+	return xattrs, nil
+}
+
+// restoreTimes sets the access and modification times of an extracted
+// entry. The access time is the modification one when the archive does
+// not have it.
+func restoreTimes(target attrTarget, hdr *tar.Header) error {
+	if hdr.ModTime.IsZero() {
+		return nil
+	}
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	ts := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(hdr.ModTime.UnixNano()),
+	}
+	return target.utimes(&ts)
+}
+
+// removeAll is os.RemoveAll making writable the directories whose
+// permissions restored from the archive forbid removing their content
+func removeAll(path string) error {
+	err := os.RemoveAll(path)
+	if err == nil || os.Geteuid() == 0 {
+		return err
+	}
+	filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() && fi.Mode().Perm()&0700 != 0700 {
+			os.Chmod(p, fi.Mode().Perm()|0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
@@ -0,0 +1,447 @@
+package task
+
+// Persistent content-addressed cache of images shared between tasks.
+// Blobs are stored by their digest and the URLs they were downloaded
+// from are recorded to revalidate them with the HTTP server.
+//
+// Layout of the cache directory:
+//
+//	blobs/sha256/<hex>   content of the blobs
+//	urls/<sha256(url)>   JSON CacheEntry of a URL
+//	rootfs/sha256/<hex>  extracted images shared as overlay lower layers
+//
+// Extracted images are locked with a shared flock while tasks use them
+// and prune skips the locked ones.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// CacheDirEnv is the environment variable to override the default cache directory
+const CacheDirEnv = "CHROOT_WRAPPER_CACHE"
+
+// Cache is a directory storing blobs by digest
+type Cache struct {
+	Dir string
+}
+
+// CacheEntry is a URL whose content is stored in the cache
+type CacheEntry struct {
+	URL          string `json:"url"`
+	Digest       string `json:"digest"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// CacheBlob describes a blob stored in the cache
+type CacheBlob struct {
+	Digest   string
+	Size     int64
+	LastUsed time.Time
+	// URLs whose content is this blob
+	URLs []string
+}
+
+// DefaultCacheDir returns the cache directory from CacheDirEnv or
+// the user cache directory
+func DefaultCacheDir() string {
+	if dir := os.Getenv(CacheDirEnv); dir != "" {
+		return dir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "chroot-wrapper")
+}
+
+// OpenCache creates the cache directory if required
+func OpenCache(dir string) (*Cache, error) {
+	for _, sub := range []string{filepath.Join("blobs", "sha256"), "urls", filepath.Join("rootfs", "sha256")} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("Cache: %v", err)
+		}
+	}
+	return &Cache{Dir: dir}, nil
+}
+
+// Path returns the file where the blob with the given digest is stored
+func (c *Cache) Path(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || strings.ContainsAny(parts[1], "/.") {
+		return "", fmt.Errorf("Unsupported digest %q", digest)
+	}
+	return filepath.Join(c.Dir, "blobs", parts[0], parts[1]), nil
+}
+
+// Has returns if the blob is stored, marking it as used
+func (c *Cache) Has(digest string) bool {
+	path, err := c.Path(digest)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	return os.Chtimes(path, now, now) == nil
+}
+
+// exists returns if the blob is stored without marking it as used
+func (c *Cache) exists(digest string) bool {
+	path, err := c.Path(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// Fetch returns the path of the blob with the given digest, calling
+// fetch to store it when it is not in the cache. fetch must check the
+// content matches the digest.
+func (c *Cache) Fetch(digest string, fetch func(w io.Writer) error) (string, error) {
+	path, err := c.Path(digest)
+	if err != nil {
+		return "", err
+	}
+	if c.Has(digest) {
+		return path, nil
+	}
+	f, err := ioutil.TempFile(c.Dir, TaskFilePrefix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	err = fetch(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	// Concurrent fetches write the same content
+	return path, os.Rename(f.Name(), path)
+}
+
+// Store copies r in the cache and returns its digest and path
+func (c *Cache) Store(r io.Reader) (digest, path string, err error) {
+	w, err := c.create()
+	if err != nil {
+		return "", "", err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.discard()
+		return "", "", err
+	}
+	return w.commit()
+}
+
+// blobWriter hashes a blob while it is written in the cache
+type blobWriter struct {
+	c *Cache
+	f *os.File
+	h hash.Hash
+}
+
+// create returns a writer of a new blob, it must be committed or
+// discarded
+func (c *Cache) create() (*blobWriter, error) {
+	f, err := ioutil.TempFile(c.Dir, TaskFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{c: c, f: f, h: sha256.New()}, nil
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.h.Write(p[:n])
+	return n, err
+}
+
+// commit stores the written content and returns its digest and path
+func (w *blobWriter) commit() (digest, path string, err error) {
+	defer os.Remove(w.f.Name())
+	if err = w.f.Close(); err != nil {
+		return "", "", err
+	}
+	digest = "sha256:" + hex.EncodeToString(w.h.Sum(nil))
+	if path, err = w.c.Path(digest); err != nil {
+		return "", "", err
+	}
+	return digest, path, os.Rename(w.f.Name(), path)
+}
+
+// discard removes the written content
+func (w *blobWriter) discard() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// CachedRoot is an image extracted in the cache. It is locked until
+// it is released so that it is not pruned while it is used.
+type CachedRoot struct {
+	Path string
+	lock *os.File
+}
+
+// Release unlocks the extracted image, it is used until now
+func (r *CachedRoot) Release() error {
+	now := time.Now()
+	os.Chtimes(r.Path, now, now)
+	return r.lock.Close()
+}
+
+// RootFS returns the directory where the image with the given key is
+// extracted, calling extract to fill it when it is not in the cache.
+// The directory must not be modified and it must be released once it
+// is not used.
+func (c *Cache) RootFS(key string, extract func(dir string) error) (*CachedRoot, error) {
+	path, err := c.rootFSPath(key)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		root, err := lockRootFS(path, path)
+		if err == nil {
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			return root, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		tmp, err := ioutil.TempDir(c.Dir, TaskFilePrefix)
+		if err != nil {
+			return nil, err
+		}
+		if err = extract(tmp); err == nil {
+			// TempDir is only accessible by its owner
+			err = os.Chmod(tmp, 0755)
+		}
+		if err != nil {
+			removeAll(tmp)
+			return nil, err
+		}
+		// Locked before it can be pruned
+		if root, err = lockRootFS(tmp, path); err != nil {
+			removeAll(tmp)
+			return nil, err
+		}
+		if err = os.Rename(tmp, path); err == nil {
+			return root, nil
+		}
+		root.lock.Close()
+		removeAll(tmp)
+		// Extracted by a concurrent task
+		if _, serr := os.Stat(path); serr != nil {
+			return nil, err
+		}
+	}
+}
+
+// lockRootFS takes a shared lock of the extracted image dir which is
+// used at path. It fails with a not exist error if it was pruned.
+func lockRootFS(dir, path string) (*CachedRoot, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Lock %s: %v", dir, err)
+	}
+	// Prune removes the directories with an exclusive lock
+	locked, err := f.Stat()
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = os.Stat(dir); err == nil && !os.SameFile(locked, fi) {
+			err = &os.PathError{Op: "lock", Path: dir, Err: syscall.ENOENT}
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &CachedRoot{Path: path, lock: f}, nil
+}
+
+// pruneRootFS removes an extracted image unless a task uses it
+func pruneRootFS(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Pruned concurrently
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Lock %s: %v", path, err)
+	}
+	return removeAll(path)
+}
+
+// rootFSPath returns the directory of an extracted image
+func (c *Cache) rootFSPath(key string) (string, error) {
+	path, err := c.Path(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.Dir, "rootfs", "sha256", filepath.Base(path)), nil
+}
+
+// entryPath returns the file with the entry of the URL
+func (c *Cache) entryPath(rawurl string) string {
+	return filepath.Join(c.Dir, "urls", fmt.Sprintf("%x", sha256.Sum256([]byte(rawurl))))
+}
+
+// Entry returns the cached entry for the URL, it is nil if the URL
+// or its blob are not in the cache
+func (c *Cache) Entry(rawurl string) *CacheEntry {
+	data, err := ioutil.ReadFile(c.entryPath(rawurl))
+	if err != nil {
+		return nil
+	}
+	var e CacheEntry
+	if err = json.Unmarshal(data, &e); err != nil || e.URL != rawurl {
+		return nil
+	}
+	if !c.exists(e.Digest) {
+		return nil
+	}
+	return &e
+}
+
+// SetEntry records the entry of a URL
+func (c *Cache) SetEntry(e *CacheEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(c.Dir, TaskFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.entryPath(e.URL))
+}
+
+// entries returns all the URL entries in the cache with the file
+// where each one is stored
+func (c *Cache) entries() (map[string]*CacheEntry, error) {
+	dir := filepath.Join(c.Dir, "urls")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*CacheEntry)
+	for _, fi := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var e CacheEntry
+		if json.Unmarshal(data, &e) == nil {
+			entries[filepath.Join(dir, fi.Name())] = &e
+		}
+	}
+	return entries, nil
+}
+
+// List returns the blobs stored in the cache
+func (c *Cache) List() ([]CacheBlob, error) {
+	files, err := ioutil.ReadDir(filepath.Join(c.Dir, "blobs", "sha256"))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return nil, err
+	}
+	urls := make(map[string][]string)
+	for _, e := range entries {
+		urls[e.Digest] = append(urls[e.Digest], e.URL)
+	}
+	blobs := make([]CacheBlob, 0, len(files))
+	for _, fi := range files {
+		digest := "sha256:" + fi.Name()
+		blobs = append(blobs, CacheBlob{
+			Digest:   digest,
+			Size:     fi.Size(),
+			LastUsed: fi.ModTime(),
+			URLs:     urls[digest],
+		})
+	}
+	return blobs, nil
+}
+
+// Prune removes the blobs not used in the given duration, all of them
+// if it is zero. It returns the removed blobs. The extracted images
+// are removed too unless a task uses them.
+func (c *Cache) Prune(unused time.Duration) ([]CacheBlob, error) {
+	blobs, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var removed []CacheBlob
+	deadline := time.Now().Add(-unused)
+	for _, b := range blobs {
+		if unused > 0 && b.LastUsed.After(deadline) {
+			continue
+		}
+		path, err := c.Path(b.Digest)
+		if err != nil {
+			return removed, err
+		}
+		if err = os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, b)
+	}
+	// Remove the extracted images not used either
+	dirs, err := ioutil.ReadDir(filepath.Join(c.Dir, "rootfs", "sha256"))
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	for _, fi := range dirs {
+		if unused > 0 && fi.ModTime().After(deadline) {
+			continue
+		}
+		// Images used by running tasks are kept
+		if err = pruneRootFS(filepath.Join(c.Dir, "rootfs", "sha256", fi.Name())); err != nil {
+			return removed, err
+		}
+	}
+	// Remove the URLs whose blob is gone
+	entries, err := c.entries()
+	if err != nil {
+		return removed, err
+	}
+	for file, e := range entries {
+		if !c.exists(e.Digest) {
+			if err = os.Remove(file); err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,336 @@
+package task
+
+// Resource limits of the tasks with cgroup v2. Each task gets a leaf
+// cgroup under the one of this process, which must be delegated to the
+// user when unprivileged, and its command is cloned into it so the
+// limits apply before it execs. As only the leaves have processes,
+// this process first enters a supervisor leaf of its cgroup.
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Resources limits the resources of a task, zero values are unlimited.
+// Unless this process is in the root cgroup, it must enter a supervisor
+// cgroup with EnterSupervisorCgroup before the tasks are started.
+type Resources struct {
+	// Memory is the maximum memory in bytes
+	Memory int64
+	// CPUs is the CPU bandwidth in number of CPUs, e.g. 0.5 is half
+	// of one CPU
+	CPUs float64
+	// Pids is the maximum number of processes and threads
+	Pids int64
+}
+
+// Limited returns true if any resource is limited
+func (r Resources) Limited() bool {
+	return r.Memory > 0 || r.CPUs > 0 || r.Pids > 0
+}
+
+func (r Resources) validate() error {
+	if r.Memory < 0 || r.CPUs < 0 || r.Pids < 0 {
+		return fmt.Errorf("Invalid resources %+v, limits cannot be negative", r)
+	}
+	if math.IsNaN(r.CPUs) || math.IsInf(r.CPUs, 0) {
+		return fmt.Errorf("Invalid resources %+v, CPUs must be a finite number", r)
+	}
+	return nil
+}
+
+// controllers returns the cgroup controllers of the limited resources
+func (r Resources) controllers() []string {
+	var names []string
+	if r.Memory > 0 {
+		names = append(names, "memory")
+	}
+	if r.CPUs > 0 {
+		names = append(names, "cpu")
+	}
+	if r.Pids > 0 {
+		names = append(names, "pids")
+	}
+	return names
+}
+
+// ParseMemory returns the bytes of a size with an optional k, m or g
+// suffix for KiB, MiB and GiB
+func ParseMemory(size string) (int64, error) {
+	shift := uint(0)
+	num := strings.ToLower(size)
+	if num != "" {
+		switch num[len(num)-1] {
+		case 'k':
+			shift = 10
+		case 'm':
+			shift = 20
+		case 'g':
+			shift = 30
+		}
+		if shift > 0 {
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)>>shift {
+		return 0, fmt.Errorf("Invalid memory size %q, expected bytes with an optional k, m or g suffix", size)
+	}
+	return n << shift, nil
+}
+
+// Period of the CPU bandwidth in microseconds, the kernel default
+const cpuPeriod = 100000
+
+// cgroupParent is the cgroup where the task ones are created
+var cgroupParent struct {
+	sync.Mutex
+	path string
+}
+
+// cgroup is the leaf cgroup of a task
+type cgroup struct {
+	path string
+	// dir is opened to clone the command into the cgroup
+	dir *os.File
+}
+
+// newCgroup creates a leaf cgroup with the resource limits
+func newCgroup(r Resources) (*cgroup, error) {
+	parent, err := parentCgroup(r.controllers())
+	if err != nil {
+		return nil, err
+	}
+	path, err := ioutil.TempDir(parent, "chroot-wrapper-")
+	if err != nil {
+		return nil, fmt.Errorf("Task cgroup: %v", err)
+	}
+	c := &cgroup{path: path}
+	limits := map[string]string{}
+	if r.Memory > 0 {
+		limits["memory.max"] = strconv.FormatInt(r.Memory, 10)
+	}
+	if r.CPUs > 0 {
+		quota := int64(r.CPUs * cpuPeriod)
+		if quota < 1000 {
+			// Minimum of the kernel
+			quota = 1000
+		}
+		limits["cpu.max"] = fmt.Sprintf("%d %d", quota, cpuPeriod)
+	}
+	if r.Pids > 0 {
+		limits["pids.max"] = strconv.FormatInt(r.Pids, 10)
+	}
+	for file, value := range limits {
+		if err = ioutil.WriteFile(filepath.Join(path, file), []byte(value), 0644); err != nil {
+			c.remove()
+			return nil, fmt.Errorf("Task cgroup limit: %v", err)
+		}
+	}
+	if c.dir, err = os.Open(path); err != nil {
+		c.remove()
+		return nil, err
+	}
+	return c, nil
+}
+
+// fd returns the file descriptor to clone into the cgroup
+func (c *cgroup) fd() int {
+	return int(c.dir.Fd())
+}
+
+// remove kills the processes left in the cgroup and removes it
+func (c *cgroup) remove() {
+	if c.dir != nil {
+		c.dir.Close()
+	}
+	err := syscall.Rmdir(c.path)
+	for i := 0; err == syscall.EBUSY && i < 50; i++ {
+		// cgroup.kill is only available since Linux 5.14
+		ioutil.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0644)
+		time.Sleep(20 * time.Millisecond)
+		err = syscall.Rmdir(c.path)
+	}
+	if err != nil && err != syscall.ENOENT {
+		log.Printf("WARN: Impossible to remove the cgroup %s: %v", c.path, err)
+	}
+}
+
+// SupervisorCgroup is the leaf where this process moves so that its
+// cgroup delegates the controllers to the task ones
+type SupervisorCgroup struct {
+	parent string
+	path   string
+}
+
+// EnterSupervisorCgroup moves this process to a new leaf of its cgroup,
+// the tasks cgroups are then created next to it. Nothing is done in the
+// root cgroup. It must be left once the tasks are closed.
+func EnterSupervisorCgroup() (*SupervisorCgroup, error) {
+	cgroupParent.Lock()
+	defer cgroupParent.Unlock()
+	root, err := cgroup2Root()
+	if err != nil {
+		return nil, err
+	}
+	own, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+	s := &SupervisorCgroup{parent: filepath.Join(root, own)}
+	cgroupParent.path = s.parent
+	if own == "/" {
+		return s, nil
+	}
+	if s.path, err = ioutil.TempDir(s.parent, "supervisor-"); err != nil {
+		return nil, fmt.Errorf("Supervisor cgroup: %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(s.path, "cgroup.procs"), []byte("0"), 0644); err != nil {
+		syscall.Rmdir(s.path)
+		return nil, fmt.Errorf("Supervisor cgroup: %v", err)
+	}
+	return s, nil
+}
+
+// Leave moves this process back to its cgroup and removes the supervisor
+// leaf. The controllers enabled for the tasks are disabled, so it fails
+// if other cgroups still use them.
+func (s *SupervisorCgroup) Leave() error {
+	if s.path == "" {
+		return nil
+	}
+	cgroupParent.Lock()
+	defer cgroupParent.Unlock()
+	infos, err := ioutil.ReadDir(s.parent)
+	if err != nil {
+		return fmt.Errorf("Supervisor cgroup: %v", err)
+	}
+	for _, fi := range infos {
+		if fi.IsDir() && fi.Name() != filepath.Base(s.path) {
+			return fmt.Errorf("Supervisor cgroup %s kept, %s is still used", s.path, fi.Name())
+		}
+	}
+	// Processes cannot be in a cgroup delegating controllers
+	subtree := filepath.Join(s.parent, "cgroup.subtree_control")
+	enabled, err := ioutil.ReadFile(subtree)
+	if err != nil {
+		return fmt.Errorf("Supervisor cgroup: %v", err)
+	}
+	disable := ""
+	for _, name := range strings.Fields(string(enabled)) {
+		disable += " -" + name
+	}
+	if disable != "" {
+		if err = ioutil.WriteFile(subtree, []byte(disable[1:]), 0644); err != nil {
+			return fmt.Errorf("Supervisor cgroup: %v", err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(s.parent, "cgroup.procs"), []byte("0"), 0644); err != nil {
+		return fmt.Errorf("Supervisor cgroup: %v", err)
+	}
+	if err = syscall.Rmdir(s.path); err != nil {
+		return fmt.Errorf("Supervisor cgroup: %v", err)
+	}
+	s.path = ""
+	cgroupParent.path = ""
+	return nil
+}
+
+// parentCgroup returns the cgroup of this process, or the one of its
+// supervisor leaf, with the controllers enabled for its children
+func parentCgroup(controllers []string) (string, error) {
+	cgroupParent.Lock()
+	defer cgroupParent.Unlock()
+	if cgroupParent.path == "" {
+		root, err := cgroup2Root()
+		if err != nil {
+			return "", err
+		}
+		own, err := ownCgroup()
+		if err != nil {
+			return "", err
+		}
+		cgroupParent.path = filepath.Join(root, own)
+	}
+	parent := cgroupParent.path
+	available, err := ioutil.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	enable := ""
+	for _, name := range controllers {
+		found := false
+		for _, a := range strings.Fields(string(available)) {
+			found = found || a == name
+		}
+		if !found {
+			return "", fmt.Errorf("Cgroup controller %s not available in %s", name, parent)
+		}
+		enable += " +" + name
+	}
+	if enable == "" {
+		return parent, nil
+	}
+	err = ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(enable[1:]), 0644)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EBUSY {
+		return "", fmt.Errorf("Cgroup %s has processes, enter a supervisor cgroup first: %v", parent, err)
+	}
+	if os.IsPermission(err) {
+		return "", fmt.Errorf("Cgroup %s not delegated to the user: %v", parent, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Cgroup controllers: %v", err)
+	}
+	return parent, nil
+}
+
+// cgroup2Root returns the mount point of the cgroup v2 hierarchy, which
+// is /sys/fs/cgroup/unified in hybrid systems
+func cgroup2Root() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The filesystem type follows the - separator
+		fields := strings.Fields(scanner.Text())
+		for i := 6; i+1 < len(fields); i++ {
+			if fields[i] == "-" {
+				if fields[i+1] == "cgroup2" {
+					return unescapeMountInfo(fields[4]), nil
+				}
+				break
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("No cgroup v2 hierarchy mounted")
+}
+
+// ownCgroup returns the cgroup v2 path of this process
+func ownCgroup() (string, error) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return line[3:], nil
+		}
+	}
+	return "", fmt.Errorf("No cgroup v2 for the process")
+}
@@ -4,22 +4,45 @@ package task
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bufio"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+const archiveHeader = 262
+
+// Format of the content of an image
+type Format int
+
 const (
-	compressHeader = 3
-	archiveHeader  = 262
+	// RootFSFormat is a tar archive of the root filesystem
+	RootFSFormat Format = iota
+	// DockerArchiveFormat is a tar archive from `docker save`
+	DockerArchiveFormat
+	// OCILayoutFormat is an OCI image layout, as a directory or a tar archive
+	OCILayoutFormat
+	// RootDirFormat is a directory with the root filesystem
+	RootDirFormat
 )
 
-func isGzip(buf []byte) bool {
-	return len(buf) > compressHeader-1 &&
-		buf[0] == 0x1F && buf[1] == 0x8B && buf[2] == 0x8
+var formatStrs = [...]string{"rootfs", "docker-archive", "oci-layout", "rootfs-dir"}
+
+func (f Format) String() string {
+	return formatStrs[f]
 }
 
+// Files identifying the image formats
+const (
+	dockerManifestFile = "manifest.json"
+	ociLayoutFile      = "oci-layout"
+	ociIndexFile       = "index.json"
+)
+
 func isTar(buf []byte) bool {
 	return len(buf) > archiveHeader-1 &&
 		buf[257] == 0x75 && buf[258] == 0x73 &&
@@ -28,7 +51,8 @@ func isTar(buf []byte) bool {
 }
 
 // ValidImage checks if a given file is a valid image. It currently
-// supports: tar and gzip tar files.
+// supports: tar files, uncompressed or compressed with one of the
+// registered decompressors (gzip, bzip2, xz and zstd by default).
 //
 // It returns a bool indicating if the image is compressed and the
 // error if happens.
@@ -38,39 +62,164 @@ func ValidImage(srcFileName string) (bool, error) {
 		return false, err
 	}
 	defer src.Close()
-	gzipped, err := checkCompress(src)
+	reader, compressed, err := checkCompress(src)
 	if err != nil {
 		return false, err
 	}
-	defer gzipped.(io.Closer).Close()
-	supported, err := checkArchive(gzipped)
+	defer reader.Close()
+	supported, err := checkArchive(reader)
 	if !supported {
-		return gzipped != src, errors.New("Unknown archive")
+		return compressed, errors.New("Unknown archive")
 	}
-	return gzipped != src, nil
+	return compressed, nil
 }
 
-// checkCompress checks if the file is compressed and returned the
-// compress reader in that case
-// It returns the compressed reader or the same reader if it is not compressed.
-func checkCompress(src io.ReadSeeker) (out io.Reader, err error) {
-	buf := make([]byte, compressHeader)
-	n_read, err := src.Read(buf)
-	if n_read > 0 {
-		// Rewind
-		if _, err = src.Seek(0, 0); err != nil {
-			return nil, err
+// ImageFormat detects the format of an image file or directory
+func ImageFormat(path string) (Format, error) {
+	format, index, err := scanImage(path)
+	if index != nil {
+		index.remove()
+	}
+	return format, err
+}
+
+// scanImage detects the format of an image file or directory and
+// returns the index of the entries of image archives. The scan stops
+// at the first entry which cannot be in an image archive.
+func scanImage(path string) (Format, *archiveIndex, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return RootFSFormat, nil, err
+	}
+	if fi.IsDir() {
+		if _, err = os.Stat(filepath.Join(path, ociLayoutFile)); err == nil {
+			return OCILayoutFormat, nil, nil
 		}
+		if !isRootDir(path) {
+			return RootFSFormat, nil, fmt.Errorf("Unknown image directory %s", path)
+		}
+		return RootDirFormat, nil, nil
 	}
-	if isGzip(buf) {
-		out, err = gzip.NewReader(src)
-		if err != nil {
-			return nil, err
+
+	src, err := os.Open(path)
+	if err != nil {
+		return RootFSFormat, nil, err
+	}
+	defer src.Close()
+	reader, compressed, err := checkCompress(src)
+	if err != nil {
+		return RootFSFormat, nil, err
+	}
+	defer reader.Close()
+
+	// The entries are located in the archive itself or, when it is
+	// compressed, in a decompressed copy
+	index := &archiveIndex{path: path, entries: make(map[string]archiveSpan)}
+	archive := src
+	var tr *tar.Reader
+	if compressed {
+		if archive, err = ioutil.TempFile("", TaskFilePrefix); err != nil {
+			return RootFSFormat, nil, err
 		}
+		defer archive.Close()
+		index.path, index.temp = archive.Name(), true
+		tr = tar.NewReader(io.TeeReader(reader, archive))
 	} else {
-		out = src
+		if _, err = src.Seek(0, io.SeekStart); err != nil {
+			return RootFSFormat, nil, err
+		}
+		tr = tar.NewReader(src)
+	}
+	kept := false
+	defer func() {
+		if !kept {
+			index.remove()
+		}
+	}()
+
+	format := RootFSFormat
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return RootFSFormat, nil, err
+		}
+		name := filepath.Clean(hdr.Name)
+		if !mayBeImageArchiveEntry(name, hdr.Typeflag == tar.TypeDir) {
+			return RootFSFormat, nil, nil
+		}
+		switch name {
+		case ociLayoutFile:
+			format = OCILayoutFormat
+		case dockerManifestFile:
+			// docker save may also include manifest.json, OCI wins
+			if format != OCILayoutFormat {
+				format = DockerArchiveFormat
+			}
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			// Tar reads the headers exactly, the data starts here
+			offset, err := archive.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return RootFSFormat, nil, err
+			}
+			index.entries[name] = archiveSpan{offset: offset, size: hdr.Size}
+		}
+	}
+	if format == RootFSFormat {
+		return format, nil, nil
+	}
+	kept = true
+	return format, index, nil
+}
+
+// isRootDir returns if a directory looks like a root filesystem, with
+// at least one of the usual top-level directories
+func isRootDir(path string) bool {
+	for _, name := range []string{"bin", "usr", "etc"} {
+		if _, err := os.Lstat(filepath.Join(path, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// mayBeImageArchiveEntry returns if the path can be found in docker
+// save archives or OCI layouts: their index and layout files, JSON
+// configs, layers, blobs and legacy layer directories
+func mayBeImageArchiveEntry(path string, isDir bool) bool {
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "." || parts[0] == "blobs":
+		return true
+	case len(parts) == 1:
+		return isDir || path == "repositories" || path == ociLayoutFile ||
+			strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".tar")
+	case len(parts) == 2:
+		switch parts[1] {
+		case "VERSION", "json", "layer.tar":
+			return true
+		}
+	}
+	return false
+}
+
+// checkCompress checks if the stream is compressed with one of the
+// registered formats and returns the decompressed reader in that case.
+// It returns the reader to use and if it was compressed.
+func checkCompress(src io.Reader) (out io.ReadCloser, compressed bool, err error) {
+	br := bufio.NewReader(src)
+	// A short stream is not an error, it is not compressed
+	buf, _ := br.Peek(magicLen())
+	if c := findDecompressor(buf); c != nil {
+		out, err := c.decompress(br)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %v", c.name, err)
+		}
+		return out, true, nil
 	}
-	return out, nil
+	return ioutil.NopCloser(br), false, nil
 }
 
 // checkArchive checks if a file is a supported archive type
@@ -0,0 +1,155 @@
+package task
+
+// Registry of the decompressors of the images detected by the magic
+// numbers at the start of the stream. gzip and bzip2 are decompressed
+// with the standard library, xz and zstd with their commands which must
+// be available in the PATH.
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Decompressor returns the decompressed stream of r
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+type compression struct {
+	name       string
+	magic      []byte
+	decompress Decompressor
+}
+
+var (
+	compressionsMu sync.RWMutex
+	compressions   []compression
+)
+
+func init() {
+	RegisterDecompressor("gzip", []byte{0x1F, 0x8B, 0x08}, func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	})
+	RegisterDecompressor("bzip2", []byte("BZh"), func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	})
+	RegisterDecompressor("xz", []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}, CommandDecompressor("xz", "-dc"))
+	RegisterDecompressor("zstd", []byte{0x28, 0xB5, 0x2F, 0xFD}, CommandDecompressor("zstd", "-dcq"))
+}
+
+// RegisterDecompressor makes a compression format available for the
+// images. Streams starting with magic are decompressed with d. A format
+// registered again with the same name replaces the previous one.
+func RegisterDecompressor(name string, magic []byte, d Decompressor) {
+	compressionsMu.Lock()
+	defer compressionsMu.Unlock()
+	c := compression{name: name, magic: append([]byte(nil), magic...), decompress: d}
+	for i := range compressions {
+		if compressions[i].name == name {
+			compressions[i] = c
+			return
+		}
+	}
+	compressions = append(compressions, c)
+}
+
+// findDecompressor returns the compression whose magic number starts
+// buf, nil if there is none
+func findDecompressor(buf []byte) *compression {
+	compressionsMu.RLock()
+	defer compressionsMu.RUnlock()
+	for _, c := range compressions {
+		if len(c.magic) > 0 && bytes.HasPrefix(buf, c.magic) {
+			return &c
+		}
+	}
+	return nil
+}
+
+// magicLen returns the length to peek to detect all the formats
+func magicLen() int {
+	compressionsMu.RLock()
+	defer compressionsMu.RUnlock()
+	n := 0
+	for _, c := range compressions {
+		if len(c.magic) > n {
+			n = len(c.magic)
+		}
+	}
+	return n
+}
+
+// CommandDecompressor returns a Decompressor running a command which
+// reads the compressed stream from its standard input and writes the
+// decompressed one to its standard output
+func CommandDecompressor(name string, args ...string) Decompressor {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		cmd := exec.Command(name, args...)
+		cr := &commandReader{cmd: cmd}
+		cmd.Stderr = &cr.stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		cr.ReadCloser = stdout
+		if err = cmd.Start(); err != nil {
+			return nil, fmt.Errorf("Decompress with %s: %v", name, err)
+		}
+		// Wait does not wait for this copy, a stalled source is
+		// unblocked when its owner closes it. A failed read
+		// truncates the stream which makes the command fail.
+		go func() {
+			io.Copy(stdin, r)
+			stdin.Close()
+		}()
+		return cr, nil
+	}
+}
+
+// commandReader reads the output of a decompression command
+type commandReader struct {
+	io.ReadCloser
+	cmd     *exec.Cmd
+	stderr  bytes.Buffer
+	waitErr error
+	once    sync.Once
+}
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		// A truncated or corrupted stream is only known at the exit
+		if werr := r.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Close stops the command if the stream was not read until the end
+func (r *commandReader) Close() error {
+	r.once.Do(func() {
+		r.cmd.Process.Kill()
+		r.cmd.Wait()
+	})
+	return nil
+}
+
+func (r *commandReader) wait() error {
+	r.once.Do(func() {
+		if err := r.cmd.Wait(); err != nil {
+			r.waitErr = fmt.Errorf("%s: %v: %s", r.cmd.Path, err,
+				strings.TrimSpace(r.stderr.String()))
+		}
+	})
+	return r.waitErr
+}
@@ -0,0 +1,163 @@
+package task
+
+// Image configuration with the defaults to run a container from it
+// Reference: https://github.com/opencontainers/image-spec/blob/master/config.md
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ImageConfig holds the execution parameters of an image
+type ImageConfig struct {
+	User       string   `json:"User,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+// decodeImageConfig reads the execution parameters from an image config
+func decodeImageConfig(r io.Reader) (*ImageConfig, error) {
+	var doc struct {
+		Config ImageConfig `json:"config"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("Image config: %v", err)
+	}
+	return &doc.Config, nil
+}
+
+// Args returns the command to run: as in docker, the user arguments
+// replace Cmd and they are appended to the Entrypoint
+func (c *ImageConfig) Args(args []string) []string {
+	if len(args) == 0 {
+		args = c.Cmd
+	}
+	return append(append([]string{}, c.Entrypoint...), args...)
+}
+
+// mergeEnv returns base with the variables in env overriding it
+func mergeEnv(base, env []string) []string {
+	res := append([]string{}, base...)
+	index := make(map[string]int)
+	for i, kv := range res {
+		index[strings.SplitN(kv, "=", 2)[0]] = i
+	}
+	for _, kv := range env {
+		k := strings.SplitN(kv, "=", 2)[0]
+		if i, ok := index[k]; ok {
+			res[i] = kv
+		} else {
+			index[k] = len(res)
+			res = append(res, kv)
+		}
+	}
+	return res
+}
+
+// lookEnv gets the value of a variable from the environment
+func lookEnv(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if kvs := strings.SplitN(env[i], "=", 2); len(kvs) == 2 && kvs[0] == key {
+			return kvs[1]
+		}
+	}
+	return ""
+}
+
+// lookPathIn searches the executable file in the PATH of env inside
+// the root filesystem. The path inside the root is returned. Symlinks
+// are resolved inside the root.
+func lookPathIn(root, file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	path := lookEnv(env, "PATH")
+	if path == "" {
+		path = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	}
+	dir, err := openDirHandle(root)
+	if err != nil {
+		return "", err
+	}
+	defer dir.Close()
+	for _, d := range filepath.SplitList(path) {
+		name := filepath.Join("/", d, file)
+		resolved, err := dir.resolve(name)
+		if err != nil {
+			continue
+		}
+		if st, err := dir.lstat(resolved); err == nil &&
+			st.Mode&syscall.S_IFMT == syscall.S_IFREG && st.Mode&0111 != 0 {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("Executable %q not found in the image", file)
+}
+
+// lookupUser resolves the user[:group] from the image config, names
+// or numeric ids, to a uid and gid using the databases in the root
+// filesystem
+func lookupUser(root, user string) (uid, gid uint32, err error) {
+	dir, err := openDirHandle(root)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer dir.Close()
+	parts := strings.SplitN(user, ":", 2)
+	// The primary group of the user is the default
+	uid, gid, err = lookupID(dir, "/etc/passwd", parts[0], 2, 3)
+	if err != nil {
+		return 0, 0, fmt.Errorf("User %q: %v", parts[0], err)
+	}
+	if len(parts) == 2 {
+		if gid, _, err = lookupID(dir, "/etc/group", parts[1], 2, 2); err != nil {
+			return 0, 0, fmt.Errorf("Group %q: %v", parts[1], err)
+		}
+	}
+	return uid, gid, nil
+}
+
+// lookupID finds name (or numeric id) in a colon separated database
+// inside root returning the fields at idField and extraField
+func lookupID(root *dirHandle, db, name string, idField, extraField int) (id, extra uint32, err error) {
+	if n, err := strconv.ParseUint(name, 10, 32); err == nil {
+		id = uint32(n)
+		// Numeric id does not require to exist
+		name = ""
+	}
+	f, err := root.openFile(db)
+	if err != nil {
+		if name == "" {
+			return id, 0, nil
+		}
+		return 0, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) <= idField || len(fields) <= extraField {
+			continue
+		}
+		if (name != "" && fields[0] == name) || (name == "" && fields[idField] == strconv.FormatUint(uint64(id), 10)) {
+			fid, err1 := strconv.ParseUint(fields[idField], 10, 32)
+			fextra, err2 := strconv.ParseUint(fields[extraField], 10, 32)
+			if err1 != nil || err2 != nil {
+				return 0, 0, fmt.Errorf("Invalid entry in %s: %s", db, scanner.Text())
+			}
+			return uint32(fid), uint32(fextra), nil
+		}
+	}
+	if name == "" {
+		return id, 0, scanner.Err()
+	}
+	return 0, 0, fmt.Errorf("Not found in %s", db)
+}
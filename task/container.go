@@ -10,27 +10,89 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"syscall"
 )
 
 type Container struct {
 	Args []string
+	// Overlay mounted over the working directory before the pivot
+	// root when LowerDir is set
+	LowerDir, UpperDir, WorkDir string
+	// Standard filesystems mounted inside the jail
+	Mounts SystemMounts
+	// Volumes bind mounted inside the jail after the standard mounts
+	Volumes []Volume
+	// Paths inside the jail where a writable tmpfs is mounted
+	Tmpfs []string
+	// ReadOnly remounts the root read-only after the pivot root
+	ReadOnly bool
+	// Network of the namespace, the loopback is brought up when it
+	// is isolated
+	Network NetworkMode
+	// TapSocket where the TAP device is sent with NetworkSlirp
+	TapSocket *os.File
+	// Hostname set in the UTS namespace, if any
+	Hostname string
+	// Seccomp profile installed right before the exec, if any
+	Seccomp *SeccompProfile
 }
 
 // Run the given exec inside a container from a working directory
 func (c *Container) Run(wdir string) error {
-	name, err := exec.LookPath(c.Args[0])
-	if err != nil {
-		return fmt.Errorf("LookPath: %v", err)
-	}
 	wd, err := os.Getwd()
 	if err != nil {
 		return fmt.Errorf("Getwd: %v", err)
 	}
+	var filter []syscall.SockFilter
+	if c.Seccomp != nil {
+		if filter, err = c.Seccomp.compile(); err != nil {
+			return err
+		}
+	}
 	// Set up the container environment
+	if c.Hostname != "" {
+		if err = setHostname(c.Hostname); err != nil {
+			return err
+		}
+	}
+	switch c.Network {
+	case NetworkNone:
+		if err = loopbackUp(); err != nil {
+			return err
+		}
+	case NetworkSlirp:
+		if err = c.sendTap(); err != nil {
+			return err
+		}
+	}
+	if c.LowerDir != "" {
+		if err = mountOverlay(c.LowerDir, c.UpperDir, c.WorkDir, wd); err != nil {
+			return err
+		}
+	}
+	if err = mountSystem(wd, c.Mounts); err != nil {
+		return err
+	}
+	if _, err = mountVolumes(wd, c.Volumes); err != nil {
+		return err
+	}
+	if _, err = mountTmpfs(wd, c.Tmpfs); err != nil {
+		return err
+	}
 	if err = pivotRoot(wd); err != nil {
 		return fmt.Errorf("Pivot root: %v", err)
 	}
+	if c.ReadOnly {
+		if err = remountReadOnly("/"); err != nil {
+			return err
+		}
+	}
+	// The command is looked up inside the jail
+	name, err := exec.LookPath(c.Args[0])
+	if err != nil {
+		return fmt.Errorf("LookPath: %v", err)
+	}
 
 	log.Println("Launching", name, c.Args[1:])
 	if wdir != "" {
@@ -38,9 +100,34 @@ func (c *Container) Run(wdir string) error {
 			return fmt.Errorf("Chdir: %v", err)
 		}
 	}
+	if filter != nil {
+		// The filter applies to the thread calling exec
+		runtime.LockOSThread()
+		if err = installSeccomp(filter); err != nil {
+			return err
+		}
+	}
 	return syscall.Exec(name, c.Args, os.Environ())
 }
 
+// sendTap creates the TAP device of the user-mode network and sends it
+// to the parent which relays its traffic
+func (c *Container) sendTap() error {
+	if c.TapSocket == nil {
+		return fmt.Errorf("No socket to send the TAP device")
+	}
+	defer c.TapSocket.Close()
+	tap, err := createTap()
+	if err != nil {
+		return err
+	}
+	defer tap.Close()
+	if err = sendFile(c.TapSocket, tap); err != nil {
+		return fmt.Errorf("Send TAP device: %v", err)
+	}
+	return nil
+}
+
 // Use of pivot_root (2) in Linux
 func pivotRoot(root string) (err error) {
 	// we need this to satisfy restriction:
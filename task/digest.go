@@ -0,0 +1,102 @@
+package task
+
+// Integrity checks of the retrieved images with expected digests in
+// the form algorithm:hex as in OCI descriptors
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// DigestError is returned when an image does not match its expected digest
+type DigestError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *DigestError) Error() string {
+	return fmt.Sprintf("Digest mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// digester hashes the written content to verify its digest
+type digester struct {
+	algorithm string
+	expected  string
+	hash      hash.Hash
+}
+
+// newDigester checks the digest is valid and returns a digester for it
+func newDigester(digest string) (*digester, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid digest %q, expected algorithm:hex", digest)
+	}
+	d := &digester{algorithm: parts[0], expected: strings.ToLower(parts[1])}
+	switch d.algorithm {
+	case "sha256":
+		d.hash = sha256.New()
+	case "sha512":
+		d.hash = sha512.New()
+	default:
+		return nil, fmt.Errorf("Unsupported digest algorithm %q", d.algorithm)
+	}
+	if b, err := hex.DecodeString(d.expected); err != nil || len(b) != d.hash.Size() {
+		return nil, fmt.Errorf("Invalid %s digest %q", d.algorithm, parts[1])
+	}
+	return d, nil
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	return d.hash.Write(p)
+}
+
+// Verify returns a *DigestError if the written content does not match
+func (d *digester) Verify() error {
+	if actual := hex.EncodeToString(d.hash.Sum(nil)); actual != d.expected {
+		return &DigestError{
+			Expected: d.algorithm + ":" + d.expected,
+			Actual:   d.algorithm + ":" + actual,
+		}
+	}
+	return nil
+}
+
+// verifyFile checks the content of a file matches the digest
+func verifyFile(path, digest string) error {
+	d, err := newDigester(digest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = io.Copy(d, f); err != nil {
+		return err
+	}
+	return d.Verify()
+}
+
+// fragmentDigest returns the digest given in a URL fragment as
+// sha256=hex or sha512=hex
+func fragmentDigest(fragment string) (string, error) {
+	var digest string
+	for _, kv := range strings.Split(fragment, "&") {
+		kvs := strings.SplitN(kv, "=", 2)
+		if len(kvs) != 2 || (kvs[0] != "sha256" && kvs[0] != "sha512") {
+			continue
+		}
+		if digest != "" {
+			return "", fmt.Errorf("Several digests in the URL fragment %q", fragment)
+		}
+		digest = kvs[0] + ":" + kvs[1]
+	}
+	return digest, nil
+}
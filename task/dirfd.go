@@ -0,0 +1,325 @@
+package task
+
+// Directory handles to extract archives with the *at system calls
+// relative to the root filesystem, independently of the working
+// directory of the process. Paths are resolved component by component
+// without following symlinks.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Constants missing in syscall
+const (
+	atSymlinkNofollow = 0x100
+	atRemoveDir       = 0x200
+	oPath             = 0x200000
+)
+
+// dirHandle is an open directory
+type dirHandle struct {
+	fd   int
+	path string
+}
+
+// openDirHandle opens the directory at path
+func openDirHandle(path string) (*dirHandle, error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return &dirHandle{fd: fd, path: path}, nil
+}
+
+func (d *dirHandle) Close() error {
+	return syscall.Close(d.fd)
+}
+
+func (d *dirHandle) pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: filepath.Join(d.path, name), Err: err}
+}
+
+// openDir opens the child directory name, failing if it is a symlink
+func (d *dirHandle) openDir(name string) (*dirHandle, error) {
+	fd, err := syscall.Openat(d.fd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, d.pathError("openat", name, err)
+	}
+	return &dirHandle{fd: fd, path: filepath.Join(d.path, name)}, nil
+}
+
+// lstat returns the status of name without following symlinks
+func (d *dirHandle) lstat(name string) (*syscall.Stat_t, error) {
+	fd, err := syscall.Openat(d.fd, name, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, d.pathError("lstat", name, err)
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return nil, d.pathError("lstat", name, err)
+	}
+	return &st, nil
+}
+
+// parent opens the parent directory of the relative path and returns
+// it with the base name of path. Symlinks and other files in the way
+// are rejected with an *UnsafePathError. Missing directories are
+// created with create, otherwise an os.IsNotExist error is returned.
+func (d *dirHandle) parent(path string, create bool) (*dirHandle, string, error) {
+	dir, base := filepath.Split(path)
+	parent, err := d.openDir(".")
+	if err != nil {
+		return nil, "", err
+	}
+	for _, name := range strings.Split(filepath.Clean(dir), string(filepath.Separator)) {
+		if name == "." {
+			continue
+		}
+		child, err := parent.openDir(name)
+		if os.IsNotExist(err) && create {
+			if err = syscall.Mkdirat(parent.fd, name, 0755); err != nil && err != syscall.EEXIST {
+				parent.Close()
+				return nil, "", parent.pathError("mkdirat", name, err)
+			}
+			child, err = parent.openDir(name)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			reason := "is not a directory"
+			if st, serr := parent.lstat(name); serr == nil && st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+				reason = "is a symlink"
+			}
+			rel, _ := filepath.Rel(d.path, filepath.Join(parent.path, name))
+			err = &UnsafePathError{Path: path, Reason: rel + " " + reason}
+		}
+		parent.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		parent = child
+	}
+	return parent, base, nil
+}
+
+// readDirNames returns the names of the directory entries
+func (d *dirHandle) readDirNames() ([]string, error) {
+	fd, err := syscall.Openat(d.fd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, d.pathError("openat", ".", err)
+	}
+	f := os.NewFile(uintptr(fd), d.path)
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// removeAll removes name and its content without following symlinks.
+// The directory itself and its parent are never removed.
+func (d *dirHandle) removeAll(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return d.pathError("unlinkat", name, syscall.EINVAL)
+	}
+	err := unlinkat(d.fd, name, 0)
+	if err == nil || err == syscall.ENOENT {
+		return nil
+	}
+	if err != syscall.EISDIR {
+		return d.pathError("unlinkat", name, err)
+	}
+	child, err := d.openDir(name)
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		// Permissions restored from the archive may forbid it
+		syscall.Fchmod(child.fd, 0700)
+	}
+	names, err := child.readDirNames()
+	for _, n := range names {
+		if err == nil {
+			err = child.removeAll(n)
+		}
+	}
+	child.Close()
+	if err != nil {
+		return err
+	}
+	if err = unlinkat(d.fd, name, atRemoveDir); err != nil {
+		return d.pathError("unlinkat", name, err)
+	}
+	return nil
+}
+
+// Maximum number of symlinks followed to resolve a path, like Linux
+const maxSymlinks = 40
+
+// resolve follows the symlinks of path as if d was the root directory,
+// so absolute and .. targets never lead outside of it. The path
+// relative to d without symlinks is returned, its last component may
+// not exist.
+func (d *dirHandle) resolve(path string) (string, error) {
+	var resolved []string
+	pending := strings.Split(path, "/")
+	for links := 0; len(pending) > 0; {
+		name := pending[0]
+		pending = pending[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		current := filepath.Join(append(resolved, name)...)
+		st, err := d.lstat(current)
+		if os.IsNotExist(err) && len(pending) == 0 {
+			resolved = append(resolved, name)
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			resolved = append(resolved, name)
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", d.pathError("resolve", path, syscall.ELOOP)
+		}
+		target, err := readlinkat(d.fd, current)
+		if err != nil {
+			return "", d.pathError("readlinkat", current, err)
+		}
+		if filepath.IsAbs(target) {
+			resolved = resolved[:0]
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(append([]string{"."}, resolved...)...), nil
+}
+
+// openFile opens path for reading with its symlinks resolved inside d
+func (d *dirHandle) openFile(path string) (*os.File, error) {
+	name, err := d.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Openat(d.fd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, d.pathError("openat", name, err)
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(d.path, name)), nil
+}
+
+// procPath returns a path to name through the directory descriptor
+// for the system calls without *at variants
+func (d *dirHandle) procPath(name string) string {
+	return fmt.Sprintf("/proc/self/fd/%d/%s", d.fd, name)
+}
+
+func unlinkat(dirfd int, path string, flags int) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(flags))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func readlinkat(dirfd int, path string) (string, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, _, errno := syscall.Syscall6(syscall.SYS_READLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(size), 0, 0)
+		if errno != 0 {
+			return "", errno
+		}
+		if int(n) < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+func symlinkat(target string, dirfd int, path string) error {
+	t, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(t)), uintptr(dirfd), uintptr(unsafe.Pointer(p)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func linkat(olddirfd int, oldpath string, newdirfd int, newpath string) error {
+	o, err := syscall.BytePtrFromString(oldpath)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(newpath)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(olddirfd), uintptr(unsafe.Pointer(o)),
+		uintptr(newdirfd), uintptr(unsafe.Pointer(n)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func utimensat(dirfd int, path string, ts *[2]syscall.Timespec, flags int) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(ts)), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// futimens is utimensat on an open file
+func futimens(fd int, ts *[2]syscall.Timespec) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(fd), 0, uintptr(unsafe.Pointer(ts)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func fsetxattr(fd int, attr string, value []byte, flags int) error {
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	var v unsafe.Pointer
+	if len(value) > 0 {
+		v = unsafe.Pointer(&value[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_FSETXATTR, uintptr(fd), uintptr(unsafe.Pointer(a)),
+		uintptr(v), uintptr(len(value)), uintptr(flags), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,767 @@
+package task
+
+// Extraction of the images in the task root filesystem. Plain root
+// filesystem archives are extracted while they are retrieved, the rest
+// are extracted from the files stored on disk.
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// UnsafePathError is returned when an archive entry would be extracted
+// or a filesystem mounted outside the root filesystem
+type UnsafePathError struct {
+	Path   string
+	Reason string
+}
+
+func (e *UnsafePathError) Error() string {
+	return fmt.Sprintf("Unsafe path %s: %s", e.Path, e.Reason)
+}
+
+// ExtractReport lists the archive entries which could not be extracted
+// as they are
+type ExtractReport struct {
+	// Substituted device nodes created as empty regular files as
+	// there are no privileges to create them
+	Substituted []string
+	// Skipped entries whose type is not supported
+	Skipped []string
+	// Squashed entries owned by the current user as their owner is
+	// not mapped in the task user namespace
+	Squashed []string
+	// Unrestored entries whose extended attributes could not be set
+	Unrestored []string
+	// Files and Bytes of the regular files extracted in Duration
+	Files, Bytes int64
+	Duration     time.Duration
+}
+
+// Throughput returns the bytes of the regular files extracted per second
+func (r *ExtractReport) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+// reportEntry adds path to a list of the report, entries are reported
+// by the body writers too
+func (t *Task) reportEntry(list *[]string, path string) {
+	t.reportMu.Lock()
+	defer t.reportMu.Unlock()
+	*list = append(*list, path)
+}
+
+// ExtractReport returns the entries substituted or skipped while
+// extracting the image of the task
+func (t *Task) ExtractReport() ExtractReport {
+	t.RLock()
+	defer t.RUnlock()
+	return t.report
+}
+
+// log reports the throughput and warns about the entries not
+// extracted as they are
+func (r *ExtractReport) log() {
+	log.Printf("Extracted %d files, %d bytes in %v (%.1f MB/s)",
+		r.Files, r.Bytes, r.Duration.Round(time.Millisecond), r.Throughput()/1e6)
+	if len(r.Substituted) > 0 {
+		log.Printf("WARN: %d device nodes replaced by empty files without privileges: %s",
+			len(r.Substituted), strings.Join(r.Substituted, ", "))
+	}
+	if len(r.Skipped) > 0 {
+		log.Printf("WARN: %d entries of unsupported types skipped: %s",
+			len(r.Skipped), strings.Join(r.Skipped, ", "))
+	}
+	if len(r.Squashed) > 0 {
+		log.Printf("WARN: %d entries owned by the current user as their owner is not mapped: %s",
+			len(r.Squashed), strings.Join(r.Squashed, ", "))
+	}
+	if len(r.Unrestored) > 0 {
+		log.Printf("WARN: %d entries without their extended attributes: %s",
+			len(r.Unrestored), strings.Join(r.Unrestored, ", "))
+	}
+}
+
+// errImageArchive is returned when a stream turns out to be an image
+// archive with layers instead of a root filesystem
+var errImageArchive = errors.New("Image archive with layers")
+
+// Prepare retrieves and extracts the image of the task if it is not
+// done yet. Images are extracted while they are retrieved unless they
+// must be stored: cache, digest or signature verification and image
+// archives with layers.
+func (t *Task) Prepare() error {
+	t.Lock()
+	defer t.Unlock()
+	return t.prepare()
+}
+
+func (t *Task) prepare() (err error) {
+	if len(t.dirimage) > 0 {
+		return nil
+	}
+	if root := t.rootDir(); root != "" {
+		if err = t.checkSignature(); err != nil {
+			return err
+		}
+		return t.useRootDir(root)
+	}
+	if t.image == nil && len(t.layers) == 0 {
+		if t.streamable() {
+			if err = t.streamImage(); err != errImageArchive {
+				if err != nil {
+					t.removeImageDir()
+				} else {
+					t.report.log()
+				}
+				return err
+			}
+			// Read the layers of the archive
+			t.removeImageDir()
+		}
+		if t.image != nil {
+			// Already stored in the cache or spooled while it was streamed
+			err = t.checkImage()
+		} else {
+			err = t.Retrieve()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if t.Options.Overlay && t.Cache != nil {
+		err = t.useCachedRoot()
+	} else if err = t.extractImage(); err != nil {
+		// Extract the content in dirimage
+		t.removeImageDir()
+	}
+	if err == nil {
+		t.report.log()
+	}
+	return err
+}
+
+// streamable returns if the image can be extracted while it is
+// retrieved. Images are extracted once in the cache with overlays.
+func (t *Task) streamable() bool {
+	if t.Options.Overlay && t.Cache != nil || t.Options.Digest != "" || t.Options.SignaturePolicy != SignatureSkip {
+		return false
+	}
+	switch t.URL.Scheme {
+	case "http", "https":
+		return true
+	case "file":
+		fi, err := os.Stat(t.URL.Path)
+		return err == nil && fi.Mode().IsRegular()
+	}
+	return false
+}
+
+// rootDir returns the local root filesystem directory of the task
+// image, empty if it is not one
+func (t *Task) rootDir() string {
+	if t.URL.Scheme != "file" {
+		return ""
+	}
+	if format, err := ImageFormat(t.URL.Path); err != nil || format != RootDirFormat {
+		return ""
+	}
+	return t.URL.Path
+}
+
+// useRootDir uses a local directory as the task root, through an
+// overlay with the Scratch option
+func (t *Task) useRootDir(root string) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	if !t.Options.Scratch {
+		t.dirimage, t.local = root, true
+		return nil
+	}
+	return t.useOverlay(root)
+}
+
+// useCachedRoot extracts the image once in the cache and uses it as
+// the lower layer of the task overlay
+func (t *Task) useCachedRoot() error {
+	key, err := t.imageKey()
+	if err != nil {
+		return err
+	}
+	root, err := t.Cache.RootFS(key, func(dir string) error {
+		return t.extractLayers(dir)
+	})
+	if err != nil {
+		return err
+	}
+	if err = t.useOverlay(root.Path); err != nil {
+		root.Release()
+		return err
+	}
+	t.cachedRoot = root
+	return nil
+}
+
+// imageKey identifies the content of the image from its layers and
+// the ownership of the extracted files
+func (t *Task) imageKey() (string, error) {
+	h := sha256.New()
+	if t.Options.Ownership != OwnershipFaithful {
+		// Extracted with other owners
+		fmt.Fprintln(h, t.Options.Ownership)
+	}
+	if t.Options.TrustedXattrs {
+		// Extracted with other extended attributes
+		fmt.Fprintln(h, "trusted-xattrs")
+	}
+	for _, layer := range t.imageLayers() {
+		digest, err := t.layerDigest(layer)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(h, digest)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// layerDigest returns the digest of a layer, hashing it unless it is
+// a cached blob
+func (t *Task) layerDigest(layer blob) (string, error) {
+	if layer.entry == "" && filepath.Dir(layer.path) == filepath.Join(t.Cache.Dir, "blobs", "sha256") {
+		return "sha256:" + filepath.Base(layer.path), nil
+	}
+	r, err := layer.open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// useOverlay uses an overlay over a read-only lower directory as the
+// task root. It is copied if overlays are not available.
+func (t *Task) useOverlay(root string) error {
+	o, err := newOverlay(root)
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() == 0 {
+		err = o.mount()
+	} else if !overlaySupported() {
+		err = errors.New("Overlay filesystem not supported")
+	} else if compareKernel(kernelVersion(), unprivilegedOverlayKernel) < 0 {
+		// Unprivileged overlays are mounted in the task namespace,
+		// older kernels fail with EPERM once the task is started
+		err = fmt.Errorf("Unprivileged overlays require Linux %s", unprivilegedOverlayKernel)
+	}
+	if err != nil {
+		log.Printf("WARN: %v, copying %s", err, root)
+		if err = o.copy(); err != nil {
+			o.remove()
+			return err
+		}
+	}
+	t.overlay, t.dirimage = o, o.root()
+	return nil
+}
+
+// rootfs returns the directory with the root filesystem content seen
+// from the host
+func (t *Task) rootfs() string {
+	if t.overlay != nil && t.overlay.inNamespace() {
+		return t.overlay.lower
+	}
+	return t.dirimage
+}
+
+// removeImageDir removes the extracted image
+func (t *Task) removeImageDir() {
+	if len(t.dirimage) > 0 && !t.local {
+		removeAll(t.dirimage)
+	}
+	t.dirimage = ""
+}
+
+// streamImage extracts a root filesystem archive while it is retrieved.
+// It returns errImageArchive if the archive contains an image with layers.
+func (t *Task) streamImage() (err error) {
+	if t.Cache != nil && (t.URL.Scheme == "http" || t.URL.Scheme == "https") {
+		return t.streamCached()
+	}
+	src, err := t.openImage()
+	if err != nil {
+		return err
+	}
+	defer checkedClose(src, &err)
+	if t.URL.Scheme == "file" {
+		return t.streamArchive(src)
+	}
+	return t.streamSpooled(src)
+}
+
+// streamSpooled extracts a downloaded image while it is spooled in a
+// temporary file. If it turns out to be an image archive, the whole
+// image is kept to read its layers without downloading it again.
+func (t *Task) streamSpooled(src io.Reader) error {
+	spool, err := ioutil.TempFile("", TaskFilePrefix)
+	if err != nil {
+		return err
+	}
+	// Decompression commands may still read the body once closed
+	body := &lockedReader{r: io.TeeReader(src, spool)}
+	err = t.streamArchive(body)
+	if err == errImageArchive {
+		if _, cerr := io.Copy(ioutil.Discard, body); cerr != nil {
+			err = cerr
+		}
+	}
+	if cerr := spool.Close(); cerr != nil && err == errImageArchive {
+		err = cerr
+	}
+	if err != errImageArchive {
+		os.Remove(spool.Name())
+		return err
+	}
+	t.image = spool
+	return err
+}
+
+// streamCached extracts an image from an HTTP server while it is
+// stored in the cache. The whole image is stored, even if it turns out
+// to be an image archive, to read its layers without retrieving it again.
+func (t *Task) streamCached() error {
+	path, resp, err := t.requestCached()
+	if err != nil {
+		return err
+	}
+	if resp == nil {
+		// Not modified, extract the cached image
+		if err = t.useCachedImage(path); err != nil {
+			return err
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		return t.streamArchive(src)
+	}
+	defer resp.Body.Close()
+	w, err := t.Cache.create()
+	if err != nil {
+		return fmt.Errorf("Cache: %v", err)
+	}
+	// Decompression commands may still read the body once closed
+	body := &lockedReader{r: io.TeeReader(resp.Body, w)}
+	err = t.streamArchive(body)
+	if err != nil && err != errImageArchive {
+		w.discard()
+		return err
+	}
+	// Store the rest of the image, at least the end of the archive
+	_, cerr := io.Copy(ioutil.Discard, body)
+	if cerr != nil {
+		w.discard()
+		return cerr
+	}
+	digest, path, cerr := w.commit()
+	if cerr == nil {
+		cerr = t.setCacheEntry(resp, digest)
+	}
+	if cerr == nil {
+		cerr = t.useCachedImage(path)
+	}
+	if cerr != nil {
+		return fmt.Errorf("Cache: %v", cerr)
+	}
+	return err
+}
+
+// lockedReader serializes the reads of a source
+type lockedReader struct {
+	sync.Mutex
+	r io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.r.Read(p)
+}
+
+// streamArchive extracts a root filesystem archive read from src in a
+// new image directory
+func (t *Task) streamArchive(src io.Reader) (err error) {
+	if t.dirimage, err = ioutil.TempDir("", TaskFilePrefix); err != nil {
+		return fmt.Errorf("TempDir: %v", err)
+	}
+	t.report = ExtractReport{}
+	start := time.Now()
+	err = t.extractArchive(t.dirimage, src, true)
+	t.report.Duration = time.Since(start)
+	return err
+}
+
+// imageLayers returns the layers of the retrieved image, a plain root
+// filesystem archive is a single layer
+func (t *Task) imageLayers() []blob {
+	if len(t.layers) == 0 {
+		return []blob{{path: t.image.Name()}}
+	}
+	return t.layers
+}
+
+// Extract a image in the dirimage applying its layers in order
+func (t *Task) extractImage() (err error) {
+	if t.dirimage, err = ioutil.TempDir("", TaskFilePrefix); err != nil {
+		return fmt.Errorf("TempDir: %v", err)
+	}
+	return t.extractLayers(t.dirimage)
+}
+
+// extractLayers extracts the layers in order in dir
+func (t *Task) extractLayers(dir string) error {
+	t.report = ExtractReport{}
+	start := time.Now()
+	defer func() {
+		t.report.Duration = time.Since(start)
+	}()
+	for _, layer := range t.imageLayers() {
+		if err := t.extractLayer(dir, layer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Extract a layer tarball, compressed or not, in dir over the previous
+// layers
+func (t *Task) extractLayer(dir string, layer blob) (err error) {
+	image, err := layer.open()
+	if err != nil {
+		return
+	}
+	defer checkedClose(image, &err)
+	return t.extractArchive(dir, image, false)
+}
+
+// maxImageArchiveFile is the size limit of the manifest.json and
+// oci-layout files read to detect image archives
+const maxImageArchiveFile = 1 << 20
+
+// isImageArchiveFile returns if the content of a top-level manifest.json
+// or oci-layout file is the one of a docker save archive or an OCI layout
+func isImageArchiveFile(path string, data []byte) bool {
+	switch path {
+	case dockerManifestFile:
+		var manifests []struct {
+			Config string
+			Layers []string
+		}
+		if json.Unmarshal(data, &manifests) != nil || len(manifests) == 0 {
+			return false
+		}
+		for _, m := range manifests {
+			if m.Config == "" || m.Layers == nil {
+				return false
+			}
+		}
+		return true
+	case ociLayoutFile:
+		var layout struct {
+			ImageLayoutVersion string `json:"imageLayoutVersion"`
+		}
+		return json.Unmarshal(data, &layout) == nil && layout.ImageLayoutVersion != ""
+	}
+	return false
+}
+
+// extractArchive extracts a tar stream, compressed or not, in the dir
+// root directory. Compression is sniffed from the first bytes and the
+// content is decompressed and extracted as it arrives. When rootfsOnly
+// is set, it fails with errImageArchive once the manifest of a docker
+// save archive or the layout file of an OCI layout is found.
+//
+// Every path is resolved from dir without following symlinks, the
+// working directory is never used.
+func (t *Task) extractArchive(dir string, src io.Reader, rootfsOnly bool) (err error) {
+	reader, _, err := checkCompress(src)
+	if err != nil {
+		return
+	}
+	defer checkedClose(reader, &err)
+	root, err := openDirHandle(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	writers := newBodyWriters(t.Options.ExtractWorkers)
+	dirs, err := t.extractEntries(root, tar.NewReader(reader), writers, rootfsOnly)
+	if werr := writers.Close(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	// Directories are completed once their content is extracted
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = t.completeDir(root, dirs[i]); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+// extractEntries extracts the entries of a tar stream in the root
+// directory and returns the directories to complete
+func (t *Task) extractEntries(root *dirHandle, tr *tar.Reader, writers *bodyWriters, rootfsOnly bool) ([]dirEntry, error) {
+	state := newLayerState()
+	var dirs []dirEntry
+	// Image archives only have entries which may be in them
+	mayBeImage := rootfsOnly
+	for entries := 0; ; entries++ {
+		hdr, err := tr.Next()
+		if err != nil && rootfsOnly && entries == 0 {
+			// The archive was not checked before streaming it
+			return nil, errors.New("Unknown archive")
+		} else if err == io.EOF {
+			// End of the tar archive
+			return dirs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		path, err := entryPath(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		var body io.Reader = tr
+		if mayBeImage {
+			mayBeImage = mayBeImageArchiveEntry(path, hdr.Typeflag == tar.TypeDir)
+		}
+		if mayBeImage && (path == dockerManifestFile || path == ociLayoutFile) &&
+			hdr.Typeflag == tar.TypeReg && hdr.Size <= maxImageArchiveFile {
+			data := make([]byte, hdr.Size)
+			if _, err = io.ReadFull(tr, data); err != nil {
+				return nil, err
+			}
+			if isImageArchiveFile(path, data) {
+				return nil, errImageArchive
+			}
+			body = bytes.NewReader(data)
+		}
+		if path == "." {
+			// The root directory already exists
+			continue
+		}
+		isDir, err := t.extractEntry(root, state, body, writers, hdr, path)
+		if err == nil {
+			err = writers.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isDir {
+			dirs = append(dirs, dirEntry{path, hdr})
+		}
+	}
+}
+
+// extractEntry extracts an archive entry at the relative path in the
+// root directory. Directories are only created, they are returned to
+// be completed at the end.
+func (t *Task) extractEntry(root *dirHandle, state *layerState, body io.Reader, writers *bodyWriters, hdr *tar.Header, path string) (isDir bool, err error) {
+	// Archives may not include the parent directories, whiteout
+	// files are never extracted so they do not need them
+	isWhiteout := strings.HasPrefix(filepath.Base(path), WhiteoutPrefix)
+	dir, name, err := root.parent(path, !isWhiteout)
+	if err != nil {
+		if isWhiteout && os.IsNotExist(err) {
+			// Nothing to remove
+			return false, nil
+		}
+		return false, err
+	}
+	defer dir.Close()
+	if isWhiteout, err := state.whiteout(dir, path); isWhiteout {
+		if _, ok := err.(*UnsafePathError); ok {
+			return false, err
+		} else if err != nil {
+			return false, fmt.Errorf("Whiteout %s: %v", path, err)
+		}
+		return false, nil
+	}
+	if err = state.replace(dir, path, hdr.Typeflag == tar.TypeDir); err != nil {
+		return false, err
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		// Writable until its content is extracted
+		if err = syscall.Mkdirat(dir.fd, name, 0755); err != nil && err != syscall.EEXIST {
+			return false, dir.pathError("mkdirat", name, err)
+		}
+		return true, nil
+	case tar.TypeReg, tar.TypeGNUSparse, tar.TypeCont:
+		// Sparse files are read with their holes filled with zeros
+		fd, err := syscall.Openat(dir.fd, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC,
+			uint32(os.FileMode(hdr.Mode).Perm()))
+		if err != nil {
+			return false, dir.pathError("openat", name, err)
+		}
+		t.report.Files++
+		t.report.Bytes += hdr.Size
+		err = writers.write(os.NewFile(uintptr(fd), path), body, hdr, func(f *os.File) error {
+			if err := t.restoreAttrs(openFile{f}, path, hdr); err != nil {
+				return err
+			}
+			return restoreTimes(openFile{f}, hdr)
+		})
+		if err != nil {
+			return false, fmt.Errorf("Write %s: %v", path, err)
+		}
+		return false, nil
+	case tar.TypeLink:
+		target, err := entryPath(hdr.Linkname)
+		if err != nil {
+			return false, err
+		}
+		tdir, tname, err := root.parent(target, false)
+		if err != nil {
+			return false, err
+		}
+		err = linkat(tdir.fd, tname, dir.fd, name)
+		tdir.Close()
+		if err != nil {
+			return false, dir.pathError("linkat", name, err)
+		}
+		// The attributes are the ones of the target
+		return false, nil
+	case tar.TypeSymlink:
+		target := hdr.Linkname
+		if filepath.IsAbs(hdr.Linkname) {
+			// Relative to the link in the root directory
+			abspath := filepath.Join(string(filepath.Separator), filepath.Dir(path))
+			if target, err = filepath.Rel(abspath, hdr.Linkname); err != nil {
+				return false, err
+			}
+		}
+		// The target is never created nor followed while extracting
+		if err = symlinkat(target, dir.fd, name); err != nil && err != syscall.EEXIST {
+			return false, dir.pathError("symlinkat", name, err)
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err = t.mknod(dir, name, path, hdr); err != nil {
+			return false, err
+		}
+	case tar.TypeXGlobalHeader:
+		// Only PAX records for the next entries
+		return false, nil
+	default:
+		t.reportEntry(&t.report.Skipped, path)
+		return false, nil
+	}
+	if err = t.restoreAttrs(entryAt{dir, name}, path, hdr); err != nil {
+		return false, err
+	}
+	return false, restoreTimes(entryAt{dir, name}, hdr)
+}
+
+// dirEntry is a directory extracted from an archive
+type dirEntry struct {
+	path string
+	hdr  *tar.Header
+}
+
+// completeDir restores the attributes of an extracted directory
+func (t *Task) completeDir(root *dirHandle, d dirEntry) error {
+	dir, name, err := root.parent(d.path, false)
+	if err != nil {
+		// Removed later in the archive
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer dir.Close()
+	if st, err := dir.lstat(name); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		// Replaced later in the archive
+		return nil
+	}
+	if err = t.restoreAttrs(entryAt{dir, name}, d.path, d.hdr); err != nil {
+		return err
+	}
+	return restoreTimes(entryAt{dir, name}, d.hdr)
+}
+
+// mknod creates the device node or the FIFO name in dir. Device nodes
+// are replaced by empty regular files when there are no privileges to
+// create them.
+func (t *Task) mknod(dir *dirHandle, name, path string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	err := syscall.Mknodat(dir.fd, name, mode, mkdev(hdr.Devmajor, hdr.Devminor))
+	if err == syscall.EPERM && hdr.Typeflag != tar.TypeFifo {
+		t.reportEntry(&t.report.Substituted, path)
+		var fd int
+		if fd, err = syscall.Openat(dir.fd, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0); err == nil {
+			err = syscall.Close(fd)
+		}
+	}
+	if err != nil {
+		return dir.pathError("mknodat", name, err)
+	}
+	return nil
+}
+
+// mkdev returns the device number from its major and minor numbers in
+// the Linux encoding
+func mkdev(major, minor int64) int {
+	return int(minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12 | (major&^0xfff)<<32)
+}
+
+// entryPath returns the path of an archive entry relative to the root.
+// Absolute names are made relative like tar does and the names whose
+// .. components escape the root are rejected.
+func entryPath(name string) (string, error) {
+	path := filepath.Clean(name)
+	if filepath.IsAbs(path) {
+		path = strings.TrimLeft(path, string(filepath.Separator))
+		if path == "" {
+			path = "."
+		}
+	}
+	if path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return "", &UnsafePathError{Path: name, Reason: "outside the root"}
+	}
+	return path, nil
+}
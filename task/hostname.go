@@ -0,0 +1,121 @@
+package task
+
+// The tasks get their own UTS and IPC namespaces so they cannot see nor
+// change the hostname and the System V IPC objects of the host. With a
+// hostname, the /etc/hostname and /etc/hosts of the jail are generated
+// and bind mounted like the volumes.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// Maximum length of a hostname in Linux
+const maxHostnameLen = 64
+
+// validateHostname checks that name is a valid hostname: dot separated
+// labels of letters, digits and hyphens not starting nor ending with one
+func validateHostname(name string) error {
+	if name == "" || len(name) > maxHostnameLen {
+		return fmt.Errorf("Invalid hostname %q, length must be 1-%d", name, maxHostnameLen)
+	}
+	for _, label := range strings.Split(name, ".") {
+		valid := label != "" && label[0] != '-' && label[len(label)-1] != '-'
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				valid = false
+			}
+		}
+		if !valid {
+			return fmt.Errorf("Invalid hostname %q", name)
+		}
+	}
+	return nil
+}
+
+// setHostname changes the hostname of the current UTS namespace
+func setHostname(name string) error {
+	if err := syscall.Sethostname([]byte(name)); err != nil {
+		return fmt.Errorf("Hostname %s: %v", name, err)
+	}
+	return nil
+}
+
+// Paths of the generated files inside the jail
+const (
+	etcHostname = "/etc/hostname"
+	etcHosts    = "/etc/hosts"
+)
+
+// writeEtcFiles writes the /etc/hostname and /etc/hosts of hostname in
+// a new temporary directory and returns it with the volumes to mount
+// them. The files covered by the given volumes are not generated.
+func writeEtcFiles(hostname string, network NetworkMode, volumes []Volume) (dir string, etc []Volume, err error) {
+	addr := "127.0.1.1"
+	if network == NetworkSlirp {
+		addr = net.IP(usernetGuestIP[:]).String()
+	}
+	files := map[string]string{
+		etcHostname: hostname + "\n",
+		etcHosts: "127.0.0.1\tlocalhost\n" +
+			"::1\tlocalhost ip6-localhost ip6-loopback\n" +
+			addr + "\t" + hostname + "\n",
+	}
+	if dir, err = ioutil.TempDir("", "chroot-wrapper-etc-"); err != nil {
+		return "", nil, err
+	}
+	for _, path := range []string{etcHostname, etcHosts} {
+		if coveredByVolume(path, volumes) {
+			continue
+		}
+		file := filepath.Join(dir, filepath.Base(path))
+		if err = ioutil.WriteFile(file, []byte(files[path]), 0644); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+		etc = append(etc, Volume{HostPath: file, Path: path})
+	}
+	return dir, etc, nil
+}
+
+// coveredByVolume returns true if path inside the jail is a volume or
+// is inside one
+func coveredByVolume(path string, volumes []Volume) bool {
+	for _, v := range volumes {
+		vpath := filepath.Clean(v.Path)
+		if path == vpath || strings.HasPrefix(path, vpath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// startUnshared starts cmd in the new namespaces given by the clone
+// flags prepared by the setup functions. It requires privileges.
+func startUnshared(cmd *exec.Cmd, flags int, setup ...func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine
+		// instead of running others in the namespaces
+		runtime.LockOSThread()
+		if err := syscall.Unshare(flags); err != nil {
+			errc <- fmt.Errorf("Task namespaces: %v", err)
+			return
+		}
+		for _, f := range setup {
+			if err := f(); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
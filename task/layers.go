@@ -0,0 +1,116 @@
+package task
+
+// Layered images are a stack of tar changesets applied in order from
+// the base layer. Removals from lower layers are represented with
+// whiteout files.
+// Reference: https://github.com/opencontainers/image-spec/blob/master/layer.md
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// WhiteoutPrefix marks a removed file: .wh.name removes name
+	WhiteoutPrefix = ".wh."
+	// WhiteoutOpaque marks a directory whose lower content is hidden
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// layerState tracks the paths created while extracting a layer as an
+// opaque whiteout only hides the content from the lower layers
+type layerState struct {
+	created map[string]bool
+	// parents of the created paths, which may be lower directories
+	// merged with the layer ones
+	parents map[string]bool
+}
+
+func newLayerState() *layerState {
+	return &layerState{created: make(map[string]bool), parents: make(map[string]bool)}
+}
+
+// whiteout applies the entry at path, whose base name is in dir, if
+// it is a whiteout file and returns if it was one. Whiteout files are
+// never extracted.
+func (ls *layerState) whiteout(dir *dirHandle, path string) (bool, error) {
+	parent, base := filepath.Split(path)
+	switch {
+	case base == WhiteoutOpaque:
+		return true, ls.hideLower(dir, filepath.Clean(parent))
+	case strings.HasPrefix(base, WhiteoutPrefix):
+		name := strings.TrimPrefix(base, WhiteoutPrefix)
+		if !validWhiteoutTarget(name) {
+			return true, &UnsafePathError{Path: path, Reason: "invalid whiteout target"}
+		}
+		return true, dir.removeAll(name)
+	}
+	return false, nil
+}
+
+// validWhiteoutTarget returns if a whiteout file can remove name, which
+// must be an entry of its directory and not another whiteout file
+func validWhiteoutTarget(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.Contains(name, "/") && !strings.HasPrefix(name, WhiteoutPrefix)
+}
+
+// hideLower removes the content of dir, at path, from the lower layers.
+// The directories listed in the layer before the opaque whiteout are
+// merged with the lower ones, so their lower content is removed too.
+func (ls *layerState) hideLower(dir *dirHandle, path string) error {
+	names, err := dir.readDirNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		child := filepath.Join(path, name)
+		if !ls.created[child] && !ls.parents[child] {
+			if err = dir.removeAll(name); err != nil {
+				return err
+			}
+			continue
+		}
+		st, err := dir.lstat(name)
+		if err != nil {
+			return err
+		}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			continue
+		}
+		sub, err := dir.openDir(name)
+		if err != nil {
+			return err
+		}
+		err = ls.hideLower(sub, child)
+		sub.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace prepares path, whose base name is in dir, to be created by
+// the current layer removing what a lower layer left there.
+// Directories are merged unless they are replaced by another file type.
+func (ls *layerState) replace(dir *dirHandle, path string, isDir bool) error {
+	ls.created[path] = true
+	for p := filepath.Dir(path); p != "."; p = filepath.Dir(p) {
+		ls.parents[p] = true
+	}
+	name := filepath.Base(path)
+	st, err := dir.lstat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if isDir && st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		return nil
+	}
+	return dir.removeAll(name)
+}
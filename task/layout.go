@@ -0,0 +1,295 @@
+package task
+
+// Images stored locally with their layers: `docker save` archives and
+// OCI image layouts, either as a directory or archived.
+// Reference: https://github.com/opencontainers/image-spec/blob/master/image-layout.md
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RefNameAnnotation is the annotation with the tag of a manifest in an index
+const RefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// blob is a content stored in a file or in an entry of a tar archive
+type blob struct {
+	// file where the content is stored
+	path string
+	// name of the entry when the file is a tar archive, with its
+	// location in the archive
+	entry string
+	span  archiveSpan
+	// the file is removed when the task is closed
+	temp bool
+	// digest of the content verified when it is read, if any
+	digest string
+}
+
+// open returns a reader of the content of the blob
+func (b blob) open() (io.ReadCloser, error) {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.ReadCloser = f
+	if b.entry != "" {
+		r = &archiveEntry{Reader: io.NewSectionReader(f, b.span.offset, b.span.size), file: f}
+	}
+	if b.digest != "" {
+		d, err := newDigester(b.digest)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r = &verifiedReader{ReadCloser: r, digester: d}
+	}
+	return r, nil
+}
+
+// verifiedReader checks the content matches its digest once it is read
+// until the end, the rest is read when it is closed before
+type verifiedReader struct {
+	io.ReadCloser
+	digester *digester
+}
+
+func (v *verifiedReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.digester.Write(p[:n])
+	if err == io.EOF {
+		if verr := v.digester.Verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+func (v *verifiedReader) Close() error {
+	_, err := io.Copy(ioutil.Discard, v)
+	if cerr := v.ReadCloser.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// archiveEntry reads an entry and closes the archive when done
+type archiveEntry struct {
+	io.Reader
+	file *os.File
+}
+
+func (a *archiveEntry) Close() error {
+	return a.file.Close()
+}
+
+// archiveSpan is the location of the content of a tar entry
+type archiveSpan struct {
+	offset, size int64
+}
+
+// archiveIndex locates the regular files of an uncompressed tar
+// archive, a temporary copy for compressed ones
+type archiveIndex struct {
+	path    string
+	temp    bool
+	entries map[string]archiveSpan
+}
+
+// remove removes the temporary copy of the archive
+func (i *archiveIndex) remove() {
+	if i.temp {
+		os.Remove(i.path)
+	}
+}
+
+// imageStore locates the files of an image directory or archive
+type imageStore struct {
+	path string
+	// index of the archive, nil for directories
+	index *archiveIndex
+}
+
+// blob returns the file with the given name relative to the store.
+// Names escaping the store are rejected.
+func (s imageStore) blob(name string) (blob, error) {
+	if filepath.IsAbs(name) {
+		return blob{}, fmt.Errorf("Invalid absolute path %q in the image", name)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return blob{}, fmt.Errorf("Invalid path %q outside the image", name)
+		}
+	}
+	name = filepath.Clean(name)
+	if s.index == nil {
+		return blob{path: filepath.Join(s.path, name)}, nil
+	}
+	span, ok := s.index.entries[name]
+	if !ok {
+		return blob{}, fmt.Errorf("Missing %s in %s", name, s.path)
+	}
+	return blob{path: s.index.path, entry: name, span: span, temp: s.index.temp}, nil
+}
+
+// digestBlob returns the blob of a content addressed by its digest,
+// which is verified when it is read
+func (s imageStore) digestBlob(digest string) (blob, error) {
+	d, err := newDigester(digest)
+	if err != nil {
+		return blob{}, err
+	}
+	b, err := s.blob(filepath.Join("blobs", d.algorithm, d.expected))
+	b.digest = digest
+	return b, err
+}
+
+// decodeJSON decodes the JSON content of a blob in v
+func decodeJSON(b blob, v interface{}) (err error) {
+	r, err := b.open()
+	if err != nil {
+		return err
+	}
+	defer checkedClose(r, &err)
+	if err = json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", filepath.Base(b.path+"/"+b.entry), err)
+	}
+	return nil
+}
+
+// normalizeTag adds the default tag to a name without it
+func normalizeTag(tag string) string {
+	if tag != "" && !strings.Contains(tag[strings.LastIndex(tag, "/")+1:], ":") {
+		tag += ":" + DefaultTag
+	}
+	return tag
+}
+
+// resolveLocalImage returns the config and layers of the image stored
+// in the given format at path, indexed when it is an archive. When
+// there are several images, tag selects one of them.
+func resolveLocalImage(path string, index *archiveIndex, format Format, tag string) (config blob, layers []blob, err error) {
+	store := imageStore{path: path, index: index}
+	switch format {
+	case DockerArchiveFormat:
+		return resolveDockerArchive(store, normalizeTag(tag))
+	case OCILayoutFormat:
+		return resolveOCILayout(store, tag)
+	}
+	return config, nil, fmt.Errorf("Image format %s has no layers", format)
+}
+
+// resolveDockerArchive reads the manifest.json from `docker save`
+func resolveDockerArchive(store imageStore, tag string) (config blob, layers []blob, err error) {
+	var manifests []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	b, err := store.blob(dockerManifestFile)
+	if err != nil {
+		return
+	}
+	if err = decodeJSON(b, &manifests); err != nil {
+		return
+	}
+	selected := -1
+	for i, m := range manifests {
+		if tag == "" {
+			if len(manifests) > 1 {
+				return config, nil, fmt.Errorf("The archive contains %d images, select one by tag", len(manifests))
+			}
+			selected = i
+		}
+		for _, repoTag := range m.RepoTags {
+			if normalizeTag(repoTag) == tag || strings.HasSuffix(normalizeTag(repoTag), "/"+tag) {
+				selected = i
+			}
+		}
+	}
+	if selected < 0 {
+		return config, nil, fmt.Errorf("Image %q not found in the archive", tag)
+	}
+	m := manifests[selected]
+	for _, l := range m.Layers {
+		if b, err = store.blob(l); err != nil {
+			return config, nil, err
+		}
+		layers = append(layers, b)
+	}
+	config, err = store.blob(m.Config)
+	return config, layers, err
+}
+
+// resolveOCILayout reads the index.json from an OCI image layout
+func resolveOCILayout(store imageStore, tag string) (config blob, layers []blob, err error) {
+	var index Manifest
+	b, err := store.blob(ociIndexFile)
+	if err != nil {
+		return
+	}
+	if err = decodeJSON(b, &index); err != nil {
+		return
+	}
+	var desc Descriptor
+	switch {
+	case tag != "":
+		found := false
+		for _, d := range index.Manifests {
+			name := d.Annotations[RefNameAnnotation]
+			if name == tag || normalizeTag(name) == normalizeTag(tag) ||
+				strings.HasSuffix(normalizeTag(name), ":"+tag) {
+				desc, found = d, true
+				break
+			}
+		}
+		if !found {
+			return config, nil, fmt.Errorf("Image %q not found in the layout", tag)
+		}
+	case len(index.Manifests) == 1:
+		desc = index.Manifests[0]
+	default:
+		if desc, err = matchPlatform(index.Manifests); err != nil {
+			return config, nil, fmt.Errorf("The layout contains %d images, select one by tag", len(index.Manifests))
+		}
+	}
+
+	for depth := 0; ; depth++ {
+		b, err := store.digestBlob(desc.Digest)
+		if err != nil {
+			return config, nil, err
+		}
+		var m Manifest
+		if err = decodeJSON(b, &m); err != nil {
+			return config, nil, err
+		}
+		if m.MediaType == "" {
+			m.MediaType = desc.MediaType
+		}
+		if m.IsIndex() {
+			if depth == maxIndexDepth {
+				return config, nil, fmt.Errorf("More than %d nested indexes in the layout", maxIndexDepth)
+			}
+			if desc, err = matchPlatform(m.Manifests); err != nil {
+				return config, nil, err
+			}
+			continue
+		}
+		if config, err = store.digestBlob(m.Config.Digest); err != nil {
+			return config, nil, err
+		}
+		for _, l := range m.Layers {
+			b, err := store.digestBlob(l.Digest)
+			if err != nil {
+				return config, nil, err
+			}
+			layers = append(layers, b)
+		}
+		return config, layers, nil
+	}
+}
@@ -0,0 +1,84 @@
+package task
+
+// Image manifests as defined by the OCI image specification and its
+// Docker Image Manifest V2 ancestor.
+// Reference: https://github.com/opencontainers/image-spec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// Media types of the manifests we understand
+const (
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// Descriptor references a content by its digest
+type Descriptor struct {
+	MediaType   string            `json:"mediaType,omitempty"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Platform describes the architecture and OS an image is built for
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Manifest is either an image manifest (Config and Layers are set) or
+// an index pointing to manifests for several platforms (Manifests is set)
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// IsIndex returns if the manifest is a list of manifests
+func (m *Manifest) IsIndex() bool {
+	return m.MediaType == MediaTypeOCIIndex ||
+		m.MediaType == MediaTypeDockerManifestList ||
+		(len(m.Manifests) > 0 && len(m.Layers) == 0)
+}
+
+// decodeManifest reads a JSON manifest, the media type from the
+// transport is used when the document does not include it
+func decodeManifest(r io.Reader, mediaType string) (*Manifest, error) {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("Manifest: %v", err)
+	}
+	if m.MediaType == "" {
+		m.MediaType = mediaType
+	}
+	return &m, nil
+}
+
+// matchPlatform selects the manifest which fits the running OS and
+// architecture from an index
+func matchPlatform(manifests []Descriptor) (Descriptor, error) {
+	for _, d := range manifests {
+		if d.Platform == nil {
+			continue
+		}
+		if d.Platform.OS == runtime.GOOS && d.Platform.Architecture == runtime.GOARCH {
+			return d, nil
+		}
+	}
+	// Single manifest without platform information
+	if len(manifests) == 1 && manifests[0].Platform == nil {
+		return manifests[0], nil
+	}
+	return Descriptor{}, fmt.Errorf("No image available for %s/%s", runtime.GOOS, runtime.GOARCH)
+}
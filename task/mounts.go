@@ -0,0 +1,341 @@
+package task
+
+// Standard filesystems of a container mounted inside the jail: a procfs
+// of the task PID namespace, a /dev with the safe devices of the host,
+// a read-only sysfs and a /tmp tmpfs. They are mounted in the root
+// before the pivot root while the host filesystems are still visible
+// as the kernel requires them to mount procfs and sysfs in a user
+// namespace.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SystemMounts is a set of standard filesystems mounted inside the jail
+type SystemMounts int
+
+const (
+	// MountProc mounts a procfs of the task at /proc
+	MountProc SystemMounts = 1 << iota
+	// MountDev mounts a tmpfs at /dev with the safe devices of the host
+	MountDev
+	// MountSys mounts a read-only sysfs at /sys
+	MountSys
+	// MountTmp mounts a tmpfs at /tmp
+	MountTmp
+
+	AllSystemMounts = MountProc | MountDev | MountSys | MountTmp
+)
+
+var systemMountStrs = [...]string{"proc", "dev", "sys", "tmp"}
+
+func (m SystemMounts) String() string {
+	var names []string
+	for i, s := range systemMountStrs {
+		if m&(1<<uint(i)) != 0 {
+			names = append(names, s)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseSystemMounts returns the set of mounts from a comma separated
+// list of their names, empty for none
+func ParseSystemMounts(list string) (SystemMounts, error) {
+	var m SystemMounts
+	for _, name := range strings.Split(list, ",") {
+		if name == "" {
+			continue
+		}
+		found := false
+		for i, s := range systemMountStrs {
+			if s == name {
+				m |= 1 << uint(i)
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("Invalid mount %q, choices: %s",
+				name, strings.Join(systemMountStrs[:], ", "))
+		}
+	}
+	return m, nil
+}
+
+// Devices of the host bind mounted in /dev
+var safeDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// Symlinks created in /dev
+var devSymlinks = [][2]string{
+	{"/proc/self/fd", "fd"},
+	{"/proc/self/fd/0", "stdin"},
+	{"/proc/self/fd/1", "stdout"},
+	{"/proc/self/fd/2", "stderr"},
+}
+
+const (
+	mountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+	// Mount flags missing in syscall
+	msRelatime = 1 << 21
+)
+
+// mountSystem mounts the given standard filesystems in root
+func mountSystem(root string, mounts SystemMounts) error {
+	if mounts&MountProc != 0 {
+		if err := mountAt(root, "/proc", "proc", "proc", mountFlags, ""); err != nil {
+			return err
+		}
+	}
+	if mounts&MountDev != 0 {
+		if err := mountDev(root); err != nil {
+			return err
+		}
+	}
+	if mounts&MountSys != 0 {
+		err := mountAt(root, "/sys", "sysfs", "sysfs", mountFlags|syscall.MS_RDONLY, "")
+		if os.IsPermission(err) {
+			// Only possible with a network namespace owned by the
+			// task user namespace, the one of the host is used
+			if err = bindMount(root, "/sys", "/sys", true); err == nil {
+				err = remountReadOnlyTree(root, "/sys", true)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if mounts&MountTmp != 0 {
+		if err := mountAt(root, "/tmp", "tmpfs", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountTmpfs mounts writable tmpfs at the paths inside root. It
+// returns the paths of the ones mounted until the first error.
+func mountTmpfs(root string, paths []string) (mounted []string, err error) {
+	for _, path := range paths {
+		if err = checkJailPath(path); err != nil {
+			return mounted, err
+		}
+		if err = mountAt(root, path, "tmpfs", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return mounted, err
+		}
+		mounted = append(mounted, filepath.Join(root, path))
+	}
+	return mounted, nil
+}
+
+// mountReadOnlyRoot bind mounts root over itself read-only, its
+// submounts stay writable
+func mountReadOnlyRoot(root string) error {
+	if err := syscall.Mount(root, root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return &os.PathError{Op: "bind mount", Path: root, Err: err}
+	}
+	return remountReadOnly(root)
+}
+
+// mountDev mounts a tmpfs at /dev populated with the safe devices
+func mountDev(root string) error {
+	if err := mountAt(root, "/dev", "tmpfs", "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=755,size=64k"); err != nil {
+		return err
+	}
+	dev := filepath.Join(root, "dev")
+	for _, name := range safeDevices {
+		src := filepath.Join("/dev", name)
+		if _, err := os.Stat(src); err != nil {
+			// Not available in the host, e.g. tty without terminal
+			continue
+		}
+		if err := bindMount(root, src, filepath.Join("/dev", name), false); err != nil {
+			return err
+		}
+	}
+	for _, link := range devSymlinks {
+		if err := os.Symlink(link[0], filepath.Join(dev, link[1])); err != nil {
+			return err
+		}
+	}
+	return mountAt(root, "/dev/shm", "shm", "tmpfs", mountFlags, "mode=1777")
+}
+
+// mountAt mounts a filesystem at target inside root, creating the
+// target directory if it does not exist
+func mountAt(root, target, source, fstype string, flags uintptr, data string) error {
+	f, err := mountTarget(root, target, true)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = syscall.Mount(source, fdPath(f), fstype, flags, data); err != nil {
+		return &os.PathError{Op: "mount " + fstype, Path: target, Err: err}
+	}
+	return nil
+}
+
+// bindMount mounts the host path src with its submounts at target
+// inside root, which is a directory if dir or a file otherwise
+func bindMount(root, src, target string, dir bool) error {
+	f, err := mountTarget(root, target, dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = syscall.Mount(src, fdPath(f), "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return &os.PathError{Op: "bind mount " + src, Path: target, Err: err}
+	}
+	return nil
+}
+
+// mountTarget creates the directory or the file target inside root if
+// it does not exist and returns it opened to mount over it. Symlinks
+// are not followed so the mounts cannot escape from root.
+func mountTarget(root, target string, dir bool) (*os.File, error) {
+	path := strings.TrimPrefix(filepath.Clean("/"+target), "/")
+	if path == "" {
+		return nil, &UnsafePathError{Path: target, Reason: "is the root"}
+	}
+	rootDir, err := openDirHandle(root)
+	if err != nil {
+		return nil, err
+	}
+	defer rootDir.Close()
+	parent, name, err := rootDir.parent(path, true)
+	if err != nil {
+		return nil, err
+	}
+	defer parent.Close()
+	if dir {
+		err = syscall.Mkdirat(parent.fd, name, 0755)
+	} else {
+		var fd int
+		if fd, err = syscall.Openat(parent.fd, name, syscall.O_CREAT|syscall.O_EXCL|syscall.O_CLOEXEC, 0644); err == nil {
+			syscall.Close(fd)
+		}
+	}
+	if err != nil && err != syscall.EEXIST {
+		return nil, parent.pathError("create", name, err)
+	}
+	fd, err := syscall.Openat(parent.fd, name, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, parent.pathError("openat", name, err)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, parent.pathError("fstat", name, err)
+	}
+	reason := ""
+	switch mode := st.Mode & syscall.S_IFMT; {
+	case mode == syscall.S_IFLNK:
+		reason = "is a symlink"
+	case dir && mode != syscall.S_IFDIR:
+		reason = "is not a directory"
+	case !dir && mode == syscall.S_IFDIR:
+		reason = "is a directory"
+	}
+	if reason != "" {
+		syscall.Close(fd)
+		return nil, &UnsafePathError{Path: target, Reason: reason}
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(root, path)), nil
+}
+
+// fdPath returns the path to an open file through /proc
+func fdPath(f *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+}
+
+// remountReadOnly makes the mount at path read-only. The flags of the
+// mount are kept as the locked ones cannot be cleared in a user
+// namespace.
+func remountReadOnly(path string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	// The statfs flags ST_* have the values of the MS_* ones except
+	// ST_RELATIME
+	const stRelatime = 4096
+	flags |= uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+		syscall.MS_NOATIME | syscall.MS_NODIRATIME)
+	if st.Flags&stRelatime != 0 {
+		flags |= msRelatime
+	}
+	if err := syscall.Mount("", path, "", flags, ""); err != nil {
+		return &os.PathError{Op: "remount read-only", Path: path, Err: err}
+	}
+	return nil
+}
+
+// remountReadOnlyTree makes read-only the mount at target inside root
+// and its submounts. The mount is remounted through its descriptor and
+// the submounts are found from its resolved path as root may not be.
+func remountReadOnlyTree(root, target string, dir bool) error {
+	mount, err := mountTarget(root, target, dir)
+	if err != nil {
+		return err
+	}
+	defer mount.Close()
+	if err = remountReadOnly(fdPath(mount)); err != nil {
+		if perr, ok := err.(*os.PathError); ok {
+			perr.Path = mount.Name()
+		}
+		return err
+	}
+	path, err := os.Readlink(fdPath(mount))
+	if err != nil {
+		return err
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var points []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The mount point is the fifth field with octal escapes
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		if point := unescapeMountInfo(fields[4]); strings.HasPrefix(point, path+"/") {
+			points = append(points, point)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	// Mounts are listed from the parents
+	for _, point := range points {
+		if err = remountReadOnly(point); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unescapeMountInfo decodes the \ooo escapes of the mountinfo fields
+func unescapeMountInfo(field string) string {
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
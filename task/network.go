@@ -0,0 +1,273 @@
+package task
+
+// Network isolation of the tasks with network namespaces. The
+// unprivileged tasks create it with their user namespace and bring the
+// loopback up inside, the privileged ones are started from a thread
+// moved to a new network namespace, see startUnshared. With user-mode
+// networking, a TAP device created in the namespace is passed to this
+// process which relays its traffic, see usernet.go.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// NetworkMode decides the network stack of the tasks
+type NetworkMode int
+
+const (
+	// NetworkHost shares the network stack of the host
+	NetworkHost NetworkMode = iota
+	// NetworkNone isolates the task in a network namespace with only
+	// the loopback interface
+	NetworkNone
+	// NetworkSlirp isolates the task in a network namespace whose
+	// connections are relayed in user mode by this process like slirp
+	// does. It does not require privileges.
+	NetworkSlirp
+)
+
+var networkStrs = [...]string{"host", "none", "slirp"}
+
+func (n NetworkMode) String() string {
+	return networkStrs[n]
+}
+
+// ParseNetworkMode returns the network mode from its name
+func ParseNetworkMode(name string) (NetworkMode, error) {
+	for i, s := range networkStrs {
+		if s == name {
+			return NetworkMode(i), nil
+		}
+	}
+	return NetworkHost, fmt.Errorf("Invalid network %q, choices: %s",
+		name, strings.Join(networkStrs[:], ", "))
+}
+
+// PortForward forwards the TCP connections to a host address to a port
+// of a task with user-mode networking
+type PortForward struct {
+	// HostAddr is the host:port to listen to
+	HostAddr string
+	// Port of the task
+	Port int
+}
+
+// ParsePortForward returns the port forward from its
+// [host:]port:taskport form. The host is 127.0.0.1 by default.
+func ParsePortForward(spec string) (f PortForward, err error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return f, fmt.Errorf("Invalid port forward %q, expected [host:]port:taskport", spec)
+	}
+	if f.Port, err = strconv.Atoi(spec[i+1:]); err != nil || f.Port <= 0 || f.Port > 65535 {
+		return f, fmt.Errorf("Invalid port forward %q, wrong task port", spec)
+	}
+	f.HostAddr = spec[:i]
+	if !strings.Contains(f.HostAddr, ":") {
+		f.HostAddr = net.JoinHostPort("127.0.0.1", f.HostAddr)
+	}
+	_, port, err := net.SplitHostPort(f.HostAddr)
+	if n, perr := strconv.Atoi(port); err != nil || perr != nil || n < 0 || n > 65535 {
+		return f, fmt.Errorf("Invalid port forward %q, wrong host address", spec)
+	}
+	return f, nil
+}
+
+func (f PortForward) String() string {
+	return f.HostAddr + ":" + strconv.Itoa(f.Port)
+}
+
+// Addresses of the user-mode network, the ones of slirp
+var (
+	usernetGuestIP   = [4]byte{10, 0, 2, 15}
+	usernetGatewayIP = [4]byte{10, 0, 2, 2}
+	usernetDNSIP     = [4]byte{10, 0, 2, 3}
+	usernetNetmask   = [4]byte{255, 255, 255, 0}
+	usernetGuestMAC  = [6]byte{0x52, 0x55, 0x0a, 0x00, 0x02, 0x0f}
+	usernetMAC       = [6]byte{0x52, 0x55, 0x0a, 0x00, 0x02, 0x02}
+)
+
+// TapSocketFd is the file descriptor of the unix socket where the
+// TAP device is sent to the parent with slirp networking
+const TapSocketFd = 3
+
+// Constants missing in syscall
+const (
+	tunSetIff = 0x400454ca
+	iffTap    = 0x0002
+	iffNoPi   = 0x1000
+	tapName   = "tap0"
+)
+
+// ifreqAddr is the struct ifreq with an IPv4 or hardware address
+type ifreqAddr struct {
+	name [syscall.IFNAMSIZ]byte
+	addr syscall.RawSockaddrInet4
+	_    [8]byte
+}
+
+// rtentry is the struct rtentry to add routes
+type rtentry struct {
+	pad1    uintptr
+	dst     syscall.RawSockaddrInet4
+	gateway syscall.RawSockaddrInet4
+	genmask syscall.RawSockaddrInet4
+	flags   uint16
+	pad2    int16
+	pad3    uintptr
+	pad4    uintptr
+	metric  int16
+	dev     *byte
+	mtu     uintptr
+	window  uintptr
+	irtt    uint16
+}
+
+// createTap creates the TAP device of the user-mode network in the
+// current network namespace with its address and the default route
+// through the gateway, and brings it and the loopback up
+func createTap() (*os.File, error) {
+	if err := loopbackUp(); err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/dev/net/tun", Err: err}
+	}
+	tap := os.NewFile(uintptr(fd), tapName)
+	if err = configureTap(fd); err != nil {
+		tap.Close()
+		return nil, err
+	}
+	return tap, nil
+}
+
+func configureTap(fd int) error {
+	var req ifreqFlags
+	copy(req.name[:], tapName)
+	req.flags = iffTap | iffNoPi
+	if err := ioctl(fd, tunSetIff, unsafe.Pointer(&req)); err != nil {
+		return fmt.Errorf("TAP device: %v", err)
+	}
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("TAP socket: %v", err)
+	}
+	defer syscall.Close(sock)
+	var hw ifreqFlags
+	copy(hw.name[:], tapName)
+	// The hardware address is a struct sockaddr
+	hwaddr := (*[16]byte)(unsafe.Pointer(&hw.flags))
+	hwaddr[0] = syscall.ARPHRD_ETHER
+	copy(hwaddr[2:], usernetGuestMAC[:])
+	if err = ioctl(sock, syscall.SIOCSIFHWADDR, unsafe.Pointer(&hw)); err != nil {
+		return fmt.Errorf("TAP hardware address: %v", err)
+	}
+	for _, a := range []struct {
+		req  uint
+		addr [4]byte
+	}{
+		{syscall.SIOCSIFADDR, usernetGuestIP},
+		{syscall.SIOCSIFNETMASK, usernetNetmask},
+	} {
+		var ifr ifreqAddr
+		copy(ifr.name[:], tapName)
+		ifr.addr = syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: a.addr}
+		if err = ioctl(sock, a.req, unsafe.Pointer(&ifr)); err != nil {
+			return fmt.Errorf("TAP address: %v", err)
+		}
+	}
+	var up ifreqFlags
+	copy(up.name[:], tapName)
+	if err = ioctl(sock, syscall.SIOCGIFFLAGS, unsafe.Pointer(&up)); err == nil {
+		up.flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+		err = ioctl(sock, syscall.SIOCSIFFLAGS, unsafe.Pointer(&up))
+	}
+	if err != nil {
+		return fmt.Errorf("TAP up: %v", err)
+	}
+	dev := append([]byte(tapName), 0)
+	route := rtentry{
+		dst:     syscall.RawSockaddrInet4{Family: syscall.AF_INET},
+		gateway: syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: usernetGatewayIP},
+		genmask: syscall.RawSockaddrInet4{Family: syscall.AF_INET},
+		flags:   syscall.RTF_UP | syscall.RTF_GATEWAY,
+		dev:     &dev[0],
+	}
+	if err = ioctl(sock, syscall.SIOCADDRT, unsafe.Pointer(&route)); err != nil {
+		return fmt.Errorf("TAP default route: %v", err)
+	}
+	return nil
+}
+
+// sendFile sends f through the unix socket conn
+func sendFile(conn *os.File, f *os.File) error {
+	rights := syscall.UnixRights(int(f.Fd()))
+	return syscall.Sendmsg(int(conn.Fd()), []byte{0}, rights, nil, 0)
+}
+
+// recvFile receives a file sent with sendFile through conn
+func recvFile(conn *os.File, name string) (*os.File, error) {
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(int(conn.Fd()), buf, oob, syscall.MSG_CMSG_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, errors.New("No file received")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		return nil, errors.New("No file received")
+	}
+	return os.NewFile(uintptr(fds[0]), name), nil
+}
+
+// ifreqFlags is the struct ifreq to get and set the interface flags
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// loopbackUp brings up the loopback interface of the network namespace
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Loopback socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	var req ifreqFlags
+	copy(req.name[:], "lo")
+	if err = ioctl(fd, syscall.SIOCGIFFLAGS, unsafe.Pointer(&req)); err != nil {
+		return fmt.Errorf("Loopback flags: %v", err)
+	}
+	req.flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	if err = ioctl(fd, syscall.SIOCSIFFLAGS, unsafe.Pointer(&req)); err != nil {
+		return fmt.Errorf("Loopback up: %v", err)
+	}
+	return nil
+}
+
+func ioctl(fd int, req uint, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
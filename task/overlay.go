@@ -0,0 +1,178 @@
+package task
+
+// Writable scratch layers over read-only root directories with the
+// overlay filesystem. Privileged tasks mount the overlay in the host,
+// unprivileged ones inside their mount namespace. A full copy of the
+// lower directory is used when overlays are not available.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// overlay of a read-only lower directory with a writable upper one
+type overlay struct {
+	// dir contains the upper, work and root (merged) directories
+	dir   string
+	lower string
+	// mounted in the host mount namespace
+	mounted bool
+	// lower copied in the root instead of mounted
+	copied bool
+}
+
+// newOverlay creates the directories of an overlay over lower
+func newOverlay(lower string) (o *overlay, err error) {
+	if strings.ContainsAny(lower, ",:") {
+		return nil, fmt.Errorf("Invalid overlay lower directory %s", lower)
+	}
+	o = &overlay{lower: lower}
+	if o.dir, err = ioutil.TempDir("", TaskFilePrefix); err != nil {
+		return nil, fmt.Errorf("TempDir: %v", err)
+	}
+	for _, sub := range []string{o.upper(), o.work(), o.root()} {
+		if err = os.Mkdir(sub, 0755); err != nil {
+			removeAll(o.dir)
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *overlay) upper() string { return filepath.Join(o.dir, "upper") }
+func (o *overlay) work() string  { return filepath.Join(o.dir, "work") }
+
+// root is where the overlay is mounted
+func (o *overlay) root() string { return filepath.Join(o.dir, "root") }
+
+// mount the overlay in the host
+func (o *overlay) mount() error {
+	if err := mountOverlay(o.lower, o.upper(), o.work(), o.root()); err != nil {
+		return err
+	}
+	o.mounted = true
+	return nil
+}
+
+// copy the lower directory in the root instead of mounting it
+func (o *overlay) copy() error {
+	if err := copyTree(o.lower, o.root()); err != nil {
+		return fmt.Errorf("Copy %s: %v", o.lower, err)
+	}
+	o.copied = true
+	return nil
+}
+
+// inNamespace returns if the overlay must be mounted in the mount
+// namespace of the task
+func (o *overlay) inNamespace() bool {
+	return !o.mounted && !o.copied
+}
+
+// remove unmounts the overlay and removes its directories
+func (o *overlay) remove() {
+	if o.mounted {
+		syscall.Unmount(o.root(), syscall.MNT_DETACH)
+		o.mounted = false
+	}
+	removeAll(o.dir)
+}
+
+// mountOverlay mounts the overlay of lower and upper at target
+func mountOverlay(lower, upper, work, target string) error {
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if err := syscall.Mount("overlay", target, "overlay", 0, opts); err != nil {
+		return fmt.Errorf("Mount overlay: %v", err)
+	}
+	return nil
+}
+
+// unprivilegedOverlayKernel is the first kernel version where overlays
+// can be mounted in a user namespace
+const unprivilegedOverlayKernel = "5.11"
+
+// overlaySupported returns if the kernel has the overlay filesystem
+func overlaySupported() bool {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == "overlay" {
+			return true
+		}
+	}
+	return false
+}
+
+// copyTree copies the files, directories and symlinks from src to the
+// existing directory dst. Directories are writable until their content
+// is copied.
+func copyTree(src, dst string) error {
+	type dirPerm struct {
+		path string
+		perm os.FileMode
+	}
+	var dirs []dirPerm
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch mode := fi.Mode(); {
+		case mode.IsDir():
+			if rel == "." {
+				return nil
+			}
+			dirs = append(dirs, dirPerm{target, mode.Perm()})
+			return os.Mkdir(target, 0700)
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			return copyFile(path, target, mode.Perm())
+		}
+		// Devices, sockets and pipes are not copied
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = os.Chmod(dirs[i].path, dirs[i].perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer checkedClose(out, &err)
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,258 @@
+package task
+
+// Client side of the Docker Registry HTTP API V2 (OCI distribution
+// spec) to retrieve images stored in registries.
+// Reference: https://github.com/opencontainers/distribution-spec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// DefaultRegistry is used when a docker:// reference has no registry
+	DefaultRegistry = "registry-1.docker.io"
+	// DefaultTag is used when a reference has neither tag nor digest
+	DefaultTag = "latest"
+	// maxIndexDepth is the number of nested indexes followed to find
+	// the manifest of an image
+	maxIndexDepth = 2
+)
+
+// registry is a repository in a registry
+type registry struct {
+	// base URL (scheme and host) of the registry
+	base string
+	// repository name
+	repo string
+	// bearer token from the authorization server
+	token  string
+	client *http.Client
+}
+
+// isRegistryScheme returns if the scheme is retrieved from a registry
+func isRegistryScheme(scheme string) bool {
+	return scheme == "docker" || scheme == "oci"
+}
+
+// parseReference translates a registry reference in the form
+// scheme://[host/]repo[:tag|@digest] to a URL. The host is mandatory
+// for the oci scheme, docker scheme defaults to Docker Hub.
+func parseReference(rawref string) (*url.URL, error) {
+	parts := strings.SplitN(rawref, "://", 2)
+	if len(parts) != 2 || !isRegistryScheme(parts[0]) {
+		return nil, fmt.Errorf("Invalid registry reference %q", rawref)
+	}
+	scheme, name := parts[0], parts[1]
+	fragment := ""
+	if i := strings.Index(name, "#"); i >= 0 {
+		name, fragment = name[:i], name[i+1:]
+	}
+	if name == "" || strings.HasSuffix(name, "/") {
+		return nil, fmt.Errorf("Missing repository in %q", rawref)
+	}
+	host := ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		// Same heuristic as docker to guess if there is a registry host
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			host, name = first, name[i+1:]
+		}
+	}
+	if host == "" {
+		if scheme == "oci" {
+			return nil, fmt.Errorf("Missing registry host in %q", rawref)
+		}
+		host = DefaultRegistry
+	}
+	if host == "docker.io" || host == "index.docker.io" {
+		host = DefaultRegistry
+	}
+	if host == DefaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if !strings.Contains(name, "@") && !strings.Contains(name[strings.LastIndex(name, "/")+1:], ":") {
+		name += ":" + DefaultTag
+	}
+	return &url.URL{Scheme: scheme, Host: host, Path: "/" + name, Fragment: fragment}, nil
+}
+
+// splitReference returns the repository and the tag or digest from the
+// URL path
+func splitReference(u *url.URL) (repo, ref string) {
+	name := strings.TrimPrefix(u.Path, "/")
+	if i := strings.Index(name, "@"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	i := strings.LastIndex(name, ":")
+	if i < strings.LastIndex(name, "/") {
+		return name, DefaultTag
+	}
+	return name[:i], name[i+1:]
+}
+
+// newRegistry creates the client for the repository of the given URL.
+// Like docker, plain HTTP is used for loopback registries.
+func newRegistry(u *url.URL) (r *registry, ref string) {
+	scheme := "https"
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+	r = &registry{
+		base:   scheme + "://" + u.Host,
+		client: http.DefaultClient,
+	}
+	r.repo, ref = splitReference(u)
+	return r, ref
+}
+
+// get requests a resource from the repository doing the token
+// authentication when requested
+func (r *registry) get(kind, ref string, accept ...string) (*http.Response, error) {
+	endpoint := fmt.Sprintf("%s/v2/%s/%s/%s", r.base, r.repo, kind, ref)
+	for retry := 0; ; retry++ {
+		req, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, mt := range accept {
+			req.Header.Add("Accept", mt)
+		}
+		if r.token != "" {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && retry == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if err = r.authorize(challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Impossible to get %s: %s", endpoint, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+// authorize gets an anonymous token from the authorization server
+// given in a Bearer challenge
+func (r *registry) authorize(challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("Unsupported authentication challenge %q", challenge)
+	}
+	params := make(map[string]string)
+	for _, kv := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kvs := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(kvs) == 2 {
+			params[kvs[0]] = strings.Trim(kvs[1], `"`)
+		}
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("Invalid realm in challenge %q", challenge)
+	}
+	query := realm.Query()
+	for _, k := range []string{"service", "scope"} {
+		if v, ok := params[k]; ok {
+			query.Set(k, v)
+		}
+	}
+	realm.RawQuery = query.Encode()
+	resp, err := r.client.Get(realm.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Impossible to get a token from %s: %s", realm.Host, resp.Status)
+	}
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return fmt.Errorf("Token: %v", err)
+	}
+	if r.token = tok.Token; r.token == "" {
+		r.token = tok.AccessToken
+	}
+	if r.token == "" {
+		return errors.New("Empty token from the authorization server")
+	}
+	return nil
+}
+
+// Manifest returns the image manifest for the reference, indexes are
+// resolved to the manifest for the current platform. Manifests
+// referenced by digest are verified.
+func (r *registry) Manifest(ref string) (*Manifest, error) {
+	for depth := 0; ; depth++ {
+		resp, err := r.get("manifests", ref, MediaTypeOCIManifest, MediaTypeOCIIndex,
+			MediaTypeDockerManifest, MediaTypeDockerManifestList)
+		if err != nil {
+			return nil, err
+		}
+		var body io.Reader = resp.Body
+		verifier, verr := newDigester(ref)
+		if verr == nil {
+			body = io.TeeReader(resp.Body, verifier)
+		}
+		m, err := decodeManifest(body, resp.Header.Get("Content-Type"))
+		if err == nil && verifier != nil {
+			// Consume the rest of the document before verifying it
+			if _, err = io.Copy(ioutil.Discard, body); err == nil {
+				err = verifier.Verify()
+			}
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if !m.IsIndex() {
+			return m, nil
+		}
+		if depth == maxIndexDepth {
+			return nil, fmt.Errorf("More than %d nested indexes for %s", maxIndexDepth, ref)
+		}
+		d, err := matchPlatform(m.Manifests)
+		if err != nil {
+			return nil, err
+		}
+		ref = d.Digest
+	}
+}
+
+// Blob copies the content with the given descriptor to w checking its digest
+func (r *registry) Blob(w io.Writer, d Descriptor) error {
+	verifier, err := newDigester(d.Digest)
+	if err != nil {
+		return err
+	}
+	resp, err := r.get("blobs", d.Digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err = io.Copy(io.MultiWriter(w, verifier), resp.Body); err != nil {
+		return err
+	}
+	return verifier.Verify()
+}
@@ -0,0 +1,412 @@
+package task
+
+// Seccomp filters of the syscalls of the unprivileged tasks, installed
+// by the container right before it execs the command. The profiles use
+// the JSON format of Docker and OCI, their rules are compiled to a BPF
+// program checking them in order, the ones with arguments first.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// SeccompProfile is a seccomp profile in the JSON format of Docker.
+// The architectures are not listed, only the syscalls of the current
+// one are allowed.
+type SeccompProfile struct {
+	// DefaultAction of the syscalls without rule, e.g. SCMP_ACT_ALLOW
+	DefaultAction string `json:"defaultAction"`
+	// DefaultErrnoRet with SCMP_ACT_ERRNO, EPERM by default
+	DefaultErrnoRet *uint `json:"defaultErrnoRet,omitempty"`
+	// Syscalls rules
+	Syscalls []SeccompSyscall `json:"syscalls,omitempty"`
+}
+
+// SeccompSyscall is the rule of a seccomp profile for some syscalls.
+// The names unknown in the current architecture are ignored.
+type SeccompSyscall struct {
+	Names []string `json:"names,omitempty"`
+	// Name of a single syscall in the old format
+	Name string `json:"name,omitempty"`
+	// Action when the arguments match
+	Action string `json:"action"`
+	// ErrnoRet with SCMP_ACT_ERRNO, EPERM by default
+	ErrnoRet *uint `json:"errnoRet,omitempty"`
+	// Args that must match all
+	Args []SeccompArg `json:"args,omitempty"`
+	// Includes and Excludes the rule depending on the architecture,
+	// the capabilities and the kernel
+	Includes SeccompFilter `json:"includes"`
+	Excludes SeccompFilter `json:"excludes"`
+}
+
+// SeccompArg compares a syscall argument
+type SeccompArg struct {
+	Index uint   `json:"index"`
+	Value uint64 `json:"value"`
+	// ValueTwo is the value compared with SCMP_CMP_MASKED_EQ, the mask
+	// is Value
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	// Op is SCMP_CMP_EQ, SCMP_CMP_NE, SCMP_CMP_LT, SCMP_CMP_LE,
+	// SCMP_CMP_GT, SCMP_CMP_GE or SCMP_CMP_MASKED_EQ
+	Op string `json:"op"`
+}
+
+// SeccompFilter decides if a rule applies. The capabilities are the
+// default ones of Docker containers.
+type SeccompFilter struct {
+	Arches    []string `json:"arches,omitempty"`
+	Caps      []string `json:"caps,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// Syscalls denied by the default profile, mostly the ones Docker only
+// allows with capabilities not given by default
+var seccompDenied = []string{
+	"acct", "add_key", "bpf", "clock_adjtime", "clock_settime",
+	"create_module", "delete_module", "finit_module", "fsconfig",
+	"fsmount", "fsopen", "fspick", "get_kernel_syms", "init_module",
+	"ioperm", "iopl", "kcmp", "kexec_file_load", "kexec_load", "keyctl",
+	"lookup_dcookie", "mount", "mount_setattr", "move_mount",
+	"name_to_handle_at", "nfsservctl", "open_by_handle_at", "open_tree",
+	"perf_event_open", "pivot_root", "query_module", "quotactl",
+	"quotactl_fd", "reboot", "request_key", "setns", "settimeofday",
+	"swapoff", "swapon", "syslog", "_sysctl", "sysfs", "umount2",
+	"unshare", "uselib", "userfaultfd", "ustat", "vm86", "vm86old",
+}
+
+// Capabilities of the Docker containers by default
+var dockerDefaultCaps = map[string]bool{
+	"CAP_AUDIT_WRITE": true, "CAP_CHOWN": true, "CAP_DAC_OVERRIDE": true,
+	"CAP_FOWNER": true, "CAP_FSETID": true, "CAP_KILL": true,
+	"CAP_MKNOD": true, "CAP_NET_BIND_SERVICE": true, "CAP_NET_RAW": true,
+	"CAP_SETFCAP": true, "CAP_SETGID": true, "CAP_SETPCAP": true,
+	"CAP_SETUID": true, "CAP_SYS_CHROOT": true,
+}
+
+// DefaultSeccompProfile returns the built-in profile. It allows all
+// the syscalls except the ones administering the system or the kernel,
+// mounting filesystems or creating namespaces, which fail with EPERM.
+func DefaultSeccompProfile() *SeccompProfile {
+	eperm, enosys := uint(syscall.EPERM), uint(syscall.ENOSYS)
+	p := &SeccompProfile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: []SeccompSyscall{
+			{Names: seccompDenied, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm},
+			// Its flags cannot be checked, the C libraries fall back
+			// to clone
+			{Names: []string{"clone3"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &enosys},
+		},
+	}
+	for _, flag := range []uint64{syscall.CLONE_NEWNS, syscall.CLONE_NEWUTS, syscall.CLONE_NEWIPC,
+		syscall.CLONE_NEWUSER, syscall.CLONE_NEWPID, syscall.CLONE_NEWNET, syscall.CLONE_NEWCGROUP} {
+		p.Syscalls = append(p.Syscalls, SeccompSyscall{
+			Names:    []string{"clone"},
+			Action:   "SCMP_ACT_ERRNO",
+			ErrnoRet: &eperm,
+			Args:     []SeccompArg{{Index: 0, Value: flag, ValueTwo: flag, Op: "SCMP_CMP_MASKED_EQ"}},
+		})
+	}
+	return p
+}
+
+// LoadSeccompProfile reads a JSON seccomp profile
+func LoadSeccompProfile(path string) (*SeccompProfile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := new(SeccompProfile)
+	if err = json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("Seccomp profile %s: %v", path, err)
+	}
+	if _, err = p.compile(); err != nil {
+		return nil, fmt.Errorf("Seccomp profile %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// Return values of the filters
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetKillThread  = 0x00000000
+	seccompRetTrap        = 0x00030000
+	seccompRetErrno       = 0x00050000
+	seccompRetTrace       = 0x7ff00000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+)
+
+// Offsets in struct seccomp_data
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// Maximum number of instructions of a filter
+const bpfMaxInsns = 4096
+
+// seccompRet returns the filter return value of an action
+func seccompRet(action string, errnoRet *uint) (uint32, error) {
+	data := uint32(syscall.EPERM)
+	if errnoRet != nil {
+		data = uint32(*errnoRet) & 0xffff
+	}
+	switch action {
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return seccompRetKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return seccompRetKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return seccompRetTrap, nil
+	case "SCMP_ACT_ERRNO":
+		return seccompRetErrno | data, nil
+	case "SCMP_ACT_TRACE":
+		return seccompRetTrace | data, nil
+	case "SCMP_ACT_LOG":
+		return seccompRetLog, nil
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow, nil
+	}
+	return 0, fmt.Errorf("Unsupported seccomp action %q", action)
+}
+
+// compile returns the BPF program of the profile. The syscalls of
+// other architectures or of the x32 ABI kill the process.
+func (p *SeccompProfile) compile() ([]syscall.SockFilter, error) {
+	if seccompAuditArch == 0 {
+		return nil, fmt.Errorf("Seccomp not supported on %s", runtime.GOARCH)
+	}
+	defaultRet, err := seccompRet(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	filter := []syscall.SockFilter{
+		bpfLoad(seccompDataArch),
+		bpfJump(syscall.BPF_JEQ, seccompAuditArch, 1, 0),
+		bpfRet(seccompRetKillProcess),
+	}
+	if seccompX32Bit != 0 {
+		filter = append(filter,
+			bpfLoad(seccompDataNr),
+			bpfJump(syscall.BPF_JGE, seccompX32Bit, 0, 1),
+			bpfRet(seccompRetKillProcess))
+	}
+	kernel := kernelVersion()
+	var withArgs, withoutArgs []syscall.SockFilter
+	for _, rule := range p.Syscalls {
+		ret, err := seccompRet(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		if !rule.applies(kernel) {
+			continue
+		}
+		names := rule.Names
+		if rule.Name != "" {
+			names = append(names[:len(names):len(names)], rule.Name)
+		}
+		for _, name := range names {
+			nr, ok := seccompSyscalls[name]
+			if !ok {
+				continue
+			}
+			block, err := seccompRule(nr, rule.Args, ret)
+			if err != nil {
+				return nil, fmt.Errorf("Seccomp rule of %s: %v", name, err)
+			}
+			if len(rule.Args) > 0 {
+				withArgs = append(withArgs, block...)
+			} else {
+				withoutArgs = append(withoutArgs, block...)
+			}
+		}
+	}
+	filter = append(append(append(filter, withArgs...), withoutArgs...), bpfRet(defaultRet))
+	if len(filter) > bpfMaxInsns {
+		return nil, fmt.Errorf("Seccomp profile too large, %d BPF instructions", len(filter))
+	}
+	return filter, nil
+}
+
+// Jump offset to the end of a rule while it is compiled
+const bpfJumpNext = 0xff
+
+// seccompRule returns the BPF instructions returning ret for the
+// syscall nr when all the args match. The arguments are compared by
+// their high and low 32 bits.
+func seccompRule(nr uint32, args []SeccompArg, ret uint32) ([]syscall.SockFilter, error) {
+	next := uint8(bpfJumpNext)
+	block := []syscall.SockFilter{
+		bpfLoad(seccompDataNr),
+		bpfJump(syscall.BPF_JEQ, nr, 0, next),
+	}
+	for _, arg := range args {
+		if arg.Index > 5 {
+			return nil, fmt.Errorf("Invalid argument index %d", arg.Index)
+		}
+		lo := uint32(seccompDataArgs + 8*arg.Index)
+		hi := lo + 4
+		vhi, vlo := uint32(arg.Value>>32), uint32(arg.Value)
+		switch arg.Op {
+		case "SCMP_CMP_EQ":
+			block = append(block,
+				bpfLoad(hi), bpfJump(syscall.BPF_JEQ, vhi, 0, next),
+				bpfLoad(lo), bpfJump(syscall.BPF_JEQ, vlo, 0, next))
+		case "SCMP_CMP_NE":
+			block = append(block,
+				bpfLoad(hi), bpfJump(syscall.BPF_JEQ, vhi, 0, 2),
+				bpfLoad(lo), bpfJump(syscall.BPF_JEQ, vlo, next, 0))
+		case "SCMP_CMP_MASKED_EQ":
+			block = append(block,
+				bpfLoad(hi), bpfAnd(vhi), bpfJump(syscall.BPF_JEQ, uint32(arg.ValueTwo>>32), 0, next),
+				bpfLoad(lo), bpfAnd(vlo), bpfJump(syscall.BPF_JEQ, uint32(arg.ValueTwo), 0, next))
+		case "SCMP_CMP_GT", "SCMP_CMP_GE":
+			op := uint16(syscall.BPF_JGT)
+			if arg.Op == "SCMP_CMP_GE" {
+				op = syscall.BPF_JGE
+			}
+			// Greater high bits match, lower ones do not
+			block = append(block,
+				bpfLoad(hi), bpfJump(syscall.BPF_JGT, vhi, 3, 0), bpfJump(syscall.BPF_JEQ, vhi, 0, next),
+				bpfLoad(lo), bpfJump(op, vlo, 0, next))
+		case "SCMP_CMP_LT", "SCMP_CMP_LE":
+			op := uint16(syscall.BPF_JGE)
+			if arg.Op == "SCMP_CMP_LE" {
+				op = syscall.BPF_JGT
+			}
+			// Lower high bits match, greater ones do not
+			block = append(block,
+				bpfLoad(hi), bpfJump(syscall.BPF_JGE, vhi, 0, 3), bpfJump(syscall.BPF_JEQ, vhi, 0, next),
+				bpfLoad(lo), bpfJump(op, vlo, next, 0))
+		default:
+			return nil, fmt.Errorf("Unsupported operator %q", arg.Op)
+		}
+	}
+	block = append(block, bpfRet(ret))
+	for i := range block {
+		if block[i].Code&0x07 != syscall.BPF_JMP {
+			continue
+		}
+		if block[i].Jt == next {
+			block[i].Jt = uint8(len(block) - i - 1)
+		}
+		if block[i].Jf == next {
+			block[i].Jf = uint8(len(block) - i - 1)
+		}
+	}
+	return block, nil
+}
+
+// applies returns true if the rule applies in the current architecture
+// and kernel to a task with the default capabilities of Docker
+func (r *SeccompSyscall) applies(kernel [2]int) bool {
+	in, ex := r.Includes, r.Excludes
+	contains := func(list []string, s string) bool {
+		for _, e := range list {
+			if e == s {
+				return true
+			}
+		}
+		return false
+	}
+	anyCap := func(caps []string) bool {
+		for _, c := range caps {
+			if dockerDefaultCaps[c] {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case len(in.Arches) > 0 && !contains(in.Arches, runtime.GOARCH),
+		contains(ex.Arches, runtime.GOARCH),
+		len(in.Caps) > 0 && !anyCap(in.Caps),
+		anyCap(ex.Caps),
+		in.MinKernel != "" && compareKernel(kernel, in.MinKernel) < 0,
+		ex.MinKernel != "" && compareKernel(kernel, ex.MinKernel) >= 0:
+		return false
+	}
+	return true
+}
+
+// kernelVersion returns the major and minor version of the kernel
+func kernelVersion() [2]int {
+	var uts syscall.Utsname
+	syscall.Uname(&uts)
+	release := make([]byte, 0, len(uts.Release))
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	var v [2]int
+	fmt.Sscanf(string(release), "%d.%d", &v[0], &v[1])
+	return v
+}
+
+// compareKernel compares the kernel version with a major.minor one
+func compareKernel(kernel [2]int, version string) int {
+	var v [2]int
+	fmt.Sscanf(version, "%d.%d", &v[0], &v[1])
+	for i := range v {
+		if kernel[i] != v[i] {
+			return kernel[i] - v[i]
+		}
+	}
+	return 0
+}
+
+func bpfLoad(offset uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: offset}
+}
+
+func bpfJump(op uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: syscall.BPF_JMP | op | syscall.BPF_K, Jt: jt, Jf: jf, K: k}
+}
+
+func bpfAnd(k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: syscall.BPF_ALU | syscall.BPF_AND | syscall.BPF_K, K: k}
+}
+
+func bpfRet(k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: k}
+}
+
+// Constants missing in syscall
+const (
+	prSetSeccomp      = 22
+	prSetNoNewPrivs   = 38
+	seccompModeFilter = 2
+)
+
+// installSeccomp installs the filter in the current thread. Without
+// CAP_SYS_ADMIN, it requires that the thread cannot gain privileges
+// anymore, e.g. with setuid programs.
+func installSeccomp(filter []syscall.SockFilter) error {
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	err := prctl(prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog)))
+	if err == syscall.EACCES {
+		if err = prctl(prSetNoNewPrivs, 1, 0); err == nil {
+			err = prctl(prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog)))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Seccomp filter: %v", err)
+	}
+	return nil
+}
+
+func prctl(option int, arg2, arg3 uintptr) error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, uintptr(option), arg2, arg3)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
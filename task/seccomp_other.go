@@ -0,0 +1,11 @@
+//go:build !amd64 && !arm64
+
+package task
+
+const (
+	// seccompAuditArch is 0 as the syscall numbers are unknown
+	seccompAuditArch = 0
+	seccompX32Bit    = 0
+)
+
+var seccompSyscalls = map[string]uint32{}
@@ -0,0 +1,375 @@
+package task
+
+// Detached signatures of the images verified with a trust store of
+// ed25519 public keys. The images are hashed while they are read, so
+// they are never loaded in memory. Supported signature formats:
+//
+//   - raw ed25519 signatures of the SHA-512 digest of the image,
+//     binary or base64 encoded
+//   - SSH signatures from `ssh-keygen -Y sign -n file`
+//   - prehashed minisign signatures from `minisign -S`
+//
+// References: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+// and https://jedisct1.github.io/minisign/
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SignaturePolicy decides what to do with the image signatures
+type SignaturePolicy int
+
+const (
+	// SignatureSkip does not verify signatures
+	SignatureSkip SignaturePolicy = iota
+	// SignatureWarn logs a warning when the signature is missing or invalid
+	SignatureWarn
+	// SignatureRequire refuses images without a valid signature
+	SignatureRequire
+)
+
+var signaturePolicyStrs = [...]string{"skip", "warn", "require"}
+
+func (p SignaturePolicy) String() string {
+	return signaturePolicyStrs[p]
+}
+
+// ParseSignaturePolicy returns the policy from its name
+func ParseSignaturePolicy(name string) (SignaturePolicy, error) {
+	for i, s := range signaturePolicyStrs {
+		if s == name {
+			return SignaturePolicy(i), nil
+		}
+	}
+	return SignatureSkip, fmt.Errorf("Invalid signature policy %q, choices: %s",
+		name, strings.Join(signaturePolicyStrs[:], ", "))
+}
+
+const (
+	// SignatureSuffix is appended to the image URL to get its signature
+	SignatureSuffix = ".sig"
+	// SSHSignatureNamespace is the namespace expected in SSH signatures
+	SSHSignatureNamespace = "file"
+
+	sshSigMagic    = "SSHSIG"
+	sshSigArmor    = "-----BEGIN SSH SIGNATURE-----"
+	sshSigArmorEnd = "-----END SSH SIGNATURE-----"
+	sshEd25519     = "ssh-ed25519"
+
+	minisignComment        = "untrusted comment:"
+	minisignTrustedComment = "trusted comment: "
+	// Algorithms of the signatures: the legacy one signs the whole
+	// file, the prehashed one its BLAKE2b-512 hash
+	minisignLegacy    = "Ed"
+	minisignPrehashed = "ED"
+	// Algorithm and key id before the keys and signatures
+	minisignHeaderLen = 10
+)
+
+// SignatureError is returned when an image has no valid signature
+type SignatureError struct {
+	URL    string
+	Reason error
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("Signature %s: %v", e.URL, e.Reason)
+}
+
+// LoadTrustedKeys reads the ed25519 public keys from a file, or from
+// all the files in a directory. Each line contains a key in the
+// authorized_keys or allowed_signers format (ssh-ed25519 AAAA...), the
+// minisign format or a raw base64 encoded key. Empty lines, comments and
+// the untrusted comments of minisign keys are ignored.
+func LoadTrustedKeys(path string) ([]ed25519.PublicKey, error) {
+	files := []string{path}
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*")); err != nil {
+			return nil, err
+		}
+	}
+	var keys []ed25519.PublicKey
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, minisignComment) {
+				continue
+			}
+			key, err := parsePublicKey(text)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+			}
+			keys = append(keys, key)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// parsePublicKey parses a line of the trust store
+func parsePublicKey(line string) (ed25519.PublicKey, error) {
+	fields := strings.Fields(line)
+	for i, field := range fields {
+		if field == sshEd25519 && i+1 < len(fields) {
+			blob, err := base64.StdEncoding.DecodeString(fields[i+1])
+			if err != nil {
+				return nil, err
+			}
+			return parseSSHPublicKey(blob)
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(fields[0])
+	if err == nil && len(raw) == minisignHeaderLen+ed25519.PublicKeySize && string(raw[:2]) == minisignLegacy {
+		// The algorithm of the minisign keys is always the legacy one
+		return ed25519.PublicKey(raw[minisignHeaderLen:]), nil
+	}
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("Unknown public key format, only ed25519 keys are supported")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// sshReader reads the fields of the SSH wire format
+type sshReader struct {
+	buf []byte
+	err error
+}
+
+// String reads a length prefixed string
+func (r *sshReader) String() []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < 4 {
+		r.err = errors.New("Truncated SSH data")
+		return nil
+	}
+	n := binary.BigEndian.Uint32(r.buf)
+	if uint64(len(r.buf)-4) < uint64(n) {
+		r.err = errors.New("Truncated SSH data")
+		return nil
+	}
+	s := r.buf[4 : 4+n]
+	r.buf = r.buf[4+n:]
+	return s
+}
+
+// sshString encodes a length prefixed string
+func sshString(s []byte) []byte {
+	buf := make([]byte, 4, 4+len(s))
+	binary.BigEndian.PutUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// parseSSHPublicKey decodes an ssh-ed25519 public key blob
+func parseSSHPublicKey(blob []byte) (ed25519.PublicKey, error) {
+	r := &sshReader{buf: blob}
+	algo, key := r.String(), r.String()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if string(algo) != sshEd25519 || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Unsupported SSH key %q", algo)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// verifySignature checks the signature of the image file with the
+// trusted keys. sig is the content of the detached signature.
+func verifySignature(path string, sig []byte, keys []ed25519.PublicKey) error {
+	if len(keys) == 0 {
+		return errors.New("No trusted keys")
+	}
+	text := bytes.TrimSpace(sig)
+	switch {
+	case bytes.HasPrefix(text, []byte(sshSigArmor)):
+		return verifySSHSignature(path, text, keys)
+	case bytes.HasPrefix(text, []byte(minisignComment)):
+		return verifyMinisign(path, text, keys)
+	}
+	raw := sig
+	if len(raw) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+		if err != nil || len(decoded) != ed25519.SignatureSize {
+			return errors.New("Unknown signature format")
+		}
+		raw = decoded
+	}
+	digest, err := hashFile(path, sha512.New())
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, digest, raw) {
+			return nil
+		}
+	}
+	return errors.New("Not signed by a trusted key")
+}
+
+// hashFile returns the hash of the content of a file
+func hashFile(path string, h hash.Hash) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyMinisign checks a minisign signature: the untrusted comment,
+// the signature, the trusted comment and the signature of both
+func verifyMinisign(path string, text []byte, keys []ed25519.PublicKey) error {
+	lines := strings.Split(string(text), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], minisignTrustedComment) {
+		return errors.New("Invalid minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != minisignHeaderLen+ed25519.SignatureSize {
+		return errors.New("Invalid minisign signature")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return errors.New("Invalid minisign trusted comment signature")
+	}
+	switch string(sig[:2]) {
+	case minisignPrehashed:
+	case minisignLegacy:
+		// It would require the whole image in memory
+		return errors.New("Legacy minisign signatures are not supported, sign with minisign -S -H")
+	default:
+		return fmt.Errorf("Unsupported minisign algorithm %q", sig[:2])
+	}
+	digest, err := hashFile(path, newBlake2b())
+	if err != nil {
+		return err
+	}
+	sig = sig[minisignHeaderLen:]
+	comment := strings.TrimSuffix(strings.TrimPrefix(lines[2], minisignTrustedComment), "\r")
+	for _, key := range keys {
+		if !ed25519.Verify(key, digest, sig) {
+			continue
+		}
+		if !ed25519.Verify(key, append(sig[:len(sig):len(sig)], comment...), global) {
+			return errors.New("Invalid minisign trusted comment signature")
+		}
+		return nil
+	}
+	return errors.New("Not signed by a trusted key")
+}
+
+// verifySSHSignature checks an armored SSH signature
+func verifySSHSignature(path string, armored []byte, keys []ed25519.PublicKey) error {
+	body := strings.TrimSuffix(strings.TrimPrefix(string(armored), sshSigArmor), sshSigArmorEnd)
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return fmt.Errorf("SSH signature: %v", err)
+	}
+	if !bytes.HasPrefix(blob, []byte(sshSigMagic)) {
+		return errors.New("Invalid SSH signature")
+	}
+	r := &sshReader{buf: blob[len(sshSigMagic):]}
+	if len(r.buf) < 4 || binary.BigEndian.Uint32(r.buf) != 1 {
+		return errors.New("Unsupported SSH signature version")
+	}
+	r.buf = r.buf[4:]
+	pubkey, namespace, reserved, hashAlgo, signature := r.String(), r.String(), r.String(), r.String(), r.String()
+	if r.err != nil {
+		return r.err
+	}
+	if string(namespace) != SSHSignatureNamespace {
+		return fmt.Errorf("Invalid SSH signature namespace %q", namespace)
+	}
+	signer, err := parseSSHPublicKey(pubkey)
+	if err != nil {
+		return err
+	}
+	trusted := false
+	for _, key := range keys {
+		if key.Equal(signer) {
+			trusted = true
+		}
+	}
+	if !trusted {
+		return errors.New("Not signed by a trusted key")
+	}
+
+	var h hash.Hash
+	switch string(hashAlgo) {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("Unsupported SSH signature hash %q", hashAlgo)
+	}
+	digest, err := hashFile(path, h)
+	if err != nil {
+		return err
+	}
+
+	sr := &sshReader{buf: signature}
+	sigAlgo, raw := sr.String(), sr.String()
+	if sr.err != nil {
+		return sr.err
+	}
+	if string(sigAlgo) != sshEd25519 {
+		return fmt.Errorf("Unsupported SSH signature algorithm %q", sigAlgo)
+	}
+	var signed bytes.Buffer
+	signed.WriteString(sshSigMagic)
+	for _, field := range [][]byte{namespace, reserved, hashAlgo, digest} {
+		signed.Write(sshString(field))
+	}
+	if !ed25519.Verify(signer, signed.Bytes(), raw) {
+		return errors.New("Invalid SSH signature")
+	}
+	return nil
+}
+
+// fetchSignature gets the detached signature from a file or HTTP URL
+func fetchSignature(rawurl string) ([]byte, error) {
+	if strings.HasPrefix(rawurl, "file://") || !strings.Contains(rawurl, "://") {
+		return ioutil.ReadFile(strings.TrimPrefix(rawurl, "file://"))
+	}
+	resp, err := http.Get(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Impossible to get %s: %s", rawurl, resp.Status)
+	}
+	// Signatures are small
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
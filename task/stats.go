@@ -0,0 +1,205 @@
+package task
+
+// Resource usage of the tasks. It is read from the processes of the
+// task in /proc while it runs and from its rusage once it is finished,
+// the cgroup of the task gives the totals when its resources are
+// limited.
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Stats is the resource usage of a task
+type Stats struct {
+	// CPUTime is the user and system CPU time of its processes
+	CPUTime time.Duration `json:"cpu_time"`
+	// PeakRSS is the peak resident memory in bytes of the cgroup or,
+	// without it, of the largest process
+	PeakRSS int64 `json:"peak_rss"`
+	// ReadBytes from the storage
+	ReadBytes int64 `json:"read_bytes"`
+	// WriteBytes to the storage
+	WriteBytes int64 `json:"write_bytes"`
+	// Processes running
+	Processes int `json:"processes"`
+	// Source of the statistics: cgroup, proc or rusage
+	Source string `json:"source"`
+}
+
+// Clock ticks per second of the times in /proc, USER_HZ
+const userHZ = 100
+
+// Stats returns the resource usage of the task
+func (t *Task) Stats() (Stats, error) {
+	t.RLock()
+	defer t.RUnlock()
+	var s Stats
+	if t.Command.Process == nil {
+		return s, fmt.Errorf("Impossible to get the statistics of a non-started task")
+	}
+	if t.Command.ProcessState != nil {
+		s = rusageStats(t.Command.ProcessState)
+	} else {
+		var err error
+		if s, err = procStats(t.Command.Process.Pid); err != nil {
+			return s, err
+		}
+	}
+	if t.cgroup != nil {
+		t.cgroup.stats(&s)
+	}
+	return s, nil
+}
+
+// rusageStats returns the resource usage of a finished process and its
+// waited children
+func rusageStats(state *os.ProcessState) Stats {
+	s := Stats{
+		CPUTime: state.UserTime() + state.SystemTime(),
+		Source:  "rusage",
+	}
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// Kilobytes and blocks of 512 bytes
+		s.PeakRSS = ru.Maxrss * 1024
+		s.ReadBytes = ru.Inblock * 512
+		s.WriteBytes = ru.Oublock * 512
+	}
+	return s
+}
+
+// procStats returns the resource usage of the process pid and its
+// descendants
+func procStats(pid int) (Stats, error) {
+	s := Stats{Source: "proc"}
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return s, err
+	}
+	children := map[int][]int{}
+	for _, e := range entries {
+		p, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if fields, err := procStatFields(p); err == nil {
+			ppid, _ := strconv.Atoi(fields[1])
+			children[ppid] = append(children[ppid], p)
+		}
+	}
+	if _, err = procStatFields(pid); err != nil {
+		return s, err
+	}
+	for pending := []int{pid}; len(pending) > 0; pending = pending[1:] {
+		p := pending[0]
+		pending = append(pending, children[p]...)
+		fields, err := procStatFields(p)
+		if err != nil {
+			// Already exited
+			continue
+		}
+		s.Processes++
+		// utime, stime and the ones of the waited children
+		var ticks int64
+		for _, f := range fields[11:15] {
+			n, _ := strconv.ParseInt(f, 10, 64)
+			ticks += n
+		}
+		s.CPUTime += time.Duration(ticks) * time.Second / userHZ
+		status := procKeyValues(p, "status")
+		// Kilobytes with the unit
+		if hwm, _ := strconv.ParseInt(strings.TrimSuffix(status["VmHWM"], " kB"), 10, 64); hwm*1024 > s.PeakRSS {
+			s.PeakRSS = hwm * 1024
+		}
+		// Only readable for the processes of the same user
+		io := procKeyValues(p, "io")
+		read, _ := strconv.ParseInt(io["read_bytes"], 10, 64)
+		written, _ := strconv.ParseInt(io["write_bytes"], 10, 64)
+		s.ReadBytes += read
+		s.WriteBytes += written
+	}
+	return s, nil
+}
+
+// procStatFields returns the fields of /proc/pid/stat after the command
+// name, from the state
+func procStatFields(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// The name is between parentheses and it can contain them
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return nil, fmt.Errorf("Invalid /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 15 {
+		return nil, fmt.Errorf("Invalid /proc/%d/stat", pid)
+	}
+	return fields, nil
+}
+
+// procKeyValues returns the "key: value" lines of a /proc/pid file, empty
+// if it cannot be read
+func procKeyValues(pid int, name string) map[string]string {
+	values := map[string]string{}
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), name))
+	if err != nil {
+		return values
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if kv := strings.SplitN(scanner.Text(), ":", 2); len(kv) == 2 {
+			values[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	return values
+}
+
+// stats replaces the resource usage with the totals of the cgroup
+// available with its controllers
+func (c *cgroup) stats(s *Stats) {
+	s.Source = "cgroup"
+	read := func(name string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(c.path, name))
+		return strings.TrimSpace(string(data))
+	}
+	// Available without controllers
+	s.Processes = len(strings.Fields(read("cgroup.procs")))
+	for _, line := range strings.Split(read("cpu.stat"), "\n") {
+		if kv := strings.Fields(line); len(kv) == 2 && kv[0] == "usage_usec" {
+			usec, _ := strconv.ParseInt(kv[1], 10, 64)
+			s.CPUTime = time.Duration(usec) * time.Microsecond
+		}
+	}
+	// Since Linux 5.19
+	if peak, err := strconv.ParseInt(read("memory.peak"), 10, 64); err == nil {
+		s.PeakRSS = peak
+	}
+	// One line per device with key=value fields
+	if io := read("io.stat"); io != "" {
+		s.ReadBytes, s.WriteBytes = 0, 0
+		for _, field := range strings.Fields(io) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			n, _ := strconv.ParseInt(kv[1], 10, 64)
+			switch kv[0] {
+			case "rbytes":
+				s.ReadBytes += n
+			case "wbytes":
+				s.WriteBytes += n
+			}
+		}
+	}
+}
@@ -6,10 +6,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"syscall"
+	"time"
 )
 
 // Supervisor is a HTTP server which serve requests on a stored task
@@ -23,6 +26,7 @@ type SupervisorQuery string
 const (
 	StatusQuery SupervisorQuery = "ps"
 	SignalQuery SupervisorQuery = "kill"
+	StatsQuery  SupervisorQuery = "stats"
 )
 
 const statusUnprocessableEntity = 422
@@ -96,6 +100,50 @@ func NewSupervisor(tc <-chan *Task, listeningPort int) *Supervisor {
 		}
 	})
 
+	// With a watch interval, the statistics are streamed until the
+	// task is finished
+	http.HandleFunc("/"+string(StatsQuery), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		jsonEnc := json.NewEncoder(w)
+		var interval time.Duration
+		if watch := r.URL.Query().Get("watch"); watch != "" {
+			var err error
+			if interval, err = time.ParseDuration(watch); err != nil || interval <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				if err := jsonEnc.Encode("Invalid watch interval " + watch); err != nil {
+					panic(err)
+				}
+				return
+			}
+		}
+		stats, err := s.Task.Stats()
+		if err != nil {
+			w.WriteHeader(statusUnprocessableEntity)
+			if err := jsonEnc.Encode(err.Error()); err != nil {
+				panic(err)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		for {
+			if err = jsonEnc.Encode(stats); err != nil || interval == 0 || s.Task.Status() == Finished {
+				// The client is gone or there is nothing left
+				return
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(interval):
+			}
+			if stats, err = s.Task.Stats(); err != nil {
+				return
+			}
+		}
+	})
+
 	s.HTTP = &http.Server{
 		Addr: fmt.Sprintf(":%d", listeningPort),
 	}
@@ -149,6 +197,35 @@ func QuerySupervisor(port int, query SupervisorQuery, args ...string) error {
 			response, _ := ioutil.ReadAll(res.Body)
 			fmt.Fprintf(os.Stderr, "ERROR %s: %s", res.Status, response)
 		}
+	case StatsQuery:
+		// The optional argument is the watch interval
+		if len(args) > 0 {
+			url += "?watch=" + args[0]
+		}
+		res, err := http.Get(url)
+		if err != nil {
+			return fmt.Errorf("Cannot get the task statistics: %v", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			response, _ := ioutil.ReadAll(res.Body)
+			return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(response)))
+		}
+		fmt.Printf("%-12s %12s %12s %12s %9s  %s\n", "CPU TIME", "PEAK RSS", "READ", "WRITTEN", "PROCESSES", "SOURCE")
+		decJson := json.NewDecoder(res.Body)
+		for {
+			var stats Stats
+			err = decJson.Decode(&stats)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// The stream ends with the task
+				break
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%-12s %12d %12d %12d %9d  %s\n", stats.CPUTime.Round(time.Millisecond),
+				stats.PeakRSS, stats.ReadBytes, stats.WriteBytes, stats.Processes, stats.Source)
+		}
 	}
 	return nil
 }
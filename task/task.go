@@ -2,14 +2,16 @@
 package task
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -48,10 +50,12 @@ func (s Status) String() string {
 }
 
 var SupportedSchemes = map[string]bool{
-	"":      true, // Empty scheme is translated to "file"
-	"file":  true,
-	"http":  true,
-	"https": true,
+	"":       true, // Empty scheme is translated to "file"
+	"file":   true,
+	"http":   true,
+	"https":  true,
+	"docker": true, // Docker Registry V2, defaults to Docker Hub
+	"oci":    true, // OCI distribution registry
 }
 
 // Task is a command + URL to an image
@@ -61,19 +65,119 @@ type Task struct {
 	Command *exec.Cmd
 	// URL the URL to an image which contains a FS
 	URL *url.URL
+	// Options given on creation
+	Options Options
+	// Cache to retrieve images from, nil to use temporary files
+	Cache *Cache
 	// temp file where the image is stored
 	image *os.File
-	// compressed?
-	compressed bool
+	// image is stored in the cache and it must not be removed
+	cached bool
+	// layers of an image ordered from the base layer. Empty when
+	// image is a plain root filesystem archive
+	layers []blob
+	// execution parameters from the image, if any
+	config *ImageConfig
 	// extracted image directory
 	dirimage string
+	// dirimage is a local directory which must not be removed
+	local bool
+	// writable layer over a local directory, nil if there is none
+	overlay *overlay
+	// image extracted in the cache used as the lower layer, locked
+	// until the overlay is removed
+	cachedRoot *CachedRoot
+	// user-mode network relayed with NetworkSlirp
+	usernet *usernet
+	// volumes, tmpfs and read-only root mounted in the host for
+	// privileged tasks
+	mounts []string
+	// temporary directory of the generated /etc files
+	etcDir string
+	// cgroup limiting the resources, nil if they are unlimited
+	cgroup *cgroup
+	// entries not extracted as they are
+	report   ExtractReport
+	reportMu sync.Mutex
+}
+
+// Options to create a task
+type Options struct {
+	// Digest expected for the image in the form algorithm:hex,
+	// sha256 and sha512 are supported. It can also be given in the
+	// URL fragment as #sha256=hex
+	Digest string
+	// SignaturePolicy for the detached signature of the image
+	SignaturePolicy SignaturePolicy
+	// TrustedKeys to verify the signature, see LoadTrustedKeys
+	TrustedKeys []ed25519.PublicKey
+	// SignatureURL of the detached signature. By default, it is the
+	// image URL with SignatureSuffix
+	SignatureURL string
+	// Scratch runs a task from a local root directory over a writable
+	// overlay whose changes are discarded on Close. Otherwise, the
+	// directory is used in place.
+	Scratch bool
+	// Overlay extracts the image once in the Cache and uses it as the
+	// read-only lower layer of an overlay with a writable layer for the
+	// task, it is copied when overlays are not available. It requires
+	// a Cache.
+	Overlay bool
+	// Ownership of the extracted files, faithful to the archive by
+	// default
+	Ownership Ownership
+	// TrustedXattrs restores the trusted and security extended
+	// attributes of the image. Only the file capabilities are restored
+	// by default and the overlay ones never are.
+	TrustedXattrs bool
+	// SkipMounts are the standard filesystems not mounted inside the
+	// jail, see SystemMounts. All of them are mounted by default in
+	// the mount namespace of unprivileged tasks.
+	SkipMounts SystemMounts
+	// Volumes bind mounted inside the jail
+	Volumes []Volume
+	// ReadOnly mounts the root filesystem read-only, only the volumes
+	// and the standard and Tmpfs mounts are writable
+	ReadOnly bool
+	// Tmpfs are the paths inside the jail where a writable tmpfs is
+	// mounted
+	Tmpfs []string
+	// Network of the task, the one of the host by default
+	Network NetworkMode
+	// PortForwards from the host to the task with NetworkSlirp
+	PortForwards []PortForward
+	// Hostname of the task in its UTS namespace, the one of the host
+	// by default. The /etc/hostname and /etc/hosts of the jail are
+	// generated for it unless they are in a volume.
+	Hostname string
+	// Resources limited with a cgroup v2 of the task
+	Resources Resources
+	// Seccomp profile filtering the syscalls of the unprivileged
+	// chrooted tasks, none by default
+	Seccomp *SeccompProfile
+	// ExtractWorkers writing the extracted files concurrently, the
+	// number of CPUs by default
+	ExtractWorkers int
 }
 
 // CreateTask creates a task by parsing a URL.
 //
-// Current working URL schemes: file and http(s). Empty URL scheme implies file
+// Current working URL schemes: file, http(s) and registries. Empty URL
+// scheme implies file. Registry references are in the form
+// docker://[host/]repo[:tag|@digest] or oci://host/repo[:tag|@digest]
 func CreateTask(rawurl string, command string, args ...string) (t *Task, err error) {
-	URL, err := url.Parse(rawurl)
+	return CreateTaskWithOptions(rawurl, Options{}, command, args...)
+}
+
+// CreateTaskWithOptions creates a task by parsing a URL like
+// CreateTask with the given options
+func CreateTaskWithOptions(rawurl string, opts Options, command string, args ...string) (t *Task, err error) {
+	var URL *url.URL
+	if strings.HasPrefix(rawurl, "docker://") || strings.HasPrefix(rawurl, "oci://") {
+		URL, err = parseReference(rawurl)
+	} else {
+		URL, err = url.Parse(rawurl)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -83,17 +187,70 @@ func CreateTask(rawurl string, command string, args ...string) (t *Task, err err
 	if URL.Scheme == "" {
 		URL.Scheme = "file"
 	}
+	digest, err := fragmentDigest(URL.Fragment)
+	if err != nil {
+		return nil, err
+	}
+	if digest != "" {
+		if opts.Digest != "" && opts.Digest != digest {
+			return nil, fmt.Errorf("Digest %s differs from the URL one %s", opts.Digest, digest)
+		}
+		opts.Digest = digest
+	}
+	if opts.Digest != "" {
+		if _, err = newDigester(opts.Digest); err != nil {
+			return nil, err
+		}
+	}
+	if opts.SignaturePolicy != SignatureSkip {
+		// Only image files have a detached signature, registry images
+		// are pinned with their digest
+		if isRegistryScheme(URL.Scheme) {
+			return nil, fmt.Errorf("Signatures of %s images cannot be verified, use a digest", URL.Scheme)
+		}
+		if fi, err := os.Stat(URL.Path); URL.Scheme == "file" && err == nil && fi.IsDir() {
+			return nil, errors.New("Signatures of image directories cannot be verified")
+		}
+	}
+	for _, v := range opts.Volumes {
+		if err = v.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range opts.Tmpfs {
+		if err = checkJailPath(path); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.PortForwards) > 0 && opts.Network != NetworkSlirp {
+		return nil, fmt.Errorf("Port forwards require the %s network", NetworkSlirp)
+	}
+	if opts.Hostname != "" {
+		if err = validateHostname(opts.Hostname); err != nil {
+			return nil, err
+		}
+	}
+	if err = opts.Resources.validate(); err != nil {
+		return nil, err
+	}
+	if opts.Seccomp != nil {
+		if _, err = opts.Seccomp.compile(); err != nil {
+			return nil, err
+		}
+	}
 	t = &Task{
 		Command: exec.Command(command, args...),
 		URL:     URL,
+		Options: opts,
 	}
 	return t, nil
 }
 
+// checkedClose closes f and sets its error in err if there was none
 func checkedClose(f io.Closer, err *error) {
 	cerr := f.Close()
-	if *err != nil {
-		err = &cerr
+	if *err == nil {
+		*err = cerr
 	}
 }
 
@@ -101,68 +258,402 @@ func checkedClose(f io.Closer, err *error) {
 func (t *Task) Close() {
 	t.RLock()
 	defer t.RUnlock()
-	if len(t.dirimage) > 0 {
-		os.RemoveAll(t.dirimage)
+	if t.usernet != nil {
+		t.usernet.Close()
+	}
+	if t.cgroup != nil {
+		t.cgroup.remove()
+	}
+	if !unmountVolumes(t.mounts) {
+		// Never remove the content of the volumes
+		log.Printf("WARN: Keeping %s with volumes mounted", t.dirimage)
+	} else if t.overlay != nil {
+		t.overlay.remove()
+		if t.cachedRoot != nil {
+			t.cachedRoot.Release()
+		}
+	} else if len(t.dirimage) > 0 && !t.local {
+		removeAll(t.dirimage)
+	}
+	if t.etcDir != "" {
+		os.RemoveAll(t.etcDir)
 	}
-	if t.image != nil {
+	if t.image != nil && !t.cached {
 		os.Remove(t.image.Name())
 	}
+	for _, layer := range t.layers {
+		if layer.temp {
+			os.Remove(layer.path)
+		}
+	}
 }
 
-// ImagePath returns the path where the image file is stored
+// ImagePath returns the path where the image file is stored. It is
+// empty for images retrieved layer by layer from a registry or stored
+// in a directory.
 func (t *Task) ImagePath() string {
 	t.RLock()
-	name := t.image.Name()
-	t.RUnlock()
-	return name
+	defer t.RUnlock()
+	if t.image == nil {
+		return ""
+	}
+	return t.image.Name()
+}
+
+// ImageConfig returns the execution parameters from the image
+// configuration. It is nil until the image is retrieved or when the
+// image has no configuration.
+func (t *Task) ImageConfig() *ImageConfig {
+	t.RLock()
+	defer t.RUnlock()
+	return t.config
 }
 
 // Retrieve gets the URL from and it stored in the temporary directory
 // as temporary file. See `os.TempDir` for details.
+//
+// If the task has a Cache, remote images are stored there instead and
+// they are only downloaded again if they changed.
+//
+// If the task has an expected digest, the image is verified while it is
+// copied and a *DigestError is returned when it does not match.
 func (t *Task) Retrieve() (err error) {
-	var src io.Reader
 	switch t.URL.Scheme {
 	case "file":
-		if src, err = os.Open(t.URL.Path); err != nil {
+		if fi, err := os.Stat(t.URL.Path); err == nil && fi.IsDir() {
+			if t.Options.Digest != "" {
+				return errors.New("Digests cannot be verified for image directories")
+			}
+			if t.Options.SignaturePolicy != SignatureSkip {
+				return errors.New("Signatures of image directories cannot be verified")
+			}
+			return t.resolveLayers(t.URL.Path)
+		}
+	case "docker", "oci":
+		return t.retrieveLayers()
+	case "http", "https":
+		if t.Cache != nil {
+			if err = t.retrieveCached(); err != nil {
+				t.discardImage()
+				return err
+			}
+			return t.checkImage()
+		}
+	}
+
+	src, err := t.openImage()
+	if err != nil {
+		return err
+	}
+	defer checkedClose(src, &err)
+
+	if t.image, err = ioutil.TempFile("", TaskFilePrefix); err != nil {
+		return err
+	}
+	// Close the temporary file after the copy
+	defer checkedClose(t.image, &err)
+
+	var dst io.Writer = t.image
+	var d *digester
+	if t.Options.Digest != "" {
+		if d, err = newDigester(t.Options.Digest); err != nil {
 			return err
 		}
-		defer checkedClose(src.(io.ReadCloser), &err)
+		dst = io.MultiWriter(t.image, d)
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		return err
+	}
+	if d != nil {
+		if err = d.Verify(); err != nil {
+			// Never extract a wrong image
+			t.discardImage()
+			return err
+		}
+	}
+
+	// Check if the image is a valid archive and it is compressed
+	return t.checkImage()
+}
+
+// openImage returns the stream of an image file from a file or an
+// HTTP(S) URL
+func (t *Task) openImage() (io.ReadCloser, error) {
+	switch t.URL.Scheme {
+	case "file":
+		return os.Open(t.URL.Path)
 	case "http", "https":
 		resp, err := http.Get(t.URL.String())
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("Impossible to get %v: %v", t.URL.String(), resp.Status)
+			resp.Body.Close()
+			return nil, fmt.Errorf("Impossible to get %v: %v", t.URL.String(), resp.Status)
 		}
+		return resp.Body, nil
+	}
+	return nil, fmt.Errorf("Invalid scheme %v", t.URL.Scheme)
+}
 
-		defer checkedClose(resp.Body, &err)
-		src = resp.Body
-	default:
-		return fmt.Errorf("Invalid scheme %v", t.URL.Scheme)
+// discardImage removes the retrieved image
+func (t *Task) discardImage() {
+	if t.image != nil && !t.cached {
+		os.Remove(t.image.Name())
 	}
+	t.image = nil
+	t.cached = false
+}
 
-	if t.image, err = ioutil.TempFile("", TaskFilePrefix); err != nil {
+// checkImage checks the retrieved image file is valid and signed and
+// finds its layers
+func (t *Task) checkImage() error {
+	if err := t.checkSignature(); err != nil {
+		t.discardImage()
 		return err
 	}
-	// Close the temporary file after the copy
-	defer checkedClose(t.image, &err)
+	if _, err := ValidImage(t.image.Name()); err != nil {
+		return err
+	}
+	return t.resolveLayers(t.image.Name())
+}
+
+// checkSignature verifies the detached signature of the retrieved
+// image following the signature policy. A *SignatureError is
+// returned when the signature is required and it is not valid.
+func (t *Task) checkSignature() error {
+	if t.Options.SignaturePolicy == SignatureSkip {
+		return nil
+	}
+	sigURL := t.Options.SignatureURL
+	if sigURL == "" {
+		u := *t.URL
+		u.Fragment = ""
+		u.Path += SignatureSuffix
+		sigURL = u.String()
+		if u.Scheme == "file" {
+			sigURL = u.Path
+		}
+	}
+	sig, err := fetchSignature(sigURL)
+	if err == nil {
+		err = verifySignature(t.image.Name(), sig, t.Options.TrustedKeys)
+	}
+	if err == nil {
+		return nil
+	}
+	serr := &SignatureError{URL: sigURL, Reason: err}
+	if t.Options.SignaturePolicy == SignatureWarn {
+		log.Printf("WARN: %v", serr)
+		return nil
+	}
+	return serr
+}
 
-	if _, err = io.Copy(t.image, src); err != nil {
+// retrieveCached gets the image from an HTTP server through the cache
+func (t *Task) retrieveCached() error {
+	path, resp, err := t.requestCached()
+	if err != nil {
 		return err
 	}
+	if resp != nil {
+		defer resp.Body.Close()
+		var src io.Reader = resp.Body
+		var d *digester
+		if t.Options.Digest != "" {
+			if d, err = newDigester(t.Options.Digest); err != nil {
+				return err
+			}
+			src = io.TeeReader(resp.Body, d)
+		}
+		w, err := t.Cache.create()
+		if err != nil {
+			return fmt.Errorf("Cache: %v", err)
+		}
+		if _, err = io.Copy(w, src); err != nil {
+			w.discard()
+			return fmt.Errorf("Cache: %v", err)
+		}
+		// A mismatching image is not stored in the cache
+		if d != nil {
+			if err = d.Verify(); err != nil {
+				w.discard()
+				return err
+			}
+		}
+		var digest string
+		if digest, path, err = w.commit(); err != nil {
+			return fmt.Errorf("Cache: %v", err)
+		}
+		if err = t.setCacheEntry(resp, digest); err != nil {
+			return err
+		}
+	}
+	return t.useCachedImage(path)
+}
 
-	// I didn't manage to do that before downloading the whole
-	// file because of limitations in compress package to use with
-	// bufio.Reader
-	// Check if the image is a valid archive and it is compressed
-	t.compressed, err = ValidImage(t.image.Name())
+// requestCached requests the image from an HTTP server through the
+// cache. A cached image is revalidated with its ETag or Last-Modified
+// headers and its path is returned when it did not change. Otherwise,
+// the response with the image is returned.
+func (t *Task) requestCached() (string, *http.Response, error) {
+	rawurl := t.cacheURL()
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	entry := t.Cache.Entry(rawurl)
+	if entry != nil {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return "", resp, nil
+	case resp.StatusCode == http.StatusNotModified && entry != nil:
+		resp.Body.Close()
+	default:
+		resp.Body.Close()
+		return "", nil, fmt.Errorf("Impossible to get %v: %v", rawurl, resp.Status)
+	}
+	if !t.Cache.Has(entry.Digest) {
+		return "", nil, fmt.Errorf("Blob %s removed from the cache", entry.Digest)
+	}
+	path, err := t.Cache.Path(entry.Digest)
+	if err != nil {
+		return "", nil, err
+	}
+	if t.Options.Digest != "" && t.Options.Digest != entry.Digest {
+		if err = verifyFile(path, t.Options.Digest); err != nil {
+			return "", nil, err
+		}
+	}
+	return path, nil, nil
+}
+
+// cacheURL returns the URL of the image recorded in the cache
+func (t *Task) cacheURL() string {
+	u := *t.URL
+	u.Fragment = ""
+	return u.String()
+}
+
+// setCacheEntry records the digest of the image stored from resp
+func (t *Task) setCacheEntry(resp *http.Response, digest string) error {
+	return t.Cache.SetEntry(&CacheEntry{
+		URL:          t.cacheURL(),
+		Digest:       digest,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+}
+
+// useCachedImage uses the image blob at path in the cache
+func (t *Task) useCachedImage(path string) (err error) {
+	if t.image, err = os.Open(path); err != nil {
+		return err
+	}
+	t.cached = true
+	return t.image.Close()
+}
+
+// resolveLayers finds the layers of a docker save archive or an OCI
+// image layout stored at path. The image is selected with the tag
+// given in the URL fragment (#tag=name:tag) if there are several.
+func (t *Task) resolveLayers(path string) error {
+	format, index, err := scanImage(path)
+	if err != nil || format == RootFSFormat || format == RootDirFormat {
+		return err
+	}
+	fragment, err := url.ParseQuery(t.URL.Fragment)
+	if err != nil {
+		index.remove()
+		return fmt.Errorf("URL fragment: %v", err)
+	}
+	config, layers, err := resolveLocalImage(path, index, format, fragment.Get("tag"))
+	if err != nil || len(layers) == 0 {
+		// The copy of a compressed archive is only kept for the layers
+		index.remove()
+	}
+	if err != nil {
+		return fmt.Errorf("Image %s: %v", format, err)
+	}
+	t.layers = layers
+	return t.readImageConfig(config)
+}
 
+// readImageConfig decodes the image configuration stored in a blob
+func (t *Task) readImageConfig(config blob) (err error) {
+	r, err := config.open()
+	if err != nil {
+		return fmt.Errorf("Image config: %v", err)
+	}
+	defer checkedClose(r, &err)
+	t.config, err = decodeImageConfig(r)
 	return err
 }
 
+// retrieveLayers gets the layers of an image from a registry and
+// stores them in the cache or in temporary files
+func (t *Task) retrieveLayers() (err error) {
+	reg, ref := newRegistry(t.URL)
+	if t.Options.Digest != "" {
+		// Pin the manifest by its digest
+		ref = t.Options.Digest
+	}
+	manifest, err := reg.Manifest(ref)
+	if err != nil {
+		return err
+	}
+	var config bytes.Buffer
+	if err = reg.Blob(&config, manifest.Config); err != nil {
+		return fmt.Errorf("Image config: %v", err)
+	}
+	if t.config, err = decodeImageConfig(&config); err != nil {
+		return err
+	}
+	for _, desc := range manifest.Layers {
+		if t.Cache != nil {
+			desc := desc
+			path, err := t.Cache.Fetch(desc.Digest, func(w io.Writer) error {
+				return reg.Blob(w, desc)
+			})
+			if err != nil {
+				return fmt.Errorf("Layer %s: %v", desc.Digest, err)
+			}
+			t.layers = append(t.layers, blob{path: path})
+			continue
+		}
+		f, err := ioutil.TempFile("", TaskFilePrefix)
+		if err != nil {
+			return err
+		}
+		t.layers = append(t.layers, blob{path: f.Name(), temp: true})
+		err = reg.Blob(f, desc)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("Layer %s: %v", desc.Digest, err)
+		}
+	}
+	return nil
+}
+
 // Start the command asynchronously with wd as working directory and
-// env with the environment variables
+// env with the environment variables.
+//
+// When the image has a configuration, it gives the defaults for the
+// command, the environment variables, the working directory and the
+// user like `docker run` does.
 func (t *Task) Start(wd string, env []string) error {
 	return t.start(false, wd, env)
 }
@@ -170,25 +661,66 @@ func (t *Task) Start(wd string, env []string) error {
 func (t *Task) start(chrooted bool, wd string, env []string) (err error) {
 	t.Lock()
 	defer t.Unlock()
-	if t.image == nil {
-		if err = t.Retrieve(); err != nil {
+	if err = t.prepare(); err != nil {
+		return err
+	}
+	var cred *syscall.Credential
+	if t.config != nil {
+		env = mergeEnv(t.config.Env, env)
+		if wd == "" {
+			wd = t.config.WorkingDir
+		}
+		if err = t.applyCommand(chrooted); err != nil {
 			return err
 		}
+		if t.config.User != "" {
+			uid, gid, err := lookupUser(t.rootfs(), t.config.User)
+			if err != nil {
+				return err
+			}
+			cred = &syscall.Credential{Uid: uid, Gid: gid}
+		}
 	}
-	if len(t.dirimage) == 0 {
-		// Extract the content in dirimage
-		if err = t.extractImage(); err != nil {
-			t.dirimage = ""
+
+	t.Command.Dir = t.dirimage
+	volumes := t.Options.Volumes
+	if chrooted && t.Options.Hostname != "" && t.etcDir == "" {
+		var etc []Volume
+		if t.etcDir, etc, err = writeEtcFiles(t.Options.Hostname, t.Options.Network, volumes); err != nil {
 			return err
 		}
+		volumes = append(append([]Volume(nil), volumes...), etc...)
 	}
-	t.Command.Dir = t.dirimage
 	if chrooted {
 		// FIXME: Check Linux
 		// Check the caps
 		if os.Geteuid() == 0 {
-			t.Command.SysProcAttr = &syscall.SysProcAttr{Chroot: t.dirimage}
+			// The command is looked up inside the jail
+			if t.Command.Path, err = lookPathIn(t.rootfs(), t.Command.Args[0], env); err != nil {
+				return err
+			}
+			t.Command.Err = nil
+			// There is no mount namespace, the volumes are mounted
+			// in the host until the task is closed
+			if err = t.mountInHost(volumes); err != nil {
+				return err
+			}
+			t.Command.SysProcAttr = &syscall.SysProcAttr{Chroot: t.dirimage, Credential: cred}
+			if t.Command.Stdout == nil {
+				t.Command.Stdout = os.Stdout
+			}
+			if t.Command.Stderr == nil {
+				t.Command.Stderr = os.Stderr
+			}
+			// Dir is set after the chroot
+			t.Command.Dir = "/"
+			if wd != "" {
+				t.Command.Dir = wd
+			}
 		} else {
+			if cred != nil && (cred.Uid != 0 || cred.Gid != 0) {
+				log.Printf("WARN: Only root is mapped in the user namespace, ignoring image user %q", t.config.User)
+			}
 			// Use unprivileged mode
 			// By calling the same program with different arguments
 			// See libcontainer doc for details
@@ -196,37 +728,210 @@ func (t *Task) start(chrooted bool, wd string, env []string) (err error) {
 			if wd != "" {
 				args = append(args, "-wd", wd)
 			}
+			if o := t.overlay; o != nil && o.inNamespace() {
+				// Mounted over the task directory in the namespace
+				args = append(args, "-lowerdir", o.lower, "-upperdir", o.upper(), "-workdir", o.work())
+			}
+			args = append(args, "-mounts", (AllSystemMounts &^ t.Options.SkipMounts).String())
+			for _, v := range volumes {
+				args = append(args, "-v", v.String())
+			}
+			for _, path := range t.Options.Tmpfs {
+				args = append(args, "-tmpfs", path)
+			}
+			if t.Options.ReadOnly {
+				args = append(args, "-read-only")
+			}
+			if t.Options.Hostname != "" {
+				args = append(args, "-hostname", t.Options.Hostname)
+			}
+			if t.Options.Seccomp != nil {
+				profile, err := json.Marshal(t.Options.Seccomp)
+				if err != nil {
+					return err
+				}
+				args = append(args, "-seccomp", string(profile))
+			}
+			cloneflags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS |
+				syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+			if t.Options.Network != NetworkHost {
+				// The network is set up in the namespace
+				args = append(args, "-net", t.Options.Network.String())
+				cloneflags |= syscall.CLONE_NEWNET
+			}
 			t.Command.Args = append(args, t.Command.Args...)
 			t.Command.Path = "/proc/self/exe"
+			// The command is looked up inside the jail
+			t.Command.Err = nil
 			t.Command.SysProcAttr = &syscall.SysProcAttr{
-				Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
-				UidMappings: []syscall.SysProcIDMap{
-					{
-						ContainerID: 0,
-						HostID:      os.Geteuid(),
-						Size:        1,
-					},
-				},
-				GidMappings: []syscall.SysProcIDMap{
-					{
-						ContainerID: 0,
-						HostID:      os.Getegid(),
-						Size:        1,
-					},
-				},
+				Cloneflags:  uintptr(cloneflags),
+				UidMappings: uidMappings(),
+				GidMappings: gidMappings(),
 			}
 			t.Command.Stdin = os.Stdin
 			t.Command.Stdout = os.Stdout
 			t.Command.Stderr = os.Stderr
 		}
-	} else if wd != "" {
-		t.Command.Dir = wd
+	} else {
+		if o := t.overlay; o != nil && o.inNamespace() {
+			// There is no namespace to mount the overlay
+			if err = o.copy(); err != nil {
+				return err
+			}
+		}
+		if wd != "" {
+			t.Command.Dir = wd
+		}
 	}
 
 	if len(env) > 0 {
 		t.Command.Env = env
 	}
-	return t.Command.Start()
+	if t.Options.Resources.Limited() && t.cgroup == nil {
+		if t.cgroup, err = newCgroup(t.Options.Resources); err != nil {
+			return err
+		}
+		if t.Command.SysProcAttr == nil {
+			t.Command.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		// Cloned into the cgroup, so it is limited before it execs
+		t.Command.SysProcAttr.UseCgroupFD = true
+		t.Command.SysProcAttr.CgroupFD = t.cgroup.fd()
+	}
+	if chrooted && os.Geteuid() != 0 {
+		// The namespaces are created with the user one
+		if t.Options.Network == NetworkSlirp {
+			return t.startSlirp(0)
+		}
+		return t.Command.Start()
+	}
+	if t.Options.Seccomp != nil {
+		log.Printf("WARN: Seccomp profiles are only applied to unprivileged chrooted tasks")
+	}
+	// There are no task namespaces, the privileged tasks get them from
+	// the thread starting the command
+	var flags int
+	var setup []func() error
+	if os.Geteuid() == 0 {
+		flags = syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+	}
+	if hostname := t.Options.Hostname; hostname != "" {
+		flags |= syscall.CLONE_NEWUTS
+		setup = append(setup, func() error { return setHostname(hostname) })
+	}
+	switch t.Options.Network {
+	case NetworkNone:
+		flags |= syscall.CLONE_NEWNET
+		setup = append(setup, loopbackUp)
+	case NetworkSlirp:
+		return t.startSlirp(flags|syscall.CLONE_NEWNET, setup...)
+	}
+	if flags == 0 {
+		return t.Command.Start()
+	}
+	return startUnshared(t.Command, flags, setup...)
+}
+
+// startSlirp starts the command with user-mode networking. The TAP
+// device is created in the namespaces unshared with the given flags
+// and setup, or in the task namespaces without flags and sent back
+// through a unix socket.
+func (t *Task) startSlirp(unshare int, setup ...func() error) (err error) {
+	if t.usernet, err = newUsernet(t.Options.PortForwards); err != nil {
+		return err
+	}
+	var tap *os.File
+	if unshare != 0 {
+		err = startUnshared(t.Command, unshare, append(setup, func() (err error) {
+			tap, err = createTap()
+			return err
+		})...)
+		if err != nil {
+			return err
+		}
+		t.usernet.run(tap)
+		return nil
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Socketpair: %v", err)
+	}
+	parent := os.NewFile(uintptr(fds[0]), "tap-socket")
+	defer parent.Close()
+	child := os.NewFile(uintptr(fds[1]), "tap-socket")
+	t.Command.ExtraFiles = []*os.File{child}
+	err = t.Command.Start()
+	child.Close()
+	if err != nil {
+		return err
+	}
+	if tap, err = recvFile(parent, tapName); err != nil {
+		return fmt.Errorf("TAP device of the task: %v", err)
+	}
+	t.usernet.run(tap)
+	return nil
+}
+
+// ForwardedAddrs returns the host addresses forwarded to the task with
+// NetworkSlirp, in the order of Options.PortForwards
+func (t *Task) ForwardedAddrs() []net.Addr {
+	t.RLock()
+	defer t.RUnlock()
+	if t.usernet == nil {
+		return nil
+	}
+	return t.usernet.Addrs()
+}
+
+// mountInHost mounts the volumes, the tmpfs and the read-only root of
+// a privileged task in the host
+func (t *Task) mountInHost(volumes []Volume) error {
+	mounted, err := mountVolumes(t.dirimage, volumes)
+	t.mounts = append(t.mounts, mounted...)
+	if err != nil {
+		return err
+	}
+	mounted, err = mountTmpfs(t.dirimage, t.Options.Tmpfs)
+	t.mounts = append(t.mounts, mounted...)
+	if err != nil {
+		return err
+	}
+	if t.Options.ReadOnly {
+		// Recorded even on errors and unmounted first, with the
+		// volumes bound again under it
+		t.mounts = append(t.mounts, t.dirimage)
+		return mountReadOnlyRoot(t.dirimage)
+	}
+	return nil
+}
+
+// applyCommand sets the command from the image config and the
+// arguments given by the user, if any
+func (t *Task) applyCommand(chrooted bool) error {
+	var userArgs []string
+	if len(t.Command.Args) > 0 && t.Command.Args[0] != "" {
+		userArgs = t.Command.Args
+	}
+	args := t.config.Args(userArgs)
+	if len(args) == 0 {
+		return errors.New("No command to run given or in the image config")
+	}
+	if len(userArgs) > 0 && len(t.config.Entrypoint) == 0 {
+		// Nothing to change
+		return nil
+	}
+	// Chrooted commands are looked up inside the jail later
+	path := args[0]
+	if !chrooted {
+		var err error
+		if path, err = exec.LookPath(args[0]); err != nil {
+			return err
+		}
+	}
+	t.Command.Path = path
+	t.Command.Args = args
+	t.Command.Err = nil
+	return nil
 }
 
 // StartChroot starts the command asynchronously in the chroot jail.
@@ -246,7 +951,7 @@ func (t *Task) Status() Status {
 	t.RLock()
 	defer t.RUnlock()
 	status := NotStarted
-	if t.image != nil {
+	if t.image != nil || len(t.layers) > 0 {
 		status = Retrieved
 	}
 	if len(t.dirimage) > 0 {
@@ -302,106 +1007,9 @@ func (t *Task) Signal(sig os.Signal) error {
 	return fmt.Errorf("Impossible to send a signal to a non-running process")
 }
 
-// Extract a image in the dirimage
-func (t *Task) extractImage() (err error) {
-	var reader io.Reader
-
-	if t.dirimage, err = ioutil.TempDir("", TaskFilePrefix); err != nil {
-		return fmt.Errorf("TempDir: %v", err)
-	}
-
-	image, err := os.OpenFile(t.image.Name(), os.O_RDONLY, 0444)
-	if err != nil {
-		return
-	}
-	defer checkedClose(image, &err)
-
-	if t.compressed {
-		if reader, err = gzip.NewReader(image); err != nil {
-			return
-		}
-		defer checkedClose(reader.(io.Closer), &err)
-	} else {
-		reader = image
-	}
-
-	wd, err := os.Getwd()
-	if err != nil {
-		return fmt.Errorf("Getwd: %v", err)
-	}
-	if err = os.Chdir(t.dirimage); err != nil {
-		return fmt.Errorf("Chdir: %v", err)
-	}
-	defer func() {
-		cherr := os.Chdir(wd)
-		if err == nil && cherr != nil {
-			err = cherr
-		}
-	}()
-
-	tr := tar.NewReader(reader)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			// End of the tar archive
-			break
-		} else if err != nil {
-			return err
-		}
-		path := hdr.Name
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if err = os.MkdirAll(path, os.FileMode(hdr.Mode)); err != nil {
-				return err
-			}
-		case tar.TypeReg:
-			f, err := os.OpenFile(path, os.O_RDWR|os.O_TRUNC, 0777)
-			if err != nil {
-				if f, err = os.Create(path); err != nil {
-					return err
-				}
-			}
-			defer checkedClose(f, &err)
-			if err = os.Chmod(path, os.FileMode(hdr.Mode)); err != nil {
-				return fmt.Errorf("Chmod: %v", err)
-			}
-			if _, err = io.Copy(f, tr); err != nil {
-				return fmt.Errorf("Copy: %v", err)
-			}
-		case tar.TypeSymlink:
-			target := hdr.Linkname
-			if filepath.IsAbs(hdr.Linkname) {
-				target = strings.TrimPrefix(hdr.Linkname, string(filepath.Separator))
-				target = filepath.Join(t.dirimage, target)
-				abspath := filepath.Dir(filepath.Join(t.dirimage, path))
-				if target, err = filepath.Rel(abspath, target); err != nil {
-					return err
-				}
-			}
-			if err = os.Symlink(target, path); err != nil {
-				switch err.(*os.LinkError).Err.Error() {
-				case "file exists": // Do nothing
-				case "no such file or directory":
-					// Create the target directory file first
-					if err = os.MkdirAll(filepath.Dir(target), 0777); err != nil {
-						return err
-					}
-					if err = os.Symlink(target, path); err != nil {
-						return fmt.Errorf("Symlink: %v", err)
-					}
-				default:
-					return fmt.Errorf("Symlink: %v", err)
-				}
-			}
-		default:
-			return fmt.Errorf("Unknown type flag %c for path %s", hdr.Typeflag, path)
-		}
-	}
-	return
-}
-
 // RunContainer sets up the view of the filesystem in namespaces and then run
+// the command given in the arguments left by the flags
 func RunContainer(wd string) error {
-	container := &Container{Args: os.Args[flag.NFlag()*2+1:]}
+	container := &Container{Args: flag.Args()}
 	return container.Run(wd)
 }
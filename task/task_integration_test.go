@@ -7,8 +7,13 @@ package task
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -144,3 +149,232 @@ func TestWDTask(t *testing.T) {
 		t.Errorf("Expected out is /bin != %s", out)
 	}
 }
+
+// Test the standard filesystems mounted inside the jail
+func TestSystemMountsTask(t *testing.T) {
+	if len(*testImage) == 0 {
+		t.Skip("Test image not available. Use -test-image to set it")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("Privileged tasks are chrooted without a mount namespace")
+	}
+	cmd := exec.Command(chrootWrapperBinary, "run", *testImage,
+		"ls", "/proc/self/stat", "/dev/null", "/dev/urandom", "/sys/kernel", "/tmp")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to run: %v\nOutput: %s", err, out)
+	}
+
+	cmd = exec.Command(chrootWrapperBinary, "-mounts", "tmp", "run", *testImage, "ls", "/proc/self")
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("/proc must not be mounted: %s", out)
+	}
+}
+
+// Test the host directories bind mounted in the jail
+func TestVolumesTask(t *testing.T) {
+	if len(*testImage) == 0 {
+		t.Skip("Test image not available. Use -test-image to set it")
+	}
+	dir, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "input"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(chrootWrapperBinary, "-v", dir+":/data", "-v", dir+":/input:ro",
+		"run", *testImage, "sh", "-c", "cat /input/input > /data/output && ! touch /input/fail")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to run: %v\nOutput: %s", err, out)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "output")); string(data) != "data" {
+		t.Errorf("Output %q != data (%v)", data, err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "fail")); err == nil {
+		t.Error("Read-only volume must not be writable")
+	}
+}
+
+// Test the read-only root filesystem with a writable tmpfs
+func TestReadOnlyTask(t *testing.T) {
+	if len(*testImage) == 0 {
+		t.Skip("Test image not available. Use -test-image to set it")
+	}
+	cmd := exec.Command(chrootWrapperBinary, "-read-only", "-tmpfs", "/run",
+		"run", *testImage, "sh", "-c", "touch /run/file && ! touch /file")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to run: %v\nOutput: %s", err, out)
+	}
+}
+
+// Test the isolated network cannot reach a server in the host loopback
+func TestNetworkNoneTask(t *testing.T) {
+	if len(*testImage) == 0 {
+		t.Skip("Test image not available. Use -test-image to set it")
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "reachable")
+	}))
+	defer ts.Close()
+
+	for _, network := range []string{"host", "none"} {
+		cmd := exec.Command(chrootWrapperBinary, "-net", network, "run", *testImage,
+			"wget", "-T", "2", "-q", "-O", "-", ts.URL)
+		out, err := cmd.CombinedOutput()
+		reached := err == nil && strings.Contains(string(out), "reachable")
+		if reached != (network == "host") {
+			t.Errorf("Network %s: reached %v: %v\nOutput: %s", network, reached, err, out)
+		}
+	}
+}
+
+// Test user-mode networking reaching the host and forwarding a port
+func TestSlirpTask(t *testing.T) {
+	if len(*testImage) == 0 {
+		t.Skip("Test image not available. Use -test-image to set it")
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "reachable")
+	}))
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	cmd := exec.Command(chrootWrapperBinary, "-net", "slirp", "run", *testImage,
+		"wget", "-T", "5", "-q", "-O", "-", "http://10.0.2.2:"+port)
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "reachable") {
+		t.Errorf("Host not reached: %v\nOutput: %s", err, out)
+	}
+
+	// Free port to forward
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	cmd = exec.Command(chrootWrapperBinary, "-port", "8889", "-net", "slirp", "-p", addr+":8080",
+		"run", *testImage, "httpd", "-f", "-p", "8080", "-h", "/etc")
+	if err = cmd.Start(); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	var body []byte
+	for i := 0; i < 50; i++ {
+		var resp *http.Response
+		if resp, err = http.Get("http://" + addr + "/hostname"); err == nil {
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil && resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil || len(body) == 0 {
+		t.Errorf("Forwarded port not reached: %v: %q", err, body)
+	}
+}
+
+// Test the hostname and its generated /etc files
+func TestHostnameTask(t *testing.T) {
+	if len(*testImage) == 0 {
+		t.Skip("Test image not available. Use -test-image to set it")
+	}
+	host, _ := os.Hostname()
+	cmd := exec.Command(chrootWrapperBinary, "-hostname", "jail", "run", *testImage,
+		"sh", "-c", "hostname; cat /etc/hostname /etc/hosts; hostname changed")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Failed to run: %v\nOutput: %s", err, out)
+	}
+	if !strings.HasPrefix(string(out), "jail\njail\n") || !strings.Contains(string(out), "\tjail\n") {
+		t.Errorf("Wrong hostname and /etc files: %s", out)
+	}
+	if now, _ := os.Hostname(); now != host {
+		t.Errorf("Hostname of the host changed to %s", now)
+	}
+}
+
+// Test a fork bomb stopped by the limit of processes
+func TestResourcesTask(t *testing.T) {
+	if len(*testImage) == 0 {
+		t.Skip("Test image not available. Use -test-image to set it")
+	}
+	cmd := exec.Command(chrootWrapperBinary, "-pids", "8", "run", *testImage,
+		"sh", "-c", "for i in $(seq 20); do sleep 2 & done; wait")
+	out, err := cmd.CombinedOutput()
+	if strings.Contains(string(out), "not available") || strings.Contains(string(out), "not delegated") {
+		t.Skipf("Cgroups not available: %s", out)
+	}
+	if !strings.Contains(string(out), "can't fork") && !strings.Contains(string(out), "Resource temporarily unavailable") {
+		t.Errorf("Processes not limited: %v\nOutput: %s", err, out)
+	}
+}
+
+// Test the statistics of a running task
+func TestStatsTask(t *testing.T) {
+	if len(*testImage) == 0 {
+		t.Skip("Test image not available. Use -test-image to set it")
+	}
+	cmd := exec.Command(chrootWrapperBinary, "-port", "8890", "run", *testImage,
+		"sh", "-c", "sleep 3 & sleep 3")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+	defer cmd.Wait()
+	time.Sleep(1 * time.Second)
+
+	out, err := exec.Command(chrootWrapperBinary, "-port", "8890", "stats").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to get the statistics: %v\nOutput: %s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "CPU TIME") || len(strings.Fields(lines[1])) != 6 {
+		t.Errorf("Wrong statistics: %s", out)
+	}
+
+	// Streamed until the task finishes
+	out, err = exec.Command(chrootWrapperBinary, "-port", "8890", "stats", "--watch", "--interval", "200ms").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to watch the statistics: %v\nOutput: %s", err, out)
+	}
+	if lines = strings.Split(strings.TrimSpace(string(out)), "\n"); len(lines) < 5 {
+		t.Errorf("Statistics not streamed: %s", out)
+	}
+}
+
+// Test the syscalls blocked by the default and a custom seccomp profile
+func TestSeccompTask(t *testing.T) {
+	if len(*testImage) == 0 {
+		t.Skip("Test image not available. Use -test-image to set it")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("Seccomp profiles are only applied to unprivileged tasks")
+	}
+	for profile, blocked := range map[string]bool{"default": true, "unconfined": false} {
+		cmd := exec.Command(chrootWrapperBinary, "-seccomp", profile, "run", *testImage,
+			"mount", "-t", "tmpfs", "tmpfs", "/mnt")
+		out, err := cmd.CombinedOutput()
+		if blocked != (err != nil) {
+			t.Errorf("mount with the %s profile must be blocked %v: %v\nOutput: %s", profile, blocked, err, out)
+		}
+	}
+
+	profile := filepath.Join(t.TempDir(), "seccomp.json")
+	if err := ioutil.WriteFile(profile, []byte(`{"defaultAction": "SCMP_ACT_ALLOW",
+		"syscalls": [{"names": ["mkdir", "mkdirat"], "action": "SCMP_ACT_ERRNO"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(chrootWrapperBinary, "-seccomp", profile, "run", *testImage,
+		"sh", "-c", "mkdir /tmp/blocked; touch /tmp/allowed && echo allowed")
+	out, _ := cmd.CombinedOutput()
+	if !strings.Contains(string(out), "Operation not permitted") || !strings.Contains(string(out), "allowed\n") {
+		t.Errorf("mkdir must fail with EPERM: %s", out)
+	}
+}
@@ -6,13 +6,24 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -197,7 +208,7 @@ func TestKillSignal(test *testing.T) {
 		test.Fatalf("Fail to send signal: %v", err)
 	}
 
-	time.Sleep(10*time.Microsecond)
+	time.Sleep(10 * time.Millisecond)
 
 	if t.Status() != Stopped {
 		test.Errorf("Process must be stopped: %s", t.Status())
@@ -235,7 +246,7 @@ func TestEnv(test *testing.T) {
 		test.Fatalf("Waiting: %v", err)
 	}
 	if out.String() != "korn=light\n" {
-		test.Errorf("Out: %s incorrect", out)
+		test.Errorf("Out: %s incorrect", out.String())
 	}
 }
 
@@ -257,85 +268,2580 @@ func TestWD(test *testing.T) {
 	if err = t.Command.Wait(); err != nil {
 		test.Fatalf("Waiting: %v", err)
 	}
-	if out.String() != "/bin\n" {
-		test.Errorf("Out: %s incorrect", out)
+	// /bin may be a symlink (e.g. to /usr/bin) in merged-usr systems
+	bin, err := filepath.EvalSymlinks("/bin")
+	if err != nil {
+		test.Fatalf("EvalSymlinks: %v", err)
+	}
+	if out.String() != bin+"\n" {
+		test.Errorf("Out: %s incorrect", out.String())
 	}
 }
 
-// Helper functions
+func TestParseReference(test *testing.T) {
+	var tests = []struct {
+		rawref, url string
+		shouldFail  bool
+	}{
+		{"docker://alpine", "docker://registry-1.docker.io/library/alpine:latest", false},
+		{"docker://alpine:3.4", "docker://registry-1.docker.io/library/alpine:3.4", false},
+		{"docker://docker.io/foo/bar@sha256:abcd", "docker://registry-1.docker.io/foo/bar@sha256:abcd", false},
+		{"oci://localhost:5000/foo/bar:v1", "oci://localhost:5000/foo/bar:v1", false},
+		{"oci://quay.io/foo/bar", "oci://quay.io/foo/bar:latest", false},
+		{"oci://bar:v1", "", true},
+		{"docker://", "", true},
+	}
 
-// Create a temporary tar.gz file
-// It is the caller's responsability to remove the temporary file
-func createTarGz(test *testing.T) *url.URL {
-	src, err := ioutil.TempFile("", "")
+	for _, t := range tests {
+		u, err := parseReference(t.rawref)
+		if t.shouldFail {
+			if err == nil {
+				test.Errorf("Reference %q must fail", t.rawref)
+			}
+			continue
+		}
+		if err != nil {
+			test.Errorf("Reference %q: %v", t.rawref, err)
+			continue
+		}
+		if u.String() != t.url {
+			test.Errorf("Reference %q: %s != %s", t.rawref, u, t.url)
+		}
+	}
+}
+
+func TestRegistryRetrieve(test *testing.T) {
+	layers := [][]byte{
+		createTarGzBytes(test, []testEntry{
+			{Name: "etc/", Type: tar.TypeDir},
+			{Name: "etc/motd", Body: "base"},
+		}),
+		createTarGzBytes(test, []testEntry{
+			{Name: "etc/motd", Body: "top"},
+			{Name: "readme.txt", Body: "layered"},
+		}),
+	}
+	ts := newTestRegistry(test, "foo/bar", "v1", layers, nil)
+	defer ts.Close()
+
+	t, err := CreateTask("oci://"+strings.TrimPrefix(ts.URL, "http://")+"/foo/bar:v1", "cmd")
 	if err != nil {
-		test.Fatalf("Impossible to create a temp file %v", err)
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	defer t.Close()
+	if err = t.Retrieve(); err != nil {
+		test.Fatalf("Error retrieving a task: %v", err)
+	}
+	if t.Status() != Retrieved {
+		test.Fatalf("Task status: %s != %s", t.Status(), Retrieved)
+	}
+	if err = t.extractImage(); err != nil {
+		test.Fatalf("Error extracting image: %v", err)
+	}
+	for name, content := range map[string]string{"etc/motd": "top", "readme.txt": "layered"} {
+		data, err := ioutil.ReadFile(filepath.Join(t.dirimage, name))
+		if err != nil {
+			test.Errorf("Reading %s: %v", name, err)
+		} else if string(data) != content {
+			test.Errorf("File %s: %q != %q", name, data, content)
+		}
 	}
-	err = createGZTarContent(src, test)
 
-	if err = src.Close(); err != nil {
-		test.Fatalf("Error closing file: %v", err)
+	// Unknown tag
+	t, err = CreateTask("oci://"+strings.TrimPrefix(ts.URL, "http://")+"/foo/bar:v2", "cmd")
+	if err != nil {
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	defer t.Close()
+	if err = t.Retrieve(); err == nil {
+		test.Errorf("Retrieving an unknown tag must fail")
 	}
+}
 
-	fileURL := &url.URL{
-		Scheme: "file",
-		Path:   src.Name(),
+func TestRegistryNestedIndexes(test *testing.T) {
+	// Chain of indexes each one pointing to the next one
+	manifests := map[string][]byte{}
+	next := "sha256:0000"
+	for i := 0; i <= maxIndexDepth+1; i++ {
+		index, err := json.Marshal(Manifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeOCIIndex,
+			Manifests:     []Descriptor{{Digest: next}},
+		})
+		if err != nil {
+			test.Fatalf("JSON marshalling: %v", err)
+		}
+		next = testDigest(index)
+		manifests[next] = index
+	}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			content, ok := manifests[strings.TrimPrefix(r.URL.Path, "/v2/foo/manifests/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(content)
+		}))
+	defer ts.Close()
+
+	r := &registry{base: ts.URL, repo: "foo", client: http.DefaultClient}
+	if _, err := r.Manifest(next); err == nil || !strings.Contains(err.Error(), "nested indexes") {
+		test.Errorf("Nested indexes must be limited: %v", err)
 	}
-	return fileURL
 }
 
-// Helper function to use for different backends
-func testRetrieve(test *testing.T, rawurl string, shouldFail bool) {
-	t, err := CreateTask(rawurl, "cmd")
+func TestLayerWhiteouts(test *testing.T) {
+	layers := [][]byte{
+		createTarGzBytes(test, []testEntry{
+			{Name: "etc/", Type: tar.TypeDir},
+			{Name: "etc/motd", Body: "hi"},
+			{Name: "etc/passwd", Body: "root"},
+			{Name: "var/cache/", Type: tar.TypeDir},
+			{Name: "var/cache/a", Body: "a"},
+			{Name: "var/cache/b", Body: "b"},
+			{Name: "opt/x/", Type: tar.TypeDir},
+			{Name: "opt/x/y", Body: "y"},
+			{Name: "srv/a/b/", Type: tar.TypeDir},
+			{Name: "srv/a/b/lower", Body: "lower"},
+			{Name: "srv/a/lower", Body: "lower"},
+		}),
+		createTarGzBytes(test, []testEntry{
+			{Name: "etc/.wh.motd"},
+			{Name: "var/cache/c", Body: "c"},
+			{Name: "var/cache/.wh..wh..opq"},
+			{Name: "opt/x", Body: "x"},
+			// Re-listed before the opaque whiteout of its parent
+			{Name: "srv/a/b/", Type: tar.TypeDir},
+			{Name: "srv/a/b/upper", Body: "upper"},
+			{Name: "srv/a/.wh..wh..opq"},
+		}),
+	}
+	t, err := CreateTask("file:///nonexistent", "cmd")
 	if err != nil {
-		test.Fatalf("Impossible to create a task: %v", err)
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	for _, layer := range layers {
+		f, err := ioutil.TempFile("", TaskFilePrefix)
+		if err != nil {
+			test.Fatalf("Impossible to create a temp file %v", err)
+		}
+		t.layers = append(t.layers, blob{path: f.Name(), temp: true})
+		f.Write(layer)
+		f.Close()
 	}
 	defer t.Close()
-	err = t.Retrieve()
-	if shouldFail && err == nil {
-		test.Fatalf("It should fail on retrieving the task")
+
+	if err = t.extractImage(); err != nil {
+		test.Fatalf("Error extracting image: %v", err)
 	}
-	if !shouldFail {
-		if err != nil {
-			test.Fatalf("Error retrieving a task: %v", err)
+	var files = []struct {
+		name   string
+		exists bool
+	}{
+		{"etc/motd", false},
+		{"etc/.wh.motd", false},
+		{"etc/passwd", true},
+		{"var/cache/a", false},
+		{"var/cache/b", false},
+		{"var/cache/c", true},
+		{"var/cache/.wh..wh..opq", false},
+		{"opt/x/y", false},
+		{"srv/a/b/upper", true},
+		{"srv/a/b/lower", false},
+		{"srv/a/lower", false},
+	}
+	for _, f := range files {
+		_, err := os.Lstat(filepath.Join(t.dirimage, f.name))
+		if f.exists && err != nil {
+			test.Errorf("File %s must exist: %v", f.name, err)
+		} else if !f.exists && err == nil {
+			test.Errorf("File %s must not exist", f.name)
 		}
-		if t.ImagePath() == "" {
-			test.Fatalf("Not possible to get the image path")
+	}
+	if fi, err := os.Lstat(filepath.Join(t.dirimage, "opt/x")); err != nil || !fi.Mode().IsRegular() {
+		test.Errorf("opt/x must be a regular file replacing the directory: %v", err)
+	}
+
+	// Whiteouts only remove entries of their directory
+	for _, name := range []string{"", ".", "..", "a/b", ".wh.x"} {
+		if validWhiteoutTarget(name) {
+			test.Errorf("Whiteout target %q must be invalid", name)
+		}
+	}
+	dir, err := openDirHandle(filepath.Join(t.dirimage, "etc"))
+	if err != nil {
+		test.Fatalf("openDirHandle: %v", err)
+	}
+	defer dir.Close()
+	for _, name := range []string{"", ".", "..", "../etc"} {
+		if err = dir.removeAll(name); err == nil {
+			test.Errorf("removeAll(%q) must fail", name)
 		}
-		test.Logf("Image path: %q", t.ImagePath())
+	}
+	if _, err = os.Lstat(filepath.Join(t.dirimage, "etc/passwd")); err != nil {
+		test.Errorf("etc/passwd must exist: %v", err)
 	}
 }
 
-// Helper to create a TAR GZ file
-func createGZTarContent(src io.Writer, test *testing.T) (err error) {
-	var files = []struct {
-		Name, Body string
+// Archives trying to write, link or remove files outside the root
+var hostileArchives = []struct {
+	name    string
+	entries []testEntry
+	// rejected archives fail, the rest are extracted inside the root
+	rejected bool
+}{
+	{"dotdot", []testEntry{{Name: "../outside/x", Body: "x"}}, true},
+	{"nested dotdot", []testEntry{{Name: "a/b/../../../outside/x", Type: tar.TypeDir}}, true},
+	{"absolute", []testEntry{{Name: "/../outside/x", Body: "x"}}, false},
+	{"symlink parent", []testEntry{
+		{Name: "evil", Type: tar.TypeSymlink, Link: "../outside"},
+		{Name: "evil/x", Body: "x"},
+	}, true},
+	{"absolute symlink parent", []testEntry{
+		{Name: "evil", Type: tar.TypeSymlink, Link: "/"},
+		{Name: "evil/x", Body: "x"},
+	}, true},
+	{"symlink parent dir", []testEntry{
+		{Name: "evil", Type: tar.TypeSymlink, Link: "../outside"},
+		{Name: "evil/sub/", Type: tar.TypeDir},
+	}, true},
+	{"symlink overwritten", []testEntry{
+		{Name: "evil", Type: tar.TypeSymlink, Link: "../outside/canary"},
+		{Name: "evil", Body: "x"},
+	}, false},
+	{"symlink whiteout", []testEntry{
+		{Name: "evil", Type: tar.TypeSymlink, Link: "../outside"},
+		{Name: "evil/.wh.canary"},
+	}, true},
+	{"symlink opaque whiteout", []testEntry{
+		{Name: "evil", Type: tar.TypeSymlink, Link: "../outside"},
+		{Name: "evil/.wh..wh..opq"},
+	}, true},
+	{"dangling symlink", []testEntry{
+		{Name: "link", Type: tar.TypeSymlink, Link: "../outside/newdir/x"},
+	}, false},
+	{"root file", []testEntry{{Name: ".", Body: "x"}}, false},
+	{"hard link dotdot", []testEntry{
+		{Name: "x", Type: tar.TypeLink, Link: "../outside/canary"},
+	}, true},
+	{"hard link symlink parent", []testEntry{
+		{Name: "evil", Type: tar.TypeSymlink, Link: "../outside"},
+		{Name: "x", Type: tar.TypeLink, Link: "evil/canary"},
+	}, true},
+	{"hard link to symlink", []testEntry{
+		{Name: "evil", Type: tar.TypeSymlink, Link: "../outside/canary"},
+		{Name: "x", Type: tar.TypeLink, Link: "evil"},
+		{Name: "x", Body: "x"},
+	}, false},
+	{"device symlink parent", []testEntry{
+		{Name: "evil", Type: tar.TypeSymlink, Link: "../outside"},
+		{Name: "evil/null", Type: tar.TypeChar, Devmajor: 1, Devminor: 3},
+	}, true},
+	{"whiteout dot", []testEntry{{Name: ".wh.."}}, true},
+	{"whiteout dotdot", []testEntry{{Name: ".wh..."}}, true},
+	{"nested whiteout dot", []testEntry{
+		{Name: "a/", Type: tar.TypeDir},
+		{Name: "a/.wh.."},
+	}, true},
+	{"nested whiteout dotdot", []testEntry{
+		{Name: "a/", Type: tar.TypeDir},
+		{Name: "a/.wh..."},
+	}, true},
+	{"whiteout of whiteout", []testEntry{{Name: ".wh..wh.."}}, true},
+	{"whiteout of opaque whiteout", []testEntry{{Name: ".wh..wh..wh..opq"}}, true},
+	{"root opaque whiteout", []testEntry{{Name: ".wh..wh..opq"}}, false},
+}
+
+func TestHostileArchives(test *testing.T) {
+	for _, tc := range hostileArchives {
+		err := extractConfined(test, createTarBytes(test, tc.entries))
+		if tc.rejected {
+			if _, ok := err.(*UnsafePathError); !ok {
+				test.Errorf("Archive %s: %v is not an *UnsafePathError", tc.name, err)
+			}
+		} else if err != nil {
+			test.Errorf("Archive %s: %v", tc.name, err)
+		}
+	}
+}
+
+func TestEntryTypes(test *testing.T) {
+	image := createTarGzBytes(test, []testEntry{
+		{Name: "bin/busybox", Body: "busybox"},
+		{Name: "bin/sh", Type: tar.TypeLink, Link: "bin/busybox"},
+		{Name: "dev/null", Type: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Name: "dev/loop0", Type: tar.TypeBlock, Mode: 0660, Devmajor: 7, Devminor: 0},
+		{Name: "run/initctl", Type: tar.TypeFifo, Mode: 0600},
+		{Name: "volume", Type: 'V'}, // GNU volume header
+	})
+	path := writeTempFile(test, image)
+	defer os.Remove(path)
+	t, err := CreateTask("file://"+path, "cmd")
+	if err != nil {
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	defer t.Close()
+	if err = t.Prepare(); err != nil {
+		test.Fatalf("Prepare: %v", err)
+	}
+	report := t.ExtractReport()
+
+	busybox, err := os.Stat(filepath.Join(t.dirimage, "bin/busybox"))
+	if err != nil {
+		test.Fatalf("bin/busybox: %v", err)
+	}
+	if sh, err := os.Stat(filepath.Join(t.dirimage, "bin/sh")); err != nil || !os.SameFile(busybox, sh) {
+		test.Errorf("bin/sh must be a hard link of bin/busybox: %v", err)
+	}
+	if fi, err := os.Lstat(filepath.Join(t.dirimage, "run/initctl")); err != nil || fi.Mode()&os.ModeNamedPipe == 0 || fi.Mode().Perm() != 0600 {
+		test.Errorf("run/initctl must be a FIFO with 0600 permissions: %v (%v)", fi.Mode(), err)
+	}
+	substituted := strings.Join(report.Substituted, ",")
+	var devices = []struct {
+		name string
+		mode os.FileMode
 	}{
-		{"readme.txt", "This archive contains this file."},
+		{"dev/null", os.ModeDevice | os.ModeCharDevice},
+		{"dev/loop0", os.ModeDevice},
+	}
+	for _, d := range devices {
+		fi, err := os.Lstat(filepath.Join(t.dirimage, d.name))
+		if err != nil {
+			test.Errorf("%s: %v", d.name, err)
+		} else if strings.Contains(substituted, d.name) {
+			if !fi.Mode().IsRegular() || fi.Size() != 0 {
+				test.Errorf("%s must be substituted by an empty file: %v", d.name, fi.Mode())
+			}
+		} else if fi.Mode()&os.ModeType != d.mode {
+			test.Errorf("%s must be a device: %v", d.name, fi.Mode())
+		} else if st := fi.Sys().(*syscall.Stat_t); d.name == "dev/null" && st.Rdev != 259 {
+			test.Errorf("dev/null device number %d != 259", st.Rdev)
+		}
+	}
+	if len(report.Skipped) != 1 || report.Skipped[0] != "volume" {
+		test.Errorf("Only volume must be skipped: %v", report.Skipped)
 	}
+}
 
-	gw := gzip.NewWriter(src)
-	tw := tar.NewWriter(gw)
-	for _, file := range files {
+func TestRestoreAttrs(test *testing.T) {
+	mtime := time.Date(2015, 10, 21, 16, 29, 0, 0, time.UTC)
+	image := createTarGzBytes(test, []testEntry{
+		{Name: "bin/", Type: tar.TypeDir, Mode: 0555, ModTime: mtime},
+		{Name: "bin/su", Body: "su", Mode: 04755, ModTime: mtime},
+		{Name: "bin/ping", Body: "ping", Mode: 0755, Uid: 1000, Gid: 1000, ModTime: mtime,
+			PAXRecords: map[string]string{
+				"SCHILY.xattr.user.test":              "value",
+				"SCHILY.xattr.trusted.overlay.opaque": "y",
+			}},
+		{Name: "bin/sh", Type: tar.TypeSymlink, Link: "su", ModTime: mtime},
+	})
+	path := writeTempFile(test, image)
+	defer os.Remove(path)
+
+	for _, ownership := range []Ownership{OwnershipFaithful, OwnershipSquash} {
+		t, err := CreateTaskWithOptions("file://"+path, Options{Ownership: ownership, ExtractWorkers: 4}, "cmd")
+		if err != nil {
+			test.Fatalf("Cannot create task: %v", err)
+		}
+		if err = t.Prepare(); err != nil {
+			test.Fatalf("Prepare %s: %v", ownership, err)
+		}
+		unrestored := strings.Join(t.ExtractReport().Unrestored, ",")
+		squashed := strings.Join(t.ExtractReport().Squashed, ",")
+		var files = []struct {
+			name     string
+			mode     os.FileMode
+			uid, gid int
+		}{
+			{"bin", os.ModeDir | 0555, 0, 0},
+			{"bin/su", os.ModeSetuid | 0755, 0, 0},
+			{"bin/ping", 0755, 1000, 1000},
+			{"bin/sh", os.ModeSymlink | 0777, 0, 0},
+		}
+		for _, f := range files {
+			fi, err := os.Lstat(filepath.Join(t.dirimage, f.name))
+			if err != nil {
+				test.Errorf("%s: %v", f.name, err)
+				continue
+			}
+			if f.mode&os.ModeSymlink == 0 && fi.Mode() != f.mode {
+				test.Errorf("%s %s: mode %v != %v", ownership, f.name, fi.Mode(), f.mode)
+			}
+			if !fi.ModTime().Equal(mtime) {
+				test.Errorf("%s %s: modification time %v != %v", ownership, f.name, fi.ModTime(), mtime)
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			uid, gid := os.Geteuid(), os.Getegid()
+			if ownership == OwnershipFaithful && os.Geteuid() == 0 {
+				uid, gid = f.uid, f.gid
+			}
+			if ownership == OwnershipFaithful && os.Geteuid() != 0 && f.uid != 0 {
+				// Not mapped in the user namespace
+				if !strings.Contains(squashed, f.name) {
+					test.Errorf("%s %s must be reported as squashed", ownership, f.name)
+				}
+			} else if int(st.Uid) != uid || int(st.Gid) != gid {
+				test.Errorf("%s %s: owner %d:%d != %d:%d", ownership, f.name, st.Uid, st.Gid, uid, gid)
+			}
+		}
+		value := make([]byte, 16)
+		if n, err := syscall.Getxattr(filepath.Join(t.dirimage, "bin/ping"), "user.test", value); err == nil {
+			if string(value[:n]) != "value" {
+				test.Errorf("%s bin/ping: user.test %q != value", ownership, value[:n])
+			}
+		} else if !strings.Contains(unrestored, "bin/ping") {
+			test.Errorf("%s bin/ping without extended attributes must be reported: %v", ownership, err)
+		}
+		if _, err = syscall.Getxattr(filepath.Join(t.dirimage, "bin/ping"), "trusted.overlay.opaque", value); err == nil {
+			test.Errorf("%s bin/ping: overlay extended attribute restored", ownership)
+		}
+		t.Close()
+	}
+
+	var xattrs = []struct {
+		attr              string
+		restored          bool
+		restoredIfTrusted bool
+	}{
+		{"user.test", true, true},
+		{"security.capability", true, true},
+		{"security.selinux", false, true},
+		{"trusted.test", false, true},
+		{"trusted.overlay.opaque", false, false},
+	}
+	for _, tc := range xattrs {
+		for _, trusted := range []bool{false, true} {
+			t := &Task{Options: Options{TrustedXattrs: trusted}}
+			if restored := t.restorableXattr(tc.attr); restored != (tc.restored || trusted && tc.restoredIfTrusted) {
+				test.Errorf("%s restored %v with trusted %v", tc.attr, restored, trusted)
+			}
+		}
+	}
+}
+
+func TestParallelExtract(test *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		test.Fatalf("Getwd: %v", err)
+	}
+	const n = 8
+	tasks := make([]*Task, n)
+	for i := range tasks {
+		body := fmt.Sprintf("image %d", i)
+		path := writeTempFile(test, createTarGzBytes(test, []testEntry{
+			{Name: "usr/", Type: tar.TypeDir},
+			{Name: "usr/lib/", Type: tar.TypeDir},
+			{Name: "usr/lib/os-release", Body: body},
+			{Name: "etc/os-release", Type: tar.TypeSymlink, Link: "../usr/lib/os-release"},
+			{Name: "etc/motd", Type: tar.TypeLink, Link: "usr/lib/os-release"},
+		}))
+		defer os.Remove(path)
+		opts := Options{ExtractWorkers: i%4 + 1}
+		if tasks[i], err = CreateTaskWithOptions("file://"+path, opts, "cmd"); err != nil {
+			test.Fatalf("Cannot create task: %v", err)
+		}
+		defer tasks[i].Close()
+	}
+
+	errs := make(chan error, n)
+	for _, t := range tasks {
+		go func(t *Task) {
+			errs <- t.Prepare()
+		}(t)
+	}
+	for range tasks {
+		if err := <-errs; err != nil {
+			test.Errorf("Prepare: %v", err)
+		}
+	}
+	for i, t := range tasks {
+		if report := t.ExtractReport(); report.Files != 1 || report.Bytes != int64(len("image 0")) {
+			test.Errorf("Image %d: %d files with %d bytes extracted", i, report.Files, report.Bytes)
+		}
+		for _, name := range []string{"usr/lib/os-release", "etc/os-release", "etc/motd"} {
+			data, err := ioutil.ReadFile(filepath.Join(t.dirimage, name))
+			if body := fmt.Sprintf("image %d", i); string(data) != body {
+				test.Errorf("Image %d: %s %q != %q (%v)", i, name, data, body, err)
+			}
+		}
+	}
+	if cwd, err := os.Getwd(); err != nil || cwd != wd {
+		test.Errorf("Working directory changed to %s (%v)", cwd, err)
+	}
+}
+
+func BenchmarkExtract(b *testing.B) {
+	// Many small files and a few large ones, about 128 MiB
+	f, err := ioutil.TempFile("", TaskFilePrefix)
+	if err != nil {
+		b.Fatalf("Impossible to create a temp file %v", err)
+	}
+	defer os.Remove(f.Name())
+	tw := tar.NewWriter(f)
+	var size int64
+	body := make([]byte, 16<<20)
+	for i := range body {
+		body[i] = byte(i * 7)
+	}
+	for i := 0; i < 1028; i++ {
 		hdr := &tar.Header{
-			Name:     file.Name,
-			Mode:     0600,
-			Size:     int64(len(file.Body)),
-			Typeflag: byte('0'),
+			Name:     fmt.Sprintf("usr/share/%d/%d", i/64, i),
+			Mode:     0644,
+			Size:     64 << 10,
+			Typeflag: tar.TypeReg,
+		}
+		if i%257 == 0 {
+			hdr.Size = int64(len(body))
 		}
 		if err = tw.WriteHeader(hdr); err != nil {
-			test.Fatalf("Impossible to write TAR header: %v", err)
+			b.Fatalf("Impossible to write TAR header: %v", err)
 		}
-		if _, err = tw.Write([]byte(file.Body)); err != nil {
-			test.Fatalf("Impossible to write file %q to TAR: %v", file.Name, err)
+		if _, err = tw.Write(body[:hdr.Size]); err != nil {
+			b.Fatalf("Impossible to write file to TAR: %v", err)
 		}
-	}
-	// Make sure to check the error on Close
-	if err = gw.Close(); err != nil {
-		test.Fatalf("Error closing GZ file: %v", err)
+		size += hdr.Size
 	}
 	if err = tw.Close(); err != nil {
-		test.Fatalf("Error closing TAR GZ file: %v", err)
+		b.Fatalf("Error closing TAR file: %v", err)
+	}
+	f.Close()
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			t := &Task{Options: Options{ExtractWorkers: workers}}
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				dir, err := ioutil.TempDir("", TaskFilePrefix)
+				if err != nil {
+					b.Fatalf("TempDir: %v", err)
+				}
+				src, err := os.Open(f.Name())
+				if err != nil {
+					b.Fatalf("Open: %v", err)
+				}
+				err = t.extractArchive(dir, src, false)
+				src.Close()
+				os.RemoveAll(dir)
+				if err != nil {
+					b.Fatalf("Extract: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func FuzzExtractArchive(f *testing.F) {
+	for _, tc := range hostileArchives {
+		f.Add(createTarBytes(f, tc.entries))
+	}
+	f.Fuzz(func(test *testing.T, archive []byte) {
+		// Only the confinement matters, not the extraction errors
+		extractConfined(test, archive)
+	})
+}
+
+// Helper to extract an archive in a root directory next to an outside
+// one, failing if anything outside the root is changed
+func extractConfined(test *testing.T, archive []byte) error {
+	dir, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	root, outside := filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err = os.Mkdir(d, 0755); err != nil {
+			test.Fatalf("Mkdir: %v", err)
+		}
+	}
+	// Canaries next to the root and in a sibling directory
+	canaries := []string{filepath.Join(outside, "canary"), filepath.Join(dir, "canary")}
+	for _, canary := range canaries {
+		if err = ioutil.WriteFile(canary, []byte("canary"), 0644); err != nil {
+			test.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	t := new(Task)
+	err = t.extractArchive(root, bytes.NewReader(archive), false)
+
+	if entries, rerr := ioutil.ReadDir(dir); rerr != nil || len(entries) != 3 {
+		test.Errorf("Extraction outside the root: %d entries in %s (%v)", len(entries), dir, rerr)
+	}
+	if entries, rerr := ioutil.ReadDir(outside); rerr != nil || len(entries) != 1 {
+		test.Errorf("Extraction outside the root: %d entries in %s (%v)", len(entries), outside, rerr)
+	}
+	for _, canary := range canaries {
+		if data, rerr := ioutil.ReadFile(canary); string(data) != "canary" {
+			test.Errorf("Extraction outside the root: %s %q (%v)", canary, data, rerr)
+		}
+	}
+	return err
+}
+
+func TestDockerArchive(test *testing.T) {
+	base := createTarGzBytes(test, []testEntry{{Name: "etc/motd", Body: "base"}})
+	v1 := createTarGzBytes(test, []testEntry{{Name: "version", Body: "1"}})
+	v2 := createTarGzBytes(test, []testEntry{{Name: "version", Body: "2"}})
+	manifest := `[
+		{"Config": "c1.json", "RepoTags": ["foo:v1"], "Layers": ["base/layer.tar", "v1/layer.tar"]},
+		{"Config": "c2.json", "RepoTags": ["example.com/foo:v2"], "Layers": ["base/layer.tar", "v2/layer.tar"]}
+	]`
+	archive := createTarGzBytes(test, []testEntry{
+		{Name: "manifest.json", Body: manifest},
+		{Name: "c1.json", Body: "{}"},
+		{Name: "c2.json", Body: "{}"},
+		{Name: "base/layer.tar", Body: string(base)},
+		{Name: "v1/layer.tar", Body: string(v1)},
+		{Name: "v2/layer.tar", Body: string(v2)},
+	})
+	path := writeTempFile(test, archive)
+	defer os.Remove(path)
+
+	if format, err := ImageFormat(path); err != nil || format != DockerArchiveFormat {
+		test.Fatalf("Format %s != %s: %v", format, DockerArchiveFormat, err)
+	}
+
+	var tests = []struct {
+		fragment, version string
+	}{
+		{"", ""},
+		{"#tag=foo:v1", "1"},
+		{"#tag=foo:v2", "2"},
+		{"#tag=example.com/foo:v2", "2"},
+		{"#tag=foo", ""},
+	}
+	for _, tc := range tests {
+		testLayeredImage(test, "file://"+path+tc.fragment, map[string]string{
+			"etc/motd":      "base",
+			"version":       tc.version,
+			"manifest.json": "",
+		}, tc.version == "")
+	}
+}
+
+func TestImageStoreEscape(test *testing.T) {
+	dir, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, manifest := range []string{
+		`[{"Config": "c.json", "Layers": ["../../etc/shadow"]}]`,
+		`[{"Config": "c.json", "Layers": ["l/../../layer.tar"]}]`,
+		`[{"Config": "/etc/shadow", "Layers": ["l/layer.tar"]}]`,
+	} {
+		if err = ioutil.WriteFile(filepath.Join(dir, dockerManifestFile), []byte(manifest), 0644); err != nil {
+			test.Fatalf("WriteFile: %v", err)
+		}
+		if _, _, err = resolveLocalImage(dir, nil, DockerArchiveFormat, ""); err == nil {
+			test.Errorf("Manifest %s must be rejected", manifest)
+		}
+	}
+}
+
+func TestStreamImage(test *testing.T) {
+	rootfs := createTarGzBytes(test, []testEntry{{Name: "etc/motd", Body: "streamed"}})
+	archive := createTarGzBytes(test, []testEntry{
+		{Name: "manifest.json", Body: `[{"Config": "c.json", "Layers": ["l/layer.tar"]}]`},
+		{Name: "c.json", Body: "{}"},
+		{Name: "l/layer.tar", Body: string(rootfs)},
+	})
+	// Root filesystem with files named like the ones of image archives
+	lookalike := createTarGzBytes(test, []testEntry{
+		{Name: "manifest.json", Body: `{"name": "app"}`},
+		{Name: "index.json", Body: "{}"},
+		{Name: "repositories", Body: "{}"},
+		{Name: "l/layer.tar", Body: "layer"},
+		{Name: "etc/motd", Body: "streamed"},
+	})
+	downloads := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads[r.URL.Path]++
+		switch r.URL.Path {
+		case "/rootfs.tar.gz":
+			w.Write(rootfs)
+		case "/archive.tar.gz":
+			w.Write(archive)
+		case "/lookalike.tar.gz":
+			w.Write(lookalike)
+		case "/garbage":
+			w.Write(bytes.Repeat([]byte("garbage"), 100))
+		case "/empty":
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	var tests = []struct {
+		path   string
+		image  []byte
+		stored bool
+	}{
+		// Root filesystems are extracted without storing them
+		{"/rootfs.tar.gz", rootfs, false},
+		// Image archives are stored to read their layers
+		{"/archive.tar.gz", archive, true},
+		{"/lookalike.tar.gz", lookalike, false},
+	}
+	for _, tc := range tests {
+		downloads[tc.path] = 0
+		t, err := CreateTask(ts.URL+tc.path, "cmd")
+		if err != nil {
+			test.Fatalf("Cannot create task: %v", err)
+		}
+		if err = t.Prepare(); err != nil {
+			test.Errorf("Prepare %s: %v", tc.path, err)
+		} else if stored := t.ImagePath() != ""; stored != tc.stored {
+			test.Errorf("Image %s stored %v != %v", tc.path, stored, tc.stored)
+		} else if data, err := ioutil.ReadFile(filepath.Join(t.dirimage, "etc/motd")); string(data) != "streamed" {
+			test.Errorf("Image %s: etc/motd %q (%v)", tc.path, data, err)
+		}
+		if downloads[tc.path] != 1 {
+			test.Errorf("Image %s downloaded %d times", tc.path, downloads[tc.path])
+		}
+		t.Close()
+	}
+	t, err := CreateTask(ts.URL+"/lookalike.tar.gz", "cmd")
+	if err != nil {
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	if err = t.Prepare(); err != nil {
+		test.Errorf("Prepare: %v", err)
+	} else if data, err := ioutil.ReadFile(filepath.Join(t.dirimage, "manifest.json")); string(data) != `{"name": "app"}` {
+		test.Errorf("Root filesystem manifest.json %q (%v)", data, err)
+	}
+	t.Close()
+
+	// With a cache, images are stored while they are extracted
+	dir, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := OpenCache(dir)
+	if err != nil {
+		test.Fatalf("OpenCache: %v", err)
+	}
+	for _, tc := range tests {
+		downloads[tc.path] = 0
+		t, err := CreateTask(ts.URL+tc.path, "cmd")
+		if err != nil {
+			test.Fatalf("Cannot create task: %v", err)
+		}
+		t.Cache = cache
+		if err = t.Prepare(); err != nil {
+			test.Errorf("Prepare %s: %v", tc.path, err)
+		} else if !cache.Has(testDigest(tc.image)) {
+			test.Errorf("Image %s not stored in the cache", tc.path)
+		} else if data, err := ioutil.ReadFile(filepath.Join(t.dirimage, "etc/motd")); string(data) != "streamed" {
+			test.Errorf("Image %s: etc/motd %q (%v)", tc.path, data, err)
+		}
+		if downloads[tc.path] != 1 {
+			test.Errorf("Image %s downloaded %d times", tc.path, downloads[tc.path])
+		}
+		t.Close()
+	}
+
+	for _, path := range []string{"/missing.tar.gz", "/garbage", "/empty"} {
+		t, err := CreateTask(ts.URL+path, "cmd")
+		if err != nil {
+			test.Fatalf("Cannot create task: %v", err)
+		}
+		if err = t.Prepare(); err == nil {
+			test.Errorf("Invalid image %s must fail", path)
+		}
+		t.Close()
+	}
+}
+
+func TestDecompressors(test *testing.T) {
+	gz := createTarGzBytes(test, []testEntry{{Name: "etc/motd", Body: "compressed"}})
+	gr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		test.Fatalf("gzip: %v", err)
+	}
+	archive, err := ioutil.ReadAll(gr)
+	if err != nil {
+		test.Fatalf("gzip: %v", err)
+	}
+
+	// Custom format registered by library users
+	magic := []byte("CWTEST")
+	RegisterDecompressor("test", magic, func(r io.Reader) (io.ReadCloser, error) {
+		if _, err := io.ReadFull(r, make([]byte, len(magic))); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(r), nil
+	})
+	images := map[string][]byte{
+		"gzip": gz,
+		"test": append(append([]byte(nil), magic...), archive...),
+	}
+	for _, cmd := range []string{"bzip2", "xz", "zstd"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			test.Logf("Skipping %s: %v", cmd, err)
+			continue
+		}
+		c := exec.Command(cmd, "-c")
+		c.Stdin = bytes.NewReader(archive)
+		if images[cmd], err = c.Output(); err != nil {
+			test.Fatalf("%s: %v", cmd, err)
+		}
+	}
+
+	for name, image := range images {
+		path := writeTempFile(test, image)
+		if compressed, err := ValidImage(path); err != nil || !compressed {
+			test.Errorf("%s image: compressed %v (%v)", name, compressed, err)
+		}
+		testLayeredImage(test, "file://"+path, map[string]string{"etc/motd": "compressed"}, false)
+		os.Remove(path)
+
+		if name == "test" {
+			// Truncated plain tar archives may end on a block
+			continue
+		}
+		// Truncated streams must fail
+		path = writeTempFile(test, image[:len(image)/2])
+		testLayeredImage(test, "file://"+path, nil, true)
+		os.Remove(path)
+	}
+
+	// Closing a command must not wait for a stalled source
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	r, err := CommandDecompressor("cat")(pr)
+	if err != nil {
+		test.Fatalf("Decompress with cat: %v", err)
+	}
+	closed := make(chan error, 1)
+	go func() {
+		closed <- r.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		test.Errorf("Close blocked by a stalled source")
+	}
+}
+
+func TestRootDir(test *testing.T) {
+	root, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err = ioutil.WriteFile(filepath.Join(root, "motd"), []byte("lower"), 0644); err != nil {
+		test.Fatalf("WriteFile: %v", err)
+	}
+	// Only directories looking like a root filesystem are used
+	if _, err = ImageFormat(root); err == nil {
+		test.Errorf("Unknown directory %s must fail", root)
+	}
+	if err = os.Mkdir(filepath.Join(root, "etc"), 0755); err != nil {
+		test.Fatalf("Mkdir: %v", err)
+	}
+	if format, err := ImageFormat(root); err != nil || format != RootDirFormat {
+		test.Errorf("Root directory format %v (%v)", format, err)
+	}
+
+	for _, scratch := range []bool{false, true} {
+		t, err := CreateTaskWithOptions(root, Options{Scratch: scratch}, "cat", "motd")
+		if err != nil {
+			test.Fatalf("Cannot create task: %v", err)
+		}
+		var out bytes.Buffer
+		t.Command.Stdout = &out
+		if err = t.Start("", nil); err != nil {
+			test.Fatalf("Start with scratch %v: %v", scratch, err)
+		}
+		if err = t.Command.Wait(); err != nil || out.String() != "lower" {
+			test.Errorf("Output with scratch %v: %q (%v)", scratch, out.String(), err)
+		}
+		if t.ImagePath() != "" || t.Status() != Finished {
+			test.Errorf("Root directory must not be retrieved: %s %s", t.ImagePath(), t.Status())
+		}
+		if (t.dirimage == root) == scratch {
+			test.Errorf("Root directory with scratch %v used as %s", scratch, t.dirimage)
+		}
+		// Changes in the scratch layer are discarded
+		if err = ioutil.WriteFile(filepath.Join(t.dirimage, "motd"), []byte("upper"), 0644); err != nil {
+			test.Errorf("WriteFile: %v", err)
+		}
+		dirimage := t.dirimage
+		t.Close()
+		data, err := ioutil.ReadFile(filepath.Join(root, "motd"))
+		if err != nil {
+			test.Fatalf("Root directory removed with scratch %v: %v", scratch, err)
+		}
+		if scratch {
+			if string(data) != "lower" {
+				test.Errorf("Root directory changed through the scratch layer: %q", data)
+			}
+			if _, err = os.Stat(dirimage); err == nil {
+				test.Errorf("Scratch layer %s not removed", dirimage)
+			}
+		} else if err = ioutil.WriteFile(filepath.Join(root, "motd"), []byte("lower"), 0644); err != nil {
+			test.Fatalf("WriteFile: %v", err)
+		}
+	}
+}
+
+func TestOCILayout(test *testing.T) {
+	layer := createTarGzBytes(test, []testEntry{{Name: "etc/motd", Body: "oci"}})
+	config := []byte("{}")
+	manifest, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        Descriptor{Digest: testDigest(config), Size: int64(len(config))},
+		Layers:        []Descriptor{{Digest: testDigest(layer), Size: int64(len(layer))}},
+	})
+	if err != nil {
+		test.Fatalf("JSON marshalling: %v", err)
+	}
+	index, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		Manifests: []Descriptor{{
+			MediaType:   MediaTypeOCIManifest,
+			Digest:      testDigest(manifest),
+			Annotations: map[string]string{RefNameAnnotation: "v1"},
+		}},
+	})
+	if err != nil {
+		test.Fatalf("JSON marshalling: %v", err)
+	}
+	entries := []testEntry{
+		{Name: "oci-layout", Body: `{"imageLayoutVersion": "1.0.0"}`},
+		{Name: "index.json", Body: string(index)},
+	}
+	for _, b := range [][]byte{layer, config, manifest} {
+		entries = append(entries, testEntry{
+			Name: "blobs/sha256/" + strings.TrimPrefix(testDigest(b), "sha256:"),
+			Body: string(b),
+		})
+	}
+	expected := map[string]string{"etc/motd": "oci", "index.json": "", "oci-layout": ""}
+
+	// Archived layout
+	path := writeTempFile(test, createTarGzBytes(test, entries))
+	defer os.Remove(path)
+	testLayeredImage(test, "file://"+path, expected, false)
+	testLayeredImage(test, "file://"+path+"#tag=v1", expected, false)
+	testLayeredImage(test, "file://"+path+"#tag=v2", expected, true)
+
+	// Layout directory
+	dir, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name)
+		if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			test.Fatalf("MkdirAll: %v", err)
+		}
+		if err = ioutil.WriteFile(name, []byte(e.Body), 0644); err != nil {
+			test.Fatalf("WriteFile: %v", err)
+		}
+	}
+	testLayeredImage(test, "file://"+dir, expected, false)
+
+	// Blobs are verified against their digest and nested indexes are limited
+	nested := func(mediaType, digest string) []byte {
+		data, err := json.Marshal(Manifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeOCIIndex,
+			Manifests:     []Descriptor{{MediaType: mediaType, Digest: digest}},
+		})
+		if err != nil {
+			test.Fatalf("JSON marshalling: %v", err)
+		}
+		return data
+	}
+	self := testDigest([]byte("self"))
+	index1 := nested(MediaTypeOCIManifest, testDigest(manifest))
+	index2 := nested(MediaTypeOCIIndex, testDigest(index1))
+	index3 := nested(MediaTypeOCIIndex, testDigest(index2))
+	blobEntry := func(digest string, data []byte) testEntry {
+		return testEntry{Name: "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:"), Body: string(data)}
+	}
+	for _, c := range []struct {
+		top      string
+		blobs    []testEntry
+		expected map[string]string
+	}{
+		{testDigest(manifest), []testEntry{blobEntry(testDigest(layer), []byte("tampered"))}, nil},
+		{testDigest(manifest), []testEntry{blobEntry(testDigest(manifest), config)}, nil},
+		{self, []testEntry{blobEntry(self, nested(MediaTypeOCIIndex, self))}, nil},
+		{testDigest(index2), []testEntry{blobEntry(testDigest(index1), index1), blobEntry(testDigest(index2), index2)}, expected},
+		{testDigest(index3), []testEntry{
+			blobEntry(testDigest(index1), index1), blobEntry(testDigest(index2), index2), blobEntry(testDigest(index3), index3),
+		}, nil},
+	} {
+		top, err := json.Marshal(Manifest{
+			SchemaVersion: 2,
+			Manifests:     []Descriptor{{MediaType: MediaTypeOCIIndex, Digest: c.top}},
+		})
+		if err != nil {
+			test.Fatalf("JSON marshalling: %v", err)
+		}
+		layout := append([]testEntry{}, entries...)
+		layout[1].Body = string(top)
+		layout = append(layout, c.blobs...)
+		path := writeTempFile(test, createTarGzBytes(test, layout))
+		defer os.Remove(path)
+		testLayeredImage(test, "file://"+path, c.expected, c.expected == nil)
+	}
+}
+
+func TestImageConfig(test *testing.T) {
+	config := `{"config": {
+		"Env": ["A=1", "B=2"],
+		"Entrypoint": ["sh", "-c"],
+		"Cmd": ["echo $A $B $(pwd)"],
+		"WorkingDir": "/tmp"
+	}}`
+	layer := createTarGzBytes(test, []testEntry{{Name: "etc/passwd", Body: "root:x:0:0::/root:/bin/sh\nfoo:x:1000:100::/home/foo:/bin/sh\n"}})
+	archive := createTarGzBytes(test, []testEntry{
+		{Name: "manifest.json", Body: `[{"Config": "config.json", "Layers": ["layer.tar"]}]`},
+		{Name: "config.json", Body: config},
+		{Name: "layer.tar", Body: string(layer)},
+	})
+	path := writeTempFile(test, archive)
+	defer os.Remove(path)
+
+	var tests = []struct {
+		args []string
+		out  string
+	}{
+		{[]string{""}, "1 3 /tmp\n"},
+		{[]string{"echo $A"}, "1\n"},
+	}
+	for _, tc := range tests {
+		t, err := CreateTask("file://"+path, tc.args[0], tc.args[1:]...)
+		if err != nil {
+			test.Fatalf("Cannot create task: %v", err)
+		}
+		defer t.Close()
+		var out bytes.Buffer
+		t.Command.Stdout = &out
+		if err = t.Start("", []string{"B=3"}); err != nil {
+			test.Fatalf("Error starting task: %v", err)
+		}
+		if err = t.Command.Wait(); err != nil {
+			test.Fatalf("Waiting: %v", err)
+		}
+		if out.String() != tc.out {
+			test.Errorf("Out: %q != %q", out.String(), tc.out)
+		}
+		if t.ImageConfig() == nil || t.ImageConfig().WorkingDir != "/tmp" {
+			test.Errorf("Invalid image config: %+v", t.ImageConfig())
+		}
+
+		var users = []struct {
+			user     string
+			uid, gid uint32
+		}{
+			{"foo", 1000, 100},
+			{"foo:0", 1000, 0},
+			{"1000", 1000, 100},
+			{"2000:3", 2000, 3},
+		}
+		for _, u := range users {
+			uid, gid, err := lookupUser(t.dirimage, u.user)
+			if err != nil || uid != u.uid || gid != u.gid {
+				test.Errorf("User %s: %d:%d != %d:%d (%v)", u.user, uid, gid, u.uid, u.gid, err)
+			}
+		}
+		if _, _, err = lookupUser(t.dirimage, "bar"); err == nil {
+			test.Errorf("Unknown user must fail")
+		}
+	}
+}
+
+func TestLookupInRoot(test *testing.T) {
+	root := test.TempDir()
+	for name, content := range map[string]string{
+		"usr/bin/sh":   "#!",
+		"usr/bin/data": "",
+		"srv/passwd":   "jail:x:10:20::/:/bin/sh\n",
+	} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			test.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			test.Fatal(err)
+		}
+	}
+	os.Chmod(filepath.Join(root, "usr/bin/sh"), 0755)
+	for link, target := range map[string]string{
+		"bin":        "/usr/bin",
+		"etc":        "../../../srv",
+		"srv/escape": "/../../etc/passwd",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	env := []string{"PATH=/bin"}
+	if path, err := lookPathIn(root, "sh", env); err != nil || path != "/bin/sh" {
+		test.Errorf("sh through the absolute /bin symlink: %q (%v)", path, err)
+	}
+	if _, err := lookPathIn(root, "data", env); err == nil {
+		test.Errorf("A non-executable file must not be found")
+	}
+	// /etc resolves to /srv in the root, not to the host
+	if uid, gid, err := lookupUser(root, "jail"); err != nil || uid != 10 || gid != 20 {
+		test.Errorf("User inside the root: %d:%d (%v)", uid, gid, err)
+	}
+	if _, _, err := lookupUser(root, "root"); err == nil {
+		test.Errorf("The users of the host must not be found")
+	}
+	dir, err := openDirHandle(root)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer dir.Close()
+	// Through the /etc symlink too
+	if path, err := dir.resolve("srv/escape"); err != nil || path != "srv/passwd" {
+		test.Errorf("Symlink escaping the root resolved to %q (%v)", path, err)
+	}
+}
+
+func TestBlake2b(test *testing.T) {
+	long := make([]byte, 3*256)
+	for i := range long {
+		long[i] = byte(i)
+	}
+	for input, expected := range map[string]string{
+		"":           "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce",
+		"abc":        "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923",
+		string(long): "323e97a7a859ee63c9013debb0ca995811e73117a2f574723416e596ebc184e37a59b66d2f597df4a7c1b0d1d41a1a7f28774f46a6864d56c57b9d6c5f7302fb",
+	} {
+		h := newBlake2b()
+		// Written in pieces crossing the blocks
+		for data := []byte(input); len(data) > 0; data = data[len(data)/2+len(data)%2:] {
+			h.Write(data[:len(data)/2+len(data)%2])
+		}
+		if sum := fmt.Sprintf("%x", h.Sum(nil)); sum != expected {
+			test.Errorf("BLAKE2b-512 of %d bytes: %s != %s", len(input), sum, expected)
+		}
+	}
+}
+
+func TestCache(test *testing.T) {
+	dir, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := OpenCache(dir)
+	if err != nil {
+		test.Fatalf("OpenCache: %v", err)
+	}
+
+	image := createTarGzBytes(test, []testEntry{{Name: "readme.txt", Body: "cached"}})
+	downloads := 0
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			downloads++
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(image)
+		}))
+	defer ts.Close()
+
+	var path string
+	for i := 0; i < 3; i++ {
+		t, err := CreateTask(ts.URL+"/image.tar.gz", "cmd")
+		if err != nil {
+			test.Fatalf("Cannot create task: %v", err)
+		}
+		t.Cache = cache
+		if err = t.Retrieve(); err != nil {
+			test.Fatalf("Error retrieving a task: %v", err)
+		}
+		if path != "" && path != t.ImagePath() {
+			test.Errorf("Image path %s != %s", t.ImagePath(), path)
+		}
+		path = t.ImagePath()
+		t.Close()
+		if _, err = os.Stat(path); err != nil {
+			test.Fatalf("Cached image removed on close: %v", err)
+		}
+	}
+	if downloads != 1 {
+		test.Errorf("Image downloaded %d times", downloads)
+	}
+	if path != filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(testDigest(image), "sha256:")) {
+		test.Errorf("Image not addressed by its digest: %s", path)
+	}
+
+	// Registry layers are shared
+	layer := createTarGzBytes(test, []testEntry{{Name: "etc/motd", Body: "hi"}})
+	reg := newTestRegistry(test, "foo", "v1", [][]byte{layer}, nil)
+	defer reg.Close()
+	for i := 0; i < 2; i++ {
+		t, err := CreateTask("oci://"+strings.TrimPrefix(reg.URL, "http://")+"/foo:v1", "cmd")
+		if err != nil {
+			test.Fatalf("Cannot create task: %v", err)
+		}
+		t.Cache = cache
+		if err = t.Retrieve(); err != nil {
+			test.Fatalf("Error retrieving a task: %v", err)
+		}
+		t.Close()
+	}
+
+	blobs, err := cache.List()
+	if err != nil {
+		test.Fatalf("List: %v", err)
+	}
+	if len(blobs) != 2 {
+		test.Fatalf("Cache must have 2 blobs: %+v", blobs)
+	}
+	for _, b := range blobs {
+		if b.Digest == testDigest(image) && (len(b.URLs) != 1 || b.URLs[0] != ts.URL+"/image.tar.gz") {
+			test.Errorf("Invalid URLs for the image: %v", b.URLs)
+		}
+	}
+	if removed, err := cache.Prune(time.Hour); err != nil || len(removed) != 0 {
+		test.Errorf("Nothing to prune: %v %v", removed, err)
+	}
+	if removed, err := cache.Prune(0); err != nil || len(removed) != 2 {
+		test.Errorf("Everything must be pruned: %v %v", removed, err)
+	}
+	if cache.Entry(ts.URL+"/image.tar.gz") != nil {
+		test.Errorf("Pruned URL still in the cache")
+	}
+}
+
+func TestOverlay(test *testing.T) {
+	dir, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := OpenCache(dir)
+	if err != nil {
+		test.Fatalf("OpenCache: %v", err)
+	}
+	layer := createTarGzBytes(test, []testEntry{{Name: "etc/motd", Body: "shared"}})
+	reg := newTestRegistry(test, "foo", "v1", [][]byte{layer}, nil)
+	defer reg.Close()
+
+	var tasks []*Task
+	for i := 0; i < 2; i++ {
+		t, err := CreateTaskWithOptions("oci://"+strings.TrimPrefix(reg.URL, "http://")+"/foo:v1",
+			Options{Overlay: true}, "cmd")
+		if err != nil {
+			test.Fatalf("Cannot create task: %v", err)
+		}
+		defer t.Close()
+		t.Cache = cache
+		if err = t.Prepare(); err != nil {
+			test.Fatalf("Prepare: %v", err)
+		}
+		tasks = append(tasks, t)
+	}
+	roots, err := filepath.Glob(filepath.Join(dir, "rootfs", "sha256", "*"))
+	if err != nil || len(roots) != 1 {
+		test.Fatalf("Image must be extracted once in the cache: %v %v", roots, err)
+	}
+	for _, t := range tasks {
+		if t.overlay == nil || t.overlay.lower != roots[0] {
+			test.Fatalf("Task must be an overlay of %s: %+v", roots[0], t.overlay)
+		}
+	}
+	if tasks[0].dirimage == tasks[1].dirimage {
+		test.Fatalf("Tasks share their root %s", tasks[0].dirimage)
+	}
+	if os.Geteuid() != 0 && !tasks[0].overlay.copied {
+		test.Skip("Unprivileged overlays are only mounted in the task namespace")
+	}
+	// Changes are private to each task
+	motd := filepath.Join(tasks[0].dirimage, "etc", "motd")
+	if err = ioutil.WriteFile(motd, []byte("changed"), 0644); err != nil {
+		test.Fatalf("WriteFile: %v", err)
+	}
+	for i, path := range []string{
+		filepath.Join(tasks[1].dirimage, "etc", "motd"),
+		filepath.Join(roots[0], "etc", "motd"),
+	} {
+		if data, err := ioutil.ReadFile(path); string(data) != "shared" {
+			test.Errorf("Change visible in %d: %q (%v)", i, data, err)
+		}
+	}
+	tasks[0].Close()
+	if _, err = os.Stat(tasks[0].overlay.dir); err == nil {
+		test.Errorf("Overlay of the task not removed")
+	}
+	if _, err = os.Stat(roots[0]); err != nil {
+		test.Errorf("Extracted image removed from the cache: %v", err)
+	}
+	// The image is still used by the other task
+	if _, err = cache.Prune(0); err != nil {
+		test.Fatalf("Prune: %v", err)
+	}
+	if _, err = os.Stat(roots[0]); err != nil {
+		test.Errorf("Extracted image in use pruned: %v", err)
+	}
+	tasks[1].Close()
+	if _, err = cache.Prune(0); err != nil {
+		test.Fatalf("Prune: %v", err)
+	}
+	if _, err = os.Stat(roots[0]); err == nil {
+		test.Errorf("Extracted image not pruned")
+	}
+}
+
+func TestCopyTree(test *testing.T) {
+	src, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer removeAll(dst)
+	if err = os.MkdirAll(filepath.Join(src, "usr", "bin"), 0755); err != nil {
+		test.Fatalf("MkdirAll: %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(src, "usr", "bin", "cmd"), []byte("cmd"), 0555); err != nil {
+		test.Fatalf("WriteFile: %v", err)
+	}
+	if err = os.Symlink("usr/bin", filepath.Join(src, "bin")); err != nil {
+		test.Fatalf("Symlink: %v", err)
+	}
+	// Read-only directories are filled before their mode is set
+	for _, dir := range []string{"usr/bin", "usr"} {
+		if err = os.Chmod(filepath.Join(src, dir), 0555); err != nil {
+			test.Fatalf("Chmod: %v", err)
+		}
+		defer os.Chmod(filepath.Join(src, dir), 0755)
+	}
+	if err = copyTree(src, dst); err != nil {
+		test.Fatalf("copyTree: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dst, "bin", "cmd")); string(data) != "cmd" {
+		test.Errorf("Copied cmd: %q (%v)", data, err)
+	}
+	for _, dir := range []string{"usr/bin", "usr"} {
+		if fi, err := os.Stat(filepath.Join(dst, dir)); err != nil {
+			test.Errorf("Copied %s: %v", dir, err)
+		} else if fi.Mode().Perm() != 0555 {
+			test.Errorf("Copied %s mode %v", dir, fi.Mode())
+		}
+	}
+}
+
+func TestDigest(test *testing.T) {
+	image := createTarGzBytes(test, []testEntry{{Name: "readme.txt", Body: "digest"}})
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(image)
+		}))
+	defer ts.Close()
+	sha256sum := testDigest(image)
+	sha512sum := fmt.Sprintf("sha512:%x", sha512.Sum512(image))
+	wrong := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("wrong")))
+
+	dir, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := OpenCache(dir)
+	if err != nil {
+		test.Fatalf("OpenCache: %v", err)
+	}
+
+	var tests = []struct {
+		rawurl, digest string
+		mismatch       bool
+	}{
+		{ts.URL + "#sha256=" + strings.TrimPrefix(sha256sum, "sha256:"), "", false},
+		{ts.URL + "#tag=foo&sha512=" + strings.TrimPrefix(sha512sum, "sha512:"), "", false},
+		{ts.URL, sha256sum, false},
+		{ts.URL, wrong, true},
+		{ts.URL + "#sha256=" + strings.TrimPrefix(wrong, "sha256:"), "", true},
+	}
+	for _, tc := range tests {
+		for _, c := range []*Cache{nil, cache} {
+			t, err := CreateTaskWithOptions(tc.rawurl, Options{Digest: tc.digest}, "cmd")
+			if err != nil {
+				test.Fatalf("Cannot create task: %v", err)
+			}
+			t.Cache = c
+			err = t.Retrieve()
+			if _, ok := err.(*DigestError); ok != tc.mismatch {
+				test.Errorf("URL %s digest %s: unexpected error %v", tc.rawurl, tc.digest, err)
+			}
+			if tc.mismatch && (t.ImagePath() != "" || t.Status() != NotStarted) {
+				test.Errorf("Image with wrong digest kept %s", t.ImagePath())
+			}
+			t.Close()
+		}
+	}
+
+	// A mismatching image is not stored in the cache
+	if err = os.RemoveAll(dir); err != nil {
+		test.Fatalf("RemoveAll: %v", err)
+	}
+	if cache, err = OpenCache(dir); err != nil {
+		test.Fatalf("OpenCache: %v", err)
+	}
+	t, err := CreateTaskWithOptions(ts.URL, Options{Digest: wrong}, "cmd")
+	if err != nil {
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	t.Cache = cache
+	if err = t.Retrieve(); err == nil {
+		test.Errorf("Wrong digest must fail")
+	}
+	t.Close()
+	for _, sub := range []string{".", filepath.Join("blobs", "sha256")} {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			test.Fatalf("ReadDir: %v", err)
+		}
+		for _, fi := range infos {
+			if !fi.IsDir() {
+				test.Errorf("Image with wrong digest stored in the cache: %s", filepath.Join(sub, fi.Name()))
+			}
+		}
+	}
+
+	// Invalid digests
+	for _, rawurl := range []string{ts.URL + "#sha256=abc", ts.URL + "#sha256=" + strings.Repeat("0", 64) + "&sha512=00"} {
+		if _, err := CreateTask(rawurl, "cmd"); err == nil {
+			test.Errorf("Invalid digest in %s must fail", rawurl)
+		}
+	}
+	if _, err := CreateTaskWithOptions(ts.URL+"#sha256="+strings.TrimPrefix(sha256sum, "sha256:"),
+		Options{Digest: wrong}, "cmd"); err == nil {
+		test.Errorf("Different digests must fail")
+	}
+	if _, err := CreateTaskWithOptions(ts.URL, Options{Digest: "md5:00"}, "cmd"); err == nil {
+		test.Errorf("Unsupported digest must fail")
+	}
+}
+
+func TestSignature(test *testing.T) {
+	dir, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := createTarGzBytes(test, []testEntry{{Name: "readme.txt", Body: "signed"}})
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		test.Fatalf("GenerateKey: %v", err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		test.Fatalf("GenerateKey: %v", err)
+	}
+	trustStore := filepath.Join(dir, "trusted")
+	if err = ioutil.WriteFile(trustStore, []byte("# test key\n"+base64.StdEncoding.EncodeToString(pub)+"\n"), 0644); err != nil {
+		test.Fatalf("WriteFile: %v", err)
+	}
+	keys, err := LoadTrustedKeys(trustStore)
+	if err != nil || len(keys) != 1 {
+		test.Fatalf("LoadTrustedKeys: %v %v", keys, err)
+	}
+	digest := sha512.Sum512(image)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, digest[:]))
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/image.tar.gz":
+				w.Write(image)
+			case "/image.tar.gz.sig":
+				fmt.Fprintln(w, sig)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer ts.Close()
+
+	var tests = []struct {
+		rawurl string
+		policy SignaturePolicy
+		keys   []ed25519.PublicKey
+		valid  bool
+	}{
+		{ts.URL + "/image.tar.gz", SignatureRequire, keys, true},
+		{ts.URL + "/image.tar.gz", SignatureRequire, []ed25519.PublicKey{otherPub}, false},
+		{ts.URL + "/image.tar.gz", SignatureRequire, nil, false},
+		{ts.URL + "/image.tar.gz", SignatureWarn, []ed25519.PublicKey{otherPub}, true},
+		{ts.URL + "/other.tar.gz", SignatureSkip, nil, false},
+		{ts.URL + "/image.tar.gz?unsigned", SignatureSkip, nil, true},
+	}
+	for _, tc := range tests {
+		t, err := CreateTaskWithOptions(tc.rawurl, Options{SignaturePolicy: tc.policy, TrustedKeys: tc.keys}, "cmd")
+		if err != nil {
+			test.Fatalf("Cannot create task: %v", err)
+		}
+		err = t.Retrieve()
+		if tc.valid && err != nil {
+			test.Errorf("URL %s with %s policy: %v", tc.rawurl, tc.policy, err)
+		} else if !tc.valid {
+			if err == nil {
+				test.Errorf("URL %s with %s policy must fail", tc.rawurl, tc.policy)
+			} else if _, ok := err.(*SignatureError); !ok && tc.policy != SignatureSkip {
+				test.Errorf("URL %s with %s policy: unexpected error %v", tc.rawurl, tc.policy, err)
+			}
+			if t.ImagePath() != "" {
+				test.Errorf("Image with invalid signature kept")
+			}
+		}
+		t.Close()
+	}
+
+	// Only image files have signatures
+	for _, rawurl := range []string{"docker://alpine", "file://" + dir} {
+		if _, err := CreateTaskWithOptions(rawurl, Options{SignaturePolicy: SignatureWarn}, "cmd"); err == nil {
+			test.Errorf("Signatures of %s must be rejected", rawurl)
+		}
+	}
+	t, err := CreateTask("file://"+dir, "cmd")
+	if err != nil {
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	t.Options.SignaturePolicy = SignatureRequire
+	if err = t.Retrieve(); err == nil {
+		test.Errorf("Signatures of image directories must be rejected")
+	}
+	t.Close()
+
+	// minisign signatures of the BLAKE2b-512 hash
+	imagePath := filepath.Join(dir, "image.tar.gz")
+	if err = ioutil.WriteFile(imagePath, image, 0644); err != nil {
+		test.Fatalf("WriteFile: %v", err)
+	}
+	keyID := []byte("\x01\x02\x03\x04\x05\x06\x07\x08")
+	minisignKey := filepath.Join(dir, "minisign.pub")
+	if err = ioutil.WriteFile(minisignKey, []byte("untrusted comment: minisign public key 0807060504030201\n"+
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), pub...))+"\n"), 0644); err != nil {
+		test.Fatalf("WriteFile: %v", err)
+	}
+	if keys, err = LoadTrustedKeys(minisignKey); err != nil || len(keys) != 1 || !keys[0].Equal(pub) {
+		test.Fatalf("LoadTrustedKeys: %v %v", keys, err)
+	}
+	h := newBlake2b()
+	h.Write(image)
+	signature := ed25519.Sign(priv, h.Sum(nil))
+	for _, tc := range []struct {
+		algo, comment string
+		valid         bool
+	}{
+		{"ED", "timestamp:1", true},
+		{"Ed", "timestamp:1", false},
+		// Changed trusted comment
+		{"ED", "timestamp:2", false},
+	} {
+		minisig := "untrusted comment: signature from minisign secret key\n" +
+			base64.StdEncoding.EncodeToString(append(append([]byte(tc.algo), keyID...), signature...)) + "\n" +
+			"trusted comment: " + tc.comment + "\n" +
+			base64.StdEncoding.EncodeToString(ed25519.Sign(priv, append(signature[:len(signature):len(signature)], "timestamp:1"...))) + "\n"
+		if err = verifySignature(imagePath, []byte(minisig), keys); tc.valid != (err == nil) {
+			test.Errorf("minisign %s signature with comment %s: %v", tc.algo, tc.comment, err)
+		}
+	}
+
+	// Signatures from ssh-keygen -Y sign
+	if _, err = exec.LookPath("ssh-keygen"); err != nil {
+		test.Skip("ssh-keygen not available")
+	}
+	key := filepath.Join(dir, "key")
+	for _, args := range [][]string{
+		{"-q", "-t", "ed25519", "-N", "", "-f", key},
+		{"-q", "-Y", "sign", "-f", key, "-n", SSHSignatureNamespace, imagePath},
+	} {
+		if out, err := exec.Command("ssh-keygen", args...).CombinedOutput(); err != nil {
+			test.Fatalf("ssh-keygen %v: %v %s", args, err, out)
+		}
+	}
+	if keys, err = LoadTrustedKeys(key + ".pub"); err != nil {
+		test.Fatalf("LoadTrustedKeys: %v", err)
+	}
+	for _, trusted := range [][]ed25519.PublicKey{keys, {pub}} {
+		t, err := CreateTaskWithOptions("file://"+imagePath, Options{SignaturePolicy: SignatureRequire, TrustedKeys: trusted}, "cmd")
+		if err != nil {
+			test.Fatalf("Cannot create task: %v", err)
+		}
+		err = t.Retrieve()
+		if trusted[0].Equal(pub) != (err != nil) {
+			test.Errorf("SSH signature with trusted key %v: %v", trusted[0].Equal(keys[0]), err)
+		}
+		t.Close()
+	}
+}
+
+// Helper functions
+
+// Create a temporary tar.gz file
+// It is the caller's responsability to remove the temporary file
+func createTarGz(test *testing.T) *url.URL {
+	src, err := ioutil.TempFile("", "")
+	if err != nil {
+		test.Fatalf("Impossible to create a temp file %v", err)
+	}
+	err = createGZTarContent(src, test)
+
+	if err = src.Close(); err != nil {
+		test.Fatalf("Error closing file: %v", err)
+	}
+
+	fileURL := &url.URL{
+		Scheme: "file",
+		Path:   src.Name(),
+	}
+	return fileURL
+}
+
+// Helper function to use for different backends
+func testRetrieve(test *testing.T, rawurl string, shouldFail bool) {
+	t, err := CreateTask(rawurl, "cmd")
+	if err != nil {
+		test.Fatalf("Impossible to create a task: %v", err)
+	}
+	defer t.Close()
+	err = t.Retrieve()
+	if shouldFail && err == nil {
+		test.Fatalf("It should fail on retrieving the task")
+	}
+	if !shouldFail {
+		if err != nil {
+			test.Fatalf("Error retrieving a task: %v", err)
+		}
+		if t.ImagePath() == "" {
+			test.Fatalf("Not possible to get the image path")
+		}
+		test.Logf("Image path: %q", t.ImagePath())
+	}
+}
+
+// Helper to create a TAR GZ file
+func createGZTarContent(src io.Writer, test *testing.T) (err error) {
+	var files = []struct {
+		Name, Body string
+	}{
+		{"readme.txt", "This archive contains this file."},
+	}
+
+	gw := gzip.NewWriter(src)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		hdr := &tar.Header{
+			Name:     file.Name,
+			Mode:     0600,
+			Size:     int64(len(file.Body)),
+			Typeflag: byte('0'),
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			test.Fatalf("Impossible to write TAR header: %v", err)
+		}
+		if _, err = tw.Write([]byte(file.Body)); err != nil {
+			test.Fatalf("Impossible to write file %q to TAR: %v", file.Name, err)
+		}
+	}
+	// Make sure to check the error on Close
+	if err = tw.Close(); err != nil {
+		test.Fatalf("Error closing TAR GZ file: %v", err)
+	}
+	if err = gw.Close(); err != nil {
+		test.Fatalf("Error closing GZ file: %v", err)
+	}
+	return
+}
+
+// Entry of a tar archive created by the tests
+type testEntry struct {
+	Name, Body, Link   string
+	Type               byte
+	Mode               int64
+	Devmajor, Devminor int64
+	Uid, Gid           int
+	ModTime            time.Time
+	PAXRecords         map[string]string
+}
+
+// Helper to create a TAR GZ archive in memory from its entries
+func createTarGzBytes(test testing.TB, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(createTarBytes(test, entries)); err != nil {
+		test.Fatalf("Impossible to write GZ file: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		test.Fatalf("Error closing GZ file: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Helper to create an uncompressed TAR archive in memory
+func createTarBytes(test testing.TB, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:       e.Name,
+			Mode:       e.Mode,
+			Size:       int64(len(e.Body)),
+			Typeflag:   e.Type,
+			Linkname:   e.Link,
+			Devmajor:   e.Devmajor,
+			Devminor:   e.Devminor,
+			Uid:        e.Uid,
+			Gid:        e.Gid,
+			ModTime:    e.ModTime,
+			PAXRecords: e.PAXRecords,
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0755
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			test.Fatalf("Impossible to write TAR header: %v", err)
+		}
+		if _, err := tw.Write([]byte(e.Body)); err != nil && hdr.Size > 0 {
+			test.Fatalf("Impossible to write file %q to TAR: %v", e.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		test.Fatalf("Error closing TAR file: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Digest of a blob in the OCI form
+func testDigest(blob []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+}
+
+// Registry stand-in serving a single image under the given repository
+// and tag through an index, with token authentication
+func newTestRegistry(test *testing.T, repo, tag string, layers [][]byte, config []byte) *httptest.Server {
+	if config == nil {
+		config = []byte("{}")
+	}
+	blobs := map[string][]byte{testDigest(config): config}
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        Descriptor{Digest: testDigest(config), Size: int64(len(config))},
+	}
+	for _, layer := range layers {
+		blobs[testDigest(layer)] = layer
+		manifest.Layers = append(manifest.Layers,
+			Descriptor{Digest: testDigest(layer), Size: int64(len(layer))})
+	}
+	manifestBlob, err := json.Marshal(manifest)
+	if err != nil {
+		test.Fatalf("JSON marshalling: %v", err)
+	}
+	index, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests: []Descriptor{
+			{Digest: "sha256:0000", Platform: &Platform{OS: "plan9", Architecture: "mips"}},
+			{Digest: testDigest(manifestBlob), Platform: &Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}},
+		},
+	})
+	if err != nil {
+		test.Fatalf("JSON marshalling: %v", err)
+	}
+	manifests := map[string][]byte{tag: index, testDigest(manifestBlob): manifestBlob}
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				fmt.Fprintln(w, `{"token": "secret"}`)
+				return
+			}
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.Header().Set("WWW-Authenticate",
+					fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:%s:pull"`, ts.URL, repo))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			prefix := "/v2/" + repo + "/"
+			if !strings.HasPrefix(r.URL.Path, prefix) {
+				http.NotFound(w, r)
+				return
+			}
+			parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, prefix), "/", 2)
+			if len(parts) != 2 {
+				http.NotFound(w, r)
+				return
+			}
+			var content []byte
+			switch parts[0] {
+			case "manifests":
+				content = manifests[parts[1]]
+			case "blobs":
+				content = blobs[parts[1]]
+			}
+			if content == nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(content)
+		}))
+	return ts
+}
+
+// Helper to write content in a temporary file returning its name
+func writeTempFile(test *testing.T, content []byte) string {
+	f, err := ioutil.TempFile("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("Impossible to create a temp file %v", err)
+	}
+	defer f.Close()
+	if _, err = f.Write(content); err != nil {
+		test.Fatalf("Write: %v", err)
+	}
+	return f.Name()
+}
+
+// Helper to retrieve and extract an image checking the content of its
+// files, an empty content means the file must not exist
+func testLayeredImage(test *testing.T, rawurl string, files map[string]string, shouldFail bool) {
+	t, err := CreateTask(rawurl, "cmd")
+	if err != nil {
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	defer t.Close()
+	err = t.Retrieve()
+	if err == nil {
+		err = t.extractImage()
+	}
+	if shouldFail {
+		if err == nil {
+			test.Errorf("Image %s must fail", rawurl)
+		}
+		return
+	}
+	if err != nil {
+		test.Errorf("Image %s: %v", rawurl, err)
+		return
+	}
+	for name, content := range files {
+		data, err := ioutil.ReadFile(filepath.Join(t.dirimage, name))
+		if content == "" {
+			if err == nil {
+				test.Errorf("Image %s: %s must not exist", rawurl, name)
+			}
+		} else if string(data) != content {
+			test.Errorf("Image %s: %s %q != %q (%v)", rawurl, name, data, content, err)
+		}
+	}
+}
+
+func TestParseSystemMounts(test *testing.T) {
+	for _, tc := range []struct {
+		list   string
+		mounts SystemMounts
+		valid  bool
+	}{
+		{"proc,dev,sys,tmp", AllSystemMounts, true},
+		{"tmp,proc", MountProc | MountTmp, true},
+		{"", 0, true},
+		{"proc,home", 0, false},
+	} {
+		mounts, err := ParseSystemMounts(tc.list)
+		if (err == nil) != tc.valid || mounts != tc.mounts {
+			test.Errorf("Mounts %q: %v %v", tc.list, mounts, err)
+			continue
+		}
+		if tc.valid {
+			if again, _ := ParseSystemMounts(mounts.String()); again != mounts {
+				test.Errorf("Mounts %q: %q is parsed as %v", tc.list, mounts, again)
+			}
+		}
+	}
+}
+
+func TestMountTarget(test *testing.T) {
+	root, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	if err = os.Symlink(outside, filepath.Join(root, "tmp")); err != nil {
+		test.Fatal(err)
+	}
+	if err = os.Symlink("/dev", filepath.Join(root, "devices")); err != nil {
+		test.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		target string
+		dir    bool
+		safe   bool
+	}{
+		{"/proc", true, true},
+		{"/../../dev/null", false, true},
+		{"/proc", false, false},
+		{"/dev/null", true, false},
+		{"/tmp", true, false},
+		{"/tmp/x", true, false},
+		{"/devices/null", false, false},
+		{"/", true, false},
+	} {
+		f, err := mountTarget(root, tc.target, tc.dir)
+		if !tc.safe {
+			if _, ok := err.(*UnsafePathError); !ok {
+				test.Errorf("Target %s: %v is not an *UnsafePathError", tc.target, err)
+			}
+			continue
+		}
+		if err != nil {
+			test.Errorf("Target %s: %v", tc.target, err)
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(root, tc.target))
+		if err != nil || fi.IsDir() != tc.dir {
+			test.Errorf("Target %s not created inside the root: %v", tc.target, err)
+		}
+		f.Close()
+	}
+	if names, _ := ioutil.ReadDir(outside); len(names) > 0 {
+		test.Errorf("Targets created outside the root: %v", names)
+	}
+}
+
+func TestParseVolume(test *testing.T) {
+	wd, _ := os.Getwd()
+	for _, tc := range []struct {
+		spec   string
+		volume Volume
+		valid  bool
+	}{
+		{"/data:/mnt/data", Volume{"/data", "/mnt/data", false}, true},
+		{"/data:/data:ro", Volume{"/data", "/data", true}, true},
+		{"/data:/data:rw", Volume{"/data", "/data", false}, true},
+		{"data:/data", Volume{filepath.Join(wd, "data"), "/data", false}, true},
+		{"/data", Volume{}, false},
+		{"/data:/data:rx", Volume{}, false},
+		{"/data:data", Volume{}, false},
+		{"/data:/", Volume{}, false},
+		{"/data:/../etc", Volume{}, false},
+		{"/data:/mnt/../../etc", Volume{}, false},
+		{"/data:/a:b:ro", Volume{}, false},
+	} {
+		v, err := ParseVolume(tc.spec)
+		if !tc.valid {
+			if err == nil {
+				test.Errorf("Volume %q must be invalid", tc.spec)
+			}
+			continue
+		}
+		if err != nil || v != tc.volume {
+			test.Errorf("Volume %q: %+v != %+v (%v)", tc.spec, v, tc.volume, err)
+		}
+	}
+}
+
+func TestMountVolumes(test *testing.T) {
+	if os.Geteuid() != 0 {
+		test.Skip("Volumes are only mounted in the host with privileges")
+	}
+	dirs := make([]string, 2)
+	for i := range dirs {
+		dir, err := ioutil.TempDir("", TaskFilePrefix)
+		if err != nil {
+			test.Fatalf("TempDir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		dirs[i] = dir
+	}
+	root, host := dirs[0], dirs[1]
+	if err := ioutil.WriteFile(filepath.Join(host, "input"), []byte("data"), 0644); err != nil {
+		test.Fatal(err)
+	}
+	// Submounts of read-only volumes are read-only too
+	sub := filepath.Join(host, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		test.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", sub, "tmpfs", 0, ""); err != nil {
+		test.Fatalf("Mount tmpfs: %v", err)
+	}
+	defer syscall.Unmount(sub, syscall.MNT_DETACH)
+	// The root is not a resolved path
+	link := root + ".link"
+	if err := os.Symlink(root, link); err != nil {
+		test.Fatal(err)
+	}
+	defer os.Remove(link)
+
+	mounted, err := mountVolumes(link, []Volume{
+		{HostPath: host, Path: "/data/ro", ReadOnly: true},
+		{HostPath: host, Path: "/data"},
+		{HostPath: filepath.Join(host, "input"), Path: "/etc/input"},
+	})
+	defer unmountVolumes(mounted)
+	if err != nil {
+		test.Fatalf("Mount volumes: %v", err)
+	}
+	for _, name := range []string{"data/input", "data/ro/input", "etc/input"} {
+		if data, err := ioutil.ReadFile(filepath.Join(root, name)); string(data) != "data" {
+			test.Errorf("%s %q != data (%v)", name, data, err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(root, "data", "output"), nil, 0644); err != nil {
+		test.Errorf("Writable volume: %v", err)
+	}
+	for _, name := range []string{"data/ro/output", "data/ro/sub/output"} {
+		if err = ioutil.WriteFile(filepath.Join(root, name), nil, 0644); err == nil {
+			test.Errorf("Read-only volume must not be writable: %s", name)
+		}
+	}
+
+	if !unmountVolumes(mounted) {
+		test.Fatal("Volumes still mounted")
+	}
+	if err = removeAll(root); err != nil {
+		test.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(host, "output")); err != nil {
+		test.Errorf("Output in the volume: %v", err)
+	}
+}
+
+func TestReadOnlyRoot(test *testing.T) {
+	if _, err := CreateTaskWithOptions("image.tar", Options{Tmpfs: []string{"/run/../.."}}, "cmd"); err == nil {
+		test.Error("Tmpfs outside the root must be rejected")
+	}
+	if os.Geteuid() != 0 {
+		test.Skip("Read-only roots are only mounted in the host with privileges")
+	}
+	root, err := ioutil.TempDir("", TaskFilePrefix)
+	if err != nil {
+		test.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	t := &Task{dirimage: root, Options: Options{ReadOnly: true, Tmpfs: []string{"/run", "/var/cache"}}}
+	err = t.mountInHost(nil)
+	defer unmountVolumes(t.mounts)
+	if err != nil {
+		test.Fatalf("Mount: %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(root, "file"), nil, 0644); err == nil {
+		test.Error("Read-only root must not be writable")
+	}
+	for _, path := range t.Options.Tmpfs {
+		if err = ioutil.WriteFile(filepath.Join(root, path, "file"), nil, 0644); err != nil {
+			test.Errorf("Tmpfs %s: %v", path, err)
+		}
+	}
+	if !unmountVolumes(t.mounts) {
+		test.Fatal("Still mounted")
+	}
+	if err = ioutil.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		test.Errorf("Root after unmounting: %v", err)
+	}
+}
+
+func TestNetworkNone(test *testing.T) {
+	if _, err := ParseNetworkMode("bridge"); err == nil {
+		test.Error("Unknown network modes must be rejected")
+	}
+	if os.Geteuid() != 0 {
+		test.Skip("Unchrooted tasks only get a network namespace with privileges")
+	}
+	fileURL := createTarGz(test)
+	defer os.Remove(fileURL.Path)
+	t, err := CreateTaskWithOptions(fileURL.String(), Options{Network: NetworkNone}, "cat", "/proc/net/dev")
+	if err != nil {
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	defer t.Close()
+
+	var out bytes.Buffer
+	t.Command.Stdout = &out
+	if err = t.Start("", nil); err != nil {
+		test.Fatalf("Error starting task: %v", err)
+	}
+	if err = t.Command.Wait(); err != nil {
+		test.Fatalf("Waiting: %v", err)
+	}
+	// Two header lines and the loopback
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(strings.TrimSpace(lines[2]), "lo:") {
+		test.Errorf("Only the loopback must be available:\n%s", out.String())
+	}
+}
+
+func TestParsePortForward(test *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		forward PortForward
+		valid   bool
+	}{
+		{"8080:80", PortForward{"127.0.0.1:8080", 80}, true},
+		{"0.0.0.0:8080:80", PortForward{"0.0.0.0:8080", 80}, true},
+		{"[::1]:8080:80", PortForward{"[::1]:8080", 80}, true},
+		{":0:80", PortForward{":0", 80}, true},
+		{"80", PortForward{}, false},
+		{"8080:http", PortForward{}, false},
+		{"8080:70000", PortForward{}, false},
+		{"localhost:80", PortForward{}, false},
+	} {
+		f, err := ParsePortForward(tc.spec)
+		if !tc.valid {
+			if err == nil {
+				test.Errorf("Port forward %q must be invalid", tc.spec)
+			}
+			continue
+		}
+		if err != nil || f != tc.forward {
+			test.Errorf("Port forward %q: %+v != %+v (%v)", tc.spec, f, tc.forward, err)
+		}
+	}
+	if _, err := CreateTaskWithOptions("file:///image.tar", Options{
+		PortForwards: []PortForward{{"127.0.0.1:0", 80}},
+	}, "true"); err == nil {
+		test.Error("Port forwards must require slirp networking")
+	}
+}
+
+func TestSlirpNetwork(test *testing.T) {
+	if os.Geteuid() != 0 {
+		test.Skip("Unchrooted tasks only get a network namespace with privileges")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		test.Skipf("TAP devices not available: %v", err)
+	}
+	for _, cmd := range []string{"curl", "python3"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			test.Skipf("Skipping: %v", err)
+		}
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "from host")
+	}))
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	fileURL := createTarGz(test)
+	defer os.Remove(fileURL.Path)
+	// The host loopback is reachable through the gateway
+	t, err := CreateTaskWithOptions(fileURL.String(), Options{Network: NetworkSlirp},
+		"curl", "-s", "-m", "5", "http://10.0.2.2:"+port+"/")
+	if err != nil {
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	var out bytes.Buffer
+	t.Command.Stdout = &out
+	if err = t.Start("", nil); err != nil {
+		t.Close()
+		test.Fatalf("Error starting task: %v", err)
+	}
+	err = t.Command.Wait()
+	t.Close()
+	if err != nil || out.String() != "from host" {
+		test.Errorf("Host not reached: %v: %q", err, out.String())
+	}
+
+	// A server of the task is reachable through the forwarded port
+	server := `import http.server as s
+class H(s.BaseHTTPRequestHandler):
+    def do_GET(self):
+        self.send_response(200); self.end_headers(); self.wfile.write(b"from task")
+s.HTTPServer(("", 8000), H).handle_request()`
+	t, err = CreateTaskWithOptions(fileURL.String(), Options{
+		Network:      NetworkSlirp,
+		PortForwards: []PortForward{{"127.0.0.1:0", 8000}},
+	}, "python3", "-c", server)
+	if err != nil {
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	defer t.Close()
+	if err = t.Start("", nil); err != nil {
+		test.Fatalf("Error starting task: %v", err)
+	}
+	addrs := t.ForwardedAddrs()
+	if len(addrs) != 1 {
+		test.Fatalf("Forwarded addresses: %v", addrs)
+	}
+	var body []byte
+	for i := 0; i < 50; i++ {
+		var resp *http.Response
+		if resp, err = http.Get("http://" + addrs[0].String() + "/"); err == nil {
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil || string(body) != "from task" {
+		test.Errorf("Task not reached: %v: %q", err, body)
+	}
+	if err = t.Command.Wait(); err != nil {
+		test.Errorf("Waiting: %v", err)
+	}
+}
+
+func TestHostname(test *testing.T) {
+	for _, name := range []string{"", "-jail", "jail-", "ja_il", "jail..local", strings.Repeat("a", 65)} {
+		if _, err := CreateTaskWithOptions("image.tar", Options{Hostname: name}, "cmd"); name != "" && err == nil {
+			test.Errorf("Hostname %q must be invalid", name)
+		}
+	}
+	dir, volumes, err := writeEtcFiles("jail", NetworkSlirp, []Volume{{HostPath: "/srv/etc", Path: "/etc/hostname"}})
+	if err != nil {
+		test.Fatalf("Cannot write the /etc files: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if len(volumes) != 1 || volumes[0].Path != "/etc/hosts" {
+		test.Fatalf("Only /etc/hosts must be generated: %v", volumes)
+	}
+	hosts, err := ioutil.ReadFile(volumes[0].HostPath)
+	if err != nil || !strings.Contains(string(hosts), "10.0.2.15\tjail\n") {
+		test.Errorf("Wrong /etc/hosts %q: %v", hosts, err)
+	}
+
+	if os.Geteuid() != 0 {
+		test.Skip("Unchrooted tasks only get a UTS namespace with privileges")
+	}
+	host, _ := os.Hostname()
+	fileURL := createTarGz(test)
+	defer os.Remove(fileURL.Path)
+	t, err := CreateTaskWithOptions(fileURL.String(), Options{Hostname: "jail"},
+		"sh", "-c", "hostname; hostname changed")
+	if err != nil {
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	defer t.Close()
+
+	var out bytes.Buffer
+	t.Command.Stdout = &out
+	if err = t.Start("", nil); err != nil {
+		test.Fatalf("Error starting task: %v", err)
+	}
+	if err = t.Command.Wait(); err != nil {
+		test.Fatalf("Waiting: %v", err)
+	}
+	if out.String() != "jail\n" {
+		test.Errorf("Hostname of the task %q != jail", out.String())
+	}
+	if now, _ := os.Hostname(); now != host {
+		test.Errorf("Hostname of the host changed to %s", now)
+	}
+}
+
+func TestParseMemory(test *testing.T) {
+	for _, tc := range []struct {
+		size  string
+		bytes int64
+		valid bool
+	}{
+		{"1024", 1024, true},
+		{"64k", 64 << 10, true},
+		{"512M", 512 << 20, true},
+		{"2g", 2 << 30, true},
+		{"", 0, false},
+		{"g", 0, false},
+		{"1.5g", 0, false},
+		{"-1m", 0, false},
+		{"10t", 0, false},
+	} {
+		n, err := ParseMemory(tc.size)
+		if !tc.valid {
+			if err == nil {
+				test.Errorf("Memory size %q must be invalid", tc.size)
+			}
+			continue
+		}
+		if err != nil || n != tc.bytes {
+			test.Errorf("Memory size %q: %d != %d (%v)", tc.size, n, tc.bytes, err)
+		}
+	}
+}
+
+func TestCgroupLimits(test *testing.T) {
+	if _, err := CreateTaskWithOptions("image.tar", Options{Resources: Resources{Pids: -1}}, "cmd"); err == nil {
+		test.Error("Negative limits must be rejected")
+	}
+	for _, cpus := range []float64{math.NaN(), math.Inf(1)} {
+		if _, err := CreateTaskWithOptions("image.tar", Options{Resources: Resources{CPUs: cpus}}, "cmd"); err == nil {
+			test.Errorf("%v CPUs must be rejected", cpus)
+		}
+	}
+	if os.Geteuid() != 0 {
+		test.Skip("Cgroups are only delegated to root")
+	}
+	s, err := EnterSupervisorCgroup()
+	if err != nil {
+		test.Skipf("Supervisor cgroup: %v", err)
+	}
+	defer s.Leave()
+	if _, err := parentCgroup([]string{"memory", "cpu", "pids"}); err != nil {
+		test.Skipf("Cgroup controllers not available: %v", err)
+	}
+	fileURL := createTarGz(test)
+	defer os.Remove(fileURL.Path)
+	t, err := CreateTaskWithOptions(fileURL.String(), Options{
+		Resources: Resources{Memory: 64 << 20, CPUs: 0.5, Pids: 8},
+	}, "cat", "/proc/self/cgroup")
+	if err != nil {
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	var out bytes.Buffer
+	t.Command.Stdout = &out
+	if err = t.Start("", nil); err != nil {
+		t.Close()
+		test.Fatalf("Error starting task: %v", err)
+	}
+	if err = t.Command.Wait(); err != nil {
+		test.Errorf("Waiting: %v", err)
+	}
+	path := t.cgroup.path
+	if !strings.HasSuffix(strings.TrimSpace(out.String()), "/"+filepath.Base(path)) {
+		test.Errorf("Task not cloned into %s: %s", path, out.String())
+	}
+	for file, limit := range map[string]string{
+		"memory.max": "67108864",
+		"cpu.max":    "50000 100000",
+		"pids.max":   "8",
+	} {
+		if data, err := ioutil.ReadFile(filepath.Join(path, file)); err != nil || strings.TrimSpace(string(data)) != limit {
+			test.Errorf("Limit %s %q != %q: %v", file, data, limit, err)
+		}
+	}
+	t.Close()
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		test.Errorf("Cgroup %s not removed: %v", path, err)
+	}
+}
+
+func TestSupervisorCgroup(test *testing.T) {
+	if os.Geteuid() != 0 {
+		test.Skip("Cgroups are only delegated to root")
+	}
+	root, err := cgroup2Root()
+	if err != nil {
+		test.Skipf("No cgroup v2: %v", err)
+	}
+	own, err := ownCgroup()
+	if err != nil {
+		test.Fatalf("ownCgroup: %v", err)
+	}
+	// The test process moves to a cgroup of its own with a controller
+	// to delegate, it is restored at the end
+	ownDir := filepath.Join(root, own)
+	available, err := ioutil.ReadFile(filepath.Join(ownDir, "cgroup.controllers"))
+	controllers := strings.Fields(string(available))
+	if err != nil || len(controllers) == 0 {
+		test.Skipf("No cgroup controller available: %v", err)
+	}
+	enabled, err := ioutil.ReadFile(filepath.Join(ownDir, "cgroup.subtree_control"))
+	if err != nil {
+		test.Fatalf("ReadFile: %v", err)
+	}
+	if !strings.Contains(" "+strings.TrimSpace(string(enabled))+" ", " "+controllers[0]+" ") {
+		subtree := filepath.Join(ownDir, "cgroup.subtree_control")
+		if err = ioutil.WriteFile(subtree, []byte("+"+controllers[0]), 0644); err != nil {
+			test.Skipf("Cannot enable %s: %v", controllers[0], err)
+		}
+		defer ioutil.WriteFile(subtree, []byte("-"+controllers[0]), 0644)
+	}
+	dir, err := ioutil.TempDir(ownDir, "chroot-wrapper-")
+	if err != nil {
+		test.Skipf("Cgroup not writable: %v", err)
+	}
+	defer syscall.Rmdir(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte("0"), 0644); err != nil {
+		test.Skipf("Cannot move to %s: %v", dir, err)
+	}
+	defer ioutil.WriteFile(filepath.Join(ownDir, "cgroup.procs"), []byte("0"), 0644)
+	cgroupParent.path = ""
+	defer func() {
+		cgroupParent.path = ""
+	}()
+
+	if _, err = parentCgroup(controllers[:1]); err == nil {
+		test.Errorf("A cgroup with processes cannot delegate %s", controllers[0])
+	}
+	s, err := EnterSupervisorCgroup()
+	if err != nil {
+		test.Fatalf("EnterSupervisorCgroup: %v", err)
+	}
+	leaf := s.path
+	if parent, err := parentCgroup(controllers[:1]); err != nil || parent != dir {
+		test.Errorf("parentCgroup %s != %s: %v", parent, dir, err)
+	}
+	if err = s.Leave(); err != nil {
+		test.Fatalf("Leave: %v", err)
+	}
+	if cgroup, err := ownCgroup(); err != nil || filepath.Join(root, cgroup) != dir {
+		test.Errorf("Not moved back to %s: %s (%v)", dir, cgroup, err)
+	}
+	if _, err = os.Stat(leaf); !os.IsNotExist(err) {
+		test.Errorf("Supervisor cgroup %s not removed: %v", leaf, err)
+	}
+}
+
+func TestStats(test *testing.T) {
+	fileURL := createTarGz(test)
+	defer os.Remove(fileURL.Path)
+	t, err := CreateTask(fileURL.String(), "sh", "-c", "sleep 1 & i=0; while [ $i -lt 20000 ]; do i=$((i+1)); done; wait")
+	if err != nil {
+		test.Fatalf("Cannot create task: %v", err)
+	}
+	defer t.Close()
+	if _, err = t.Stats(); err == nil {
+		test.Error("A non-started task must not have statistics")
+	}
+	if err = t.Start("", nil); err != nil {
+		test.Fatalf("Error starting task: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	stats, err := t.Stats()
+	if err != nil {
+		test.Fatalf("Statistics of the running task: %v", err)
+	}
+	if stats.Source != "proc" || stats.Processes != 2 || stats.PeakRSS == 0 {
+		test.Errorf("Wrong statistics of the running task: %+v", stats)
+	}
+	if err = t.Command.Wait(); err != nil {
+		test.Fatalf("Waiting: %v", err)
+	}
+	if stats, err = t.Stats(); err != nil {
+		test.Fatalf("Statistics of the finished task: %v", err)
+	}
+	if stats.Source != "rusage" || stats.Processes != 0 || stats.PeakRSS == 0 || stats.CPUTime == 0 {
+		test.Errorf("Wrong statistics of the finished task: %+v", stats)
+	}
+}
+
+func TestSeccompProfile(test *testing.T) {
+	if seccompAuditArch == 0 {
+		test.Skipf("Seccomp not supported on %s", runtime.GOARCH)
+	}
+	for _, p := range []SeccompProfile{
+		{DefaultAction: "SCMP_ACT_NOTIFY"},
+		{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []SeccompSyscall{{Names: []string{"read"}, Action: "SCMP_ACT_DENY"}}},
+		{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []SeccompSyscall{{Names: []string{"read"}, Action: "SCMP_ACT_ERRNO",
+			Args: []SeccompArg{{Index: 6, Op: "SCMP_CMP_EQ"}}}}},
+		{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []SeccompSyscall{{Names: []string{"read"}, Action: "SCMP_ACT_ERRNO",
+			Args: []SeccompArg{{Index: 0, Op: "SCMP_CMP_LIKE"}}}}},
+	} {
+		if _, err := CreateTaskWithOptions("image.tar", Options{Seccomp: &p}, "cmd"); err == nil {
+			test.Errorf("Profile %+v must be invalid", p)
+		}
+	}
+
+	path := filepath.Join(test.TempDir(), "seccomp.json")
+	profile := `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [
+		{"names": ["getpriority"], "action": "SCMP_ACT_ERRNO", "errnoRet": 33,
+		 "args": [{"index": 1, "value": 5, "op": "SCMP_CMP_GE"}]},
+		{"names": ["not_a_syscall", "getppid"], "action": "SCMP_ACT_ERRNO",
+		 "excludes": {"arches": ["amd64", "arm64"]}},
+		{"name": "getpgid", "action": "SCMP_ACT_ERRNO", "includes": {"caps": ["CAP_SYS_ADMIN"]}}]}`
+	if err := ioutil.WriteFile(path, []byte(profile), 0644); err != nil {
+		test.Fatal(err)
+	}
+	p, err := LoadSeccompProfile(path)
+	if err != nil {
+		test.Fatalf("Cannot load the profile: %v", err)
+	}
+	// The other rules do not apply
+	filter, _ := p.compile()
+	first := SeccompProfile{DefaultAction: p.DefaultAction, Syscalls: p.Syscalls[:1]}
+	if expected, _ := first.compile(); len(filter) != len(expected) {
+		test.Errorf("Wrong filter of %d instructions, expected %d", len(filter), len(expected))
+	}
+
+	// who is a 64-bit argument for the filter
+	const hi = 1 << 32
+	for _, c := range []struct {
+		op      string
+		value   uint64
+		match   []uint64
+		noMatch []uint64
+	}{
+		{"SCMP_CMP_EQ", 5, []uint64{5}, []uint64{4, 6, hi | 5}},
+		{"SCMP_CMP_NE", 5, []uint64{4, hi | 5}, []uint64{5}},
+		{"SCMP_CMP_GT", 5, []uint64{6, hi}, []uint64{4, 5}},
+		{"SCMP_CMP_GE", 5, []uint64{5, hi | 1}, []uint64{4}},
+		{"SCMP_CMP_LT", hi | 5, []uint64{4, hi | 4}, []uint64{hi | 5, 2 * hi}},
+		{"SCMP_CMP_LE", hi | 5, []uint64{hi | 5, 6}, []uint64{hi | 6, 2 * hi}},
+		{"SCMP_CMP_MASKED_EQ", hi | 0xf0, []uint64{0x35, hi - 1 - 0xc0}, []uint64{0x45, hi | 0x30}},
+	} {
+		p := SeccompProfile{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []SeccompSyscall{{
+			Names: []string{"getpriority"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: new(uint),
+			Args: []SeccompArg{{Index: 1, Value: c.value, ValueTwo: 0x30, Op: c.op}},
+		}}}
+		*p.Syscalls[0].ErrnoRet = uint(syscall.EDOM)
+		filter, err := p.compile()
+		if err != nil {
+			test.Fatalf("Cannot compile the %s rule: %v", c.op, err)
+		}
+		for match, values := range map[bool][]uint64{true: c.match, false: c.noMatch} {
+			for _, who := range values {
+				_, _, errno := filteredSyscall(test, filter, syscall.SYS_GETPRIORITY, syscall.PRIO_PROCESS, uintptr(who))
+				if (errno == syscall.EDOM) != match {
+					test.Errorf("%s %#x must match %#x: %v, got %v", c.op, c.value, who, match, errno)
+				}
+			}
+		}
+	}
+
+	if filter, err = DefaultSeccompProfile().compile(); err != nil {
+		test.Fatalf("Cannot compile the default profile: %v", err)
+	}
+	if _, _, errno := filteredSyscall(test, filter, syscall.SYS_UNSHARE, syscall.CLONE_NEWUSER, 0); errno != syscall.EPERM {
+		test.Errorf("unshare must fail with EPERM: %v", errno)
+	}
+	if _, _, errno := filteredSyscall(test, filter, syscall.SYS_GETPID, 0, 0); errno != 0 {
+		test.Errorf("getpid must be allowed: %v", errno)
+	}
+}
+
+// filteredSyscall calls a syscall in a thread with the seccomp filter.
+// The thread exits afterwards.
+func filteredSyscall(test *testing.T, filter []syscall.SockFilter, trap, a1, a2 uintptr) (r1, r2 uintptr, errno syscall.Errno) {
+	done := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		if err := installSeccomp(filter); err != nil {
+			done <- err
+			return
+		}
+		r1, r2, errno = syscall.RawSyscall(trap, a1, a2, 0)
+		done <- nil
+	}()
+	if err := <-done; err != nil {
+		test.Fatal(err)
 	}
 	return
 }
@@ -0,0 +1,873 @@
+package task
+
+// User-mode networking relaying the traffic of the TAP device of a task
+// like slirp. The task sees the 10.0.2.0/24 network where it is
+// 10.0.2.15, the gateway 10.0.2.2 is the loopback of the host and
+// 10.0.2.3 is the DNS server of the host. A minimal TCP/IP stack ends
+// the TCP connections and the UDP datagrams of the task and relays them
+// through sockets of this process, so nothing requires privileges. Port
+// forwards are TCP connections opened to the task.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	protoICMP     = 1
+	protoTCP      = 6
+	protoUDP      = 17
+	ethHeaderLen  = 14
+	ipHeaderLen   = 20
+	tcpHeaderLen  = 20
+	udpHeaderLen  = 8
+	usernetMTU    = 1500
+	usernetMSS    = usernetMTU - ipHeaderLen - tcpHeaderLen
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	// tcpWindow bounds the data of the task not written to the host
+	// yet and the data to the task not acknowledged yet
+	tcpWindow = 65535
+	// tcpRTO is the first retransmission timeout, doubled on each
+	// retry
+	tcpRTO     = time.Second
+	tcpRetries = 6
+	// Timeout to dial the host
+	tcpDialTimeout = 10 * time.Second
+	// UDP flows idle for udpTimeout are closed
+	udpTimeout = time.Minute
+	// First port used for the connections to the task
+	forwardFirstPort = 49152
+)
+
+// flowKey identifies a TCP connection or a UDP flow of the task
+type flowKey struct {
+	port       uint16
+	remote     [4]byte
+	remotePort uint16
+}
+
+// usernet is the user-mode network of a task
+type usernet struct {
+	tap       *os.File
+	listeners []net.Listener
+	forwards  []PortForward
+	// DNS server of the host for 10.0.2.3
+	dns  string
+	ipID uint32
+	done chan struct{}
+
+	mu       sync.Mutex
+	closed   bool
+	tcp      map[flowKey]*tcpConn
+	udp      map[flowKey]*udpFlow
+	nextPort uint16
+
+	writeMu sync.Mutex
+}
+
+// newUsernet listens to the host addresses of the port forwards
+func newUsernet(forwards []PortForward) (*usernet, error) {
+	u := &usernet{
+		forwards: forwards,
+		dns:      hostDNS(),
+		done:     make(chan struct{}),
+		tcp:      make(map[flowKey]*tcpConn),
+		udp:      make(map[flowKey]*udpFlow),
+		nextPort: forwardFirstPort,
+	}
+	for _, f := range forwards {
+		l, err := net.Listen("tcp", f.HostAddr)
+		if err != nil {
+			u.Close()
+			return nil, err
+		}
+		u.listeners = append(u.listeners, l)
+	}
+	return u, nil
+}
+
+// run relays the traffic of the TAP device until it is closed
+func (u *usernet) run(tap *os.File) {
+	u.tap = tap
+	go u.readFrames()
+	go u.timers()
+	for i, l := range u.listeners {
+		go u.acceptForwards(l, u.forwards[i].Port)
+	}
+}
+
+// Addrs returns the host addresses of the port forwards
+func (u *usernet) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(u.listeners))
+	for i, l := range u.listeners {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
+
+// Close stops relaying and closes every connection
+func (u *usernet) Close() error {
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return nil
+	}
+	u.closed = true
+	close(u.done)
+	for _, c := range u.tcp {
+		u.closeTCP(c)
+	}
+	for key, f := range u.udp {
+		f.conn.Close()
+		delete(u.udp, key)
+	}
+	u.mu.Unlock()
+	for _, l := range u.listeners {
+		l.Close()
+	}
+	if u.tap != nil {
+		return u.tap.Close()
+	}
+	return nil
+}
+
+// hostDNS returns the first IPv4 DNS server of the host
+func hostDNS() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 1 && fields[0] == "nameserver" {
+				if ip := net.ParseIP(fields[1]); ip != nil && ip.To4() != nil {
+					return net.JoinHostPort(fields[1], "53")
+				}
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// hostAddr returns the host address of a remote address of the task
+func (u *usernet) hostAddr(ip [4]byte, port uint16) string {
+	switch ip {
+	case usernetGatewayIP:
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	case usernetDNSIP:
+		host, _, _ := net.SplitHostPort(u.dns)
+		return net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	return net.JoinHostPort(net.IP(ip[:]).String(), strconv.Itoa(int(port)))
+}
+
+func (u *usernet) readFrames() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := u.tap.Read(buf)
+		if err != nil {
+			// The namespace of the task is gone or it is closed
+			u.Close()
+			return
+		}
+		u.handleFrame(buf[:n])
+	}
+}
+
+func (u *usernet) handleFrame(frame []byte) {
+	if len(frame) < ethHeaderLen {
+		return
+	}
+	switch binary.BigEndian.Uint16(frame[12:]) {
+	case etherTypeARP:
+		u.handleARP(frame[ethHeaderLen:])
+	case etherTypeIPv4:
+		u.handleIPv4(frame[ethHeaderLen:])
+	}
+}
+
+// handleARP replies to the requests of the addresses of the network
+func (u *usernet) handleARP(p []byte) {
+	if len(p) < 28 || binary.BigEndian.Uint16(p[6:]) != 1 {
+		return
+	}
+	var target [4]byte
+	copy(target[:], p[24:28])
+	if target[0] != usernetGuestIP[0] || target[1] != usernetGuestIP[1] ||
+		target[2] != usernetGuestIP[2] || target == usernetGuestIP {
+		return
+	}
+	frame := make([]byte, ethHeaderLen+28)
+	copy(frame, p[8:14])
+	copy(frame[6:], usernetMAC[:])
+	binary.BigEndian.PutUint16(frame[12:], etherTypeARP)
+	reply := frame[ethHeaderLen:]
+	copy(reply, p[:6])
+	binary.BigEndian.PutUint16(reply[6:], 2)
+	copy(reply[8:], usernetMAC[:])
+	copy(reply[14:], target[:])
+	copy(reply[18:], p[8:18])
+	u.writeFrame(frame)
+}
+
+func (u *usernet) handleIPv4(p []byte) {
+	if len(p) < ipHeaderLen || p[0]>>4 != 4 {
+		return
+	}
+	ihl := int(p[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(p[2:]))
+	if ihl < ipHeaderLen || total < ihl || total > len(p) {
+		return
+	}
+	// Fragments are not reassembled
+	if binary.BigEndian.Uint16(p[6:])&0x3fff != 0 {
+		return
+	}
+	var src, dst [4]byte
+	copy(src[:], p[12:16])
+	copy(dst[:], p[16:20])
+	if src != usernetGuestIP {
+		return
+	}
+	payload := p[ihl:total]
+	switch p[9] {
+	case protoTCP:
+		u.handleTCP(dst, payload)
+	case protoUDP:
+		u.handleUDP(dst, payload)
+	case protoICMP:
+		u.handleICMP(dst, payload)
+	}
+}
+
+// handleICMP replies to the echo requests to the gateway and the DNS
+func (u *usernet) handleICMP(dst [4]byte, p []byte) {
+	if len(p) < 8 || p[0] != 8 || (dst != usernetGatewayIP && dst != usernetDNSIP) {
+		return
+	}
+	reply := append([]byte(nil), p...)
+	reply[0] = 0
+	reply[2], reply[3] = 0, 0
+	binary.BigEndian.PutUint16(reply[2:], checksum(0, reply))
+	u.sendIPv4(dst, protoICMP, reply)
+}
+
+// sendIPv4 sends a packet from src to the task
+func (u *usernet) sendIPv4(src [4]byte, proto byte, payload []byte) {
+	frame := make([]byte, ethHeaderLen+ipHeaderLen+len(payload))
+	copy(frame, usernetGuestMAC[:])
+	copy(frame[6:], usernetMAC[:])
+	binary.BigEndian.PutUint16(frame[12:], etherTypeIPv4)
+	ip := frame[ethHeaderLen:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(ipHeaderLen+len(payload)))
+	binary.BigEndian.PutUint16(ip[4:], uint16(atomic.AddUint32(&u.ipID, 1)))
+	// Don't fragment
+	ip[6] = 0x40
+	ip[8] = 64
+	ip[9] = proto
+	copy(ip[12:], src[:])
+	copy(ip[16:], usernetGuestIP[:])
+	binary.BigEndian.PutUint16(ip[10:], checksum(0, ip[:ipHeaderLen]))
+	copy(ip[ipHeaderLen:], payload)
+	u.writeFrame(frame)
+}
+
+func (u *usernet) writeFrame(frame []byte) {
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+	// Frames are lost like in any network when the device is gone
+	u.tap.Write(frame)
+}
+
+// checksum returns the internet checksum of b added to sum
+func checksum(sum uint32, b []byte) uint16 {
+	for ; len(b) > 1; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// transportChecksum returns the checksum of a TCP or UDP segment from
+// src to the task with its pseudo header
+func transportChecksum(src [4]byte, proto byte, segment []byte) uint16 {
+	var pseudo [12]byte
+	copy(pseudo[:], src[:])
+	copy(pseudo[4:], usernetGuestIP[:])
+	pseudo[9] = proto
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(segment)))
+	var sum uint32
+	for i := 0; i < len(pseudo); i += 2 {
+		sum += uint32(pseudo[i])<<8 | uint32(pseudo[i+1])
+	}
+	return checksum(sum, segment)
+}
+
+// udpFlow relays the datagrams of the task to a remote address
+type udpFlow struct {
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+func (u *usernet) handleUDP(dst [4]byte, p []byte) {
+	if len(p) < udpHeaderLen {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(p[4:]))
+	if length < udpHeaderLen || length > len(p) {
+		return
+	}
+	key := flowKey{
+		port:       binary.BigEndian.Uint16(p),
+		remote:     dst,
+		remotePort: binary.BigEndian.Uint16(p[2:]),
+	}
+	u.mu.Lock()
+	f := u.udp[key]
+	if f == nil {
+		if u.closed {
+			u.mu.Unlock()
+			return
+		}
+		conn, err := net.Dial("udp", u.hostAddr(dst, key.remotePort))
+		if err != nil {
+			u.mu.Unlock()
+			return
+		}
+		f = &udpFlow{conn: conn}
+		u.udp[key] = f
+		go u.readDatagrams(key, f)
+	}
+	f.lastUsed = time.Now()
+	u.mu.Unlock()
+	f.conn.Write(p[udpHeaderLen:length])
+}
+
+// readDatagrams relays the replies of a UDP flow to the task
+func (u *usernet) readDatagrams(key flowKey, f *udpFlow) {
+	buf := make([]byte, usernetMTU-ipHeaderLen)
+	for {
+		n, err := f.conn.Read(buf[udpHeaderLen:])
+		if err != nil {
+			u.mu.Lock()
+			if u.udp[key] == f {
+				delete(u.udp, key)
+			}
+			u.mu.Unlock()
+			f.conn.Close()
+			return
+		}
+		// Truncated datagrams are not fragmented
+		segment := buf[:udpHeaderLen+n]
+		binary.BigEndian.PutUint16(segment, key.remotePort)
+		binary.BigEndian.PutUint16(segment[2:], key.port)
+		binary.BigEndian.PutUint16(segment[4:], uint16(len(segment)))
+		segment[6], segment[7] = 0, 0
+		binary.BigEndian.PutUint16(segment[6:], transportChecksum(key.remote, protoUDP, segment))
+		u.sendIPv4(key.remote, protoUDP, segment)
+		u.mu.Lock()
+		f.lastUsed = time.Now()
+		u.mu.Unlock()
+	}
+}
+
+type tcpState int
+
+const (
+	// SYN sent to the task for a port forward
+	tcpSynSent tcpState = iota
+	// SYN received from the task while dialing the host
+	tcpDialing
+	// SYN-ACK sent to the task
+	tcpSynReceived
+	tcpEstablished
+	tcpClosed
+)
+
+// tcpConn is a TCP connection of the task relayed to a host one. Its
+// fields are guarded by the mutex of the usernet.
+type tcpConn struct {
+	key   flowKey
+	host  net.Conn
+	state tcpState
+	// signaled on every change for the relay goroutines
+	changed *sync.Cond
+
+	// Sequence numbers sent to the task
+	iss, sndUna, sndNxt uint32
+	// Window and maximum segment size of the task
+	sndWnd uint32
+	mss    int
+	// Data sent not acknowledged yet, from sndUna
+	unacked []byte
+	// FIN sent to the task and acknowledged
+	finSent, finAcked bool
+	// Retransmission timer
+	lastProgress time.Time
+	retries      uint
+
+	// Next sequence number of the task
+	rcvNxt uint32
+	// Data of the task to write to the host
+	queue   [][]byte
+	pending int
+	// FIN received from the task and relayed to the host
+	finRecv, hostClosed bool
+}
+
+func seqGT(a, b uint32) bool { return int32(a-b) > 0 }
+func seqLE(a, b uint32) bool { return int32(a-b) <= 0 }
+
+func (u *usernet) newTCP(key flowKey, state tcpState) *tcpConn {
+	c := &tcpConn{key: key, state: state, iss: rand.Uint32(), mss: usernetMSS, lastProgress: time.Now()}
+	c.changed = sync.NewCond(&u.mu)
+	c.sndUna, c.sndNxt = c.iss, c.iss+1
+	u.tcp[key] = c
+	return c
+}
+
+// window returns the receive window advertised to the task
+func (c *tcpConn) window() int {
+	if c.pending > tcpWindow {
+		return 0
+	}
+	return tcpWindow - c.pending
+}
+
+func (u *usernet) handleTCP(dst [4]byte, p []byte) {
+	if len(p) < tcpHeaderLen {
+		return
+	}
+	hl := int(p[12]>>4) * 4
+	if hl < tcpHeaderLen || hl > len(p) {
+		return
+	}
+	key := flowKey{
+		port:       binary.BigEndian.Uint16(p),
+		remote:     dst,
+		remotePort: binary.BigEndian.Uint16(p[2:]),
+	}
+	seq := binary.BigEndian.Uint32(p[4:])
+	ack := binary.BigEndian.Uint32(p[8:])
+	flags := p[13]
+	wnd := uint32(binary.BigEndian.Uint16(p[14:]))
+	data := p[hl:]
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		return
+	}
+	c := u.tcp[key]
+	if c == nil {
+		switch {
+		case flags&tcpRST != 0:
+		case flags&(tcpSYN|tcpACK) == tcpSYN:
+			c = u.newTCP(key, tcpDialing)
+			c.rcvNxt = seq + 1
+			c.sndWnd = wnd
+			c.mss = segmentMSS(p[tcpHeaderLen:hl])
+			go u.dialHost(c)
+		case flags&tcpACK != 0:
+			u.sendTCP(key, tcpRST, ack, 0, 0, nil)
+		default:
+			u.sendTCP(key, tcpRST|tcpACK, 0, seq+uint32(len(data)), 0, nil)
+		}
+		return
+	}
+	if flags&tcpRST != 0 {
+		u.closeTCP(c)
+		return
+	}
+	switch c.state {
+	case tcpDialing:
+		// SYN retransmitted
+		return
+	case tcpSynSent:
+		if flags&(tcpSYN|tcpACK) != tcpSYN|tcpACK || ack != c.iss+1 {
+			return
+		}
+		c.rcvNxt = seq + 1
+		c.sndWnd = wnd
+		c.mss = segmentMSS(p[tcpHeaderLen:hl])
+		u.establish(c)
+		u.sendSegment(c, tcpACK, c.sndNxt, nil)
+		return
+	case tcpSynReceived:
+		if flags&tcpSYN != 0 {
+			u.sendSegment(c, tcpSYN|tcpACK, c.iss, nil)
+			return
+		}
+		if flags&tcpACK == 0 || ack != c.iss+1 {
+			return
+		}
+		u.establish(c)
+	}
+	if flags&tcpSYN != 0 {
+		// SYN-ACK retransmitted
+		u.sendSegment(c, tcpACK, c.sndNxt, nil)
+		return
+	}
+	if flags&tcpACK != 0 {
+		u.acknowledge(c, ack, wnd)
+	}
+	fin := flags&tcpFIN != 0
+	if len(data) > 0 || fin {
+		if seq != c.rcvNxt || c.finRecv {
+			// Out of order or duplicated, the task retransmits it
+			u.sendSegment(c, tcpACK, c.sndNxt, nil)
+			return
+		}
+		if w := c.window(); len(data) > w {
+			data, fin = data[:w], false
+		}
+		if len(data) > 0 {
+			c.queue = append(c.queue, append([]byte(nil), data...))
+			c.pending += len(data)
+			c.rcvNxt += uint32(len(data))
+		}
+		if fin {
+			c.finRecv = true
+			c.rcvNxt++
+		}
+		c.changed.Broadcast()
+		u.sendSegment(c, tcpACK, c.sndNxt, nil)
+	}
+	u.finish(c)
+}
+
+// segmentMSS returns the maximum segment size from the TCP options
+func segmentMSS(opts []byte) int {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0:
+			return usernetMSS
+		case 1:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if opts[0] == 2 && opts[1] == 4 {
+			if mss := int(binary.BigEndian.Uint16(opts[2:])); mss > 0 && mss < usernetMSS {
+				return mss
+			}
+			break
+		}
+		opts = opts[opts[1]:]
+	}
+	return usernetMSS
+}
+
+// dialHost connects to the host address of a connection of the task
+func (u *usernet) dialHost(c *tcpConn) {
+	host, err := net.DialTimeout("tcp", u.hostAddr(c.key.remote, c.key.remotePort), tcpDialTimeout)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if c.state == tcpClosed {
+		if host != nil {
+			host.Close()
+		}
+		return
+	}
+	if err != nil {
+		u.sendTCP(c.key, tcpRST|tcpACK, 0, c.rcvNxt, 0, nil)
+		u.closeTCP(c)
+		return
+	}
+	c.host = host
+	c.state = tcpSynReceived
+	c.lastProgress = time.Now()
+	u.sendSegment(c, tcpSYN|tcpACK, c.iss, nil)
+}
+
+// acceptForwards opens a connection to the task port for every host
+// connection accepted
+func (u *usernet) acceptForwards(l net.Listener, port int) {
+	for {
+		host, err := l.Accept()
+		if err != nil {
+			return
+		}
+		u.mu.Lock()
+		if u.closed {
+			host.Close()
+		} else {
+			key := flowKey{port: uint16(port), remote: usernetGatewayIP}
+			for {
+				key.remotePort = u.nextPort
+				if u.nextPort++; u.nextPort == 0 {
+					u.nextPort = forwardFirstPort
+				}
+				if u.tcp[key] == nil {
+					break
+				}
+			}
+			c := u.newTCP(key, tcpSynSent)
+			c.host = host
+			u.sendSegment(c, tcpSYN, c.iss, nil)
+		}
+		u.mu.Unlock()
+	}
+}
+
+// establish starts relaying the data of an established connection
+func (u *usernet) establish(c *tcpConn) {
+	c.state = tcpEstablished
+	c.sndUna = c.iss + 1
+	c.retries = 0
+	c.changed.Broadcast()
+	go u.writeHost(c)
+	go u.readHost(c)
+}
+
+// acknowledge releases the data acknowledged by the task
+func (u *usernet) acknowledge(c *tcpConn, ack, wnd uint32) {
+	if seqGT(ack, c.sndUna) && seqLE(ack, c.sndNxt) {
+		n := int(ack - c.sndUna)
+		if c.finSent && ack == c.sndNxt {
+			c.finAcked = true
+			n--
+		}
+		if n > len(c.unacked) {
+			n = len(c.unacked)
+		}
+		c.unacked = c.unacked[n:]
+		c.sndUna = ack
+		c.retries = 0
+		c.lastProgress = time.Now()
+	}
+	c.sndWnd = wnd
+	c.changed.Broadcast()
+}
+
+// writeHost writes the data of the task to the host connection
+func (u *usernet) writeHost(c *tcpConn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for {
+		for len(c.queue) == 0 && !c.finRecv && c.state != tcpClosed {
+			c.changed.Wait()
+		}
+		if c.state == tcpClosed {
+			return
+		}
+		if len(c.queue) == 0 {
+			u.mu.Unlock()
+			if tc, ok := c.host.(*net.TCPConn); ok {
+				tc.CloseWrite()
+			}
+			u.mu.Lock()
+			c.hostClosed = true
+			u.finish(c)
+			return
+		}
+		data := c.queue[0]
+		c.queue = c.queue[1:]
+		u.mu.Unlock()
+		_, err := c.host.Write(data)
+		u.mu.Lock()
+		if c.state == tcpClosed {
+			return
+		}
+		if err != nil {
+			u.resetTCP(c)
+			return
+		}
+		closed := c.window() < c.mss
+		c.pending -= len(data)
+		if closed && c.window() >= c.mss {
+			// Window update
+			u.sendSegment(c, tcpACK, c.sndNxt, nil)
+		}
+	}
+}
+
+// readHost sends the data of the host connection to the task within
+// its window
+func (u *usernet) readHost(c *tcpConn) {
+	buf := make([]byte, usernetMSS)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for {
+		var n int
+		for c.state == tcpEstablished {
+			n = int(c.sndWnd) - len(c.unacked)
+			if room := tcpWindow - len(c.unacked); room < n {
+				n = room
+			}
+			if n > 0 {
+				break
+			}
+			c.changed.Wait()
+		}
+		if c.state != tcpEstablished {
+			return
+		}
+		if n > c.mss {
+			n = c.mss
+		}
+		u.mu.Unlock()
+		n, err := c.host.Read(buf[:n])
+		u.mu.Lock()
+		if c.state != tcpEstablished {
+			return
+		}
+		if n > 0 {
+			if len(c.unacked) == 0 {
+				c.lastProgress = time.Now()
+			}
+			c.unacked = append(c.unacked, buf[:n]...)
+			u.sendSegment(c, tcpACK|tcpPSH, c.sndNxt, buf[:n])
+			c.sndNxt += uint32(n)
+		}
+		if err == io.EOF {
+			if len(c.unacked) == 0 {
+				c.lastProgress = time.Now()
+			}
+			c.finSent = true
+			u.sendSegment(c, tcpFIN|tcpACK, c.sndNxt, nil)
+			c.sndNxt++
+			return
+		}
+		if err != nil {
+			u.resetTCP(c)
+			return
+		}
+	}
+}
+
+// finish closes the connection once both directions are closed
+func (u *usernet) finish(c *tcpConn) {
+	if c.finRecv && c.hostClosed && c.finSent && c.finAcked {
+		u.closeTCP(c)
+	}
+}
+
+// resetTCP aborts the connection of the task
+func (u *usernet) resetTCP(c *tcpConn) {
+	if c.state != tcpClosed {
+		u.sendTCP(c.key, tcpRST|tcpACK, c.sndNxt, c.rcvNxt, 0, nil)
+	}
+	u.closeTCP(c)
+}
+
+func (u *usernet) closeTCP(c *tcpConn) {
+	c.state = tcpClosed
+	if c.host != nil {
+		c.host.Close()
+	}
+	if u.tcp[c.key] == c {
+		delete(u.tcp, c.key)
+	}
+	c.changed.Broadcast()
+}
+
+// sendSegment sends a segment of the connection to the task
+func (u *usernet) sendSegment(c *tcpConn, flags byte, seq uint32, data []byte) {
+	u.sendTCP(c.key, flags, seq, c.rcvNxt, c.window(), data)
+}
+
+// sendTCP sends a TCP segment to the task, with the MSS option when it
+// is a SYN
+func (u *usernet) sendTCP(key flowKey, flags byte, seq, ack uint32, window int, data []byte) {
+	hl := tcpHeaderLen
+	if flags&tcpSYN != 0 {
+		hl += 4
+	}
+	segment := make([]byte, hl+len(data))
+	binary.BigEndian.PutUint16(segment, key.remotePort)
+	binary.BigEndian.PutUint16(segment[2:], key.port)
+	binary.BigEndian.PutUint32(segment[4:], seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(segment[8:], ack)
+	}
+	segment[12] = byte(hl/4) << 4
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:], uint16(window))
+	if flags&tcpSYN != 0 {
+		segment[20], segment[21] = 2, 4
+		binary.BigEndian.PutUint16(segment[22:], usernetMSS)
+	}
+	copy(segment[hl:], data)
+	binary.BigEndian.PutUint16(segment[16:], transportChecksum(key.remote, protoTCP, segment))
+	u.sendIPv4(key.remote, protoTCP, segment)
+}
+
+// timers retransmits the segments not acknowledged in time and closes
+// the idle UDP flows
+func (u *usernet) timers() {
+	ticker := time.NewTicker(tcpRTO / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.done:
+			return
+		case now := <-ticker.C:
+			u.mu.Lock()
+			for _, c := range u.tcp {
+				u.retransmit(c, now)
+			}
+			for key, f := range u.udp {
+				if now.Sub(f.lastUsed) > udpTimeout {
+					f.conn.Close()
+					delete(u.udp, key)
+				}
+			}
+			u.mu.Unlock()
+		}
+	}
+}
+
+// retransmit sends again the first segment not acknowledged after the
+// retransmission timeout
+func (u *usernet) retransmit(c *tcpConn, now time.Time) {
+	pending := c.state == tcpSynSent || c.state == tcpSynReceived ||
+		(c.state == tcpEstablished && (len(c.unacked) > 0 || (c.finSent && !c.finAcked)))
+	if !pending || now.Sub(c.lastProgress) < tcpRTO<<c.retries {
+		return
+	}
+	if c.retries++; c.retries > tcpRetries {
+		u.resetTCP(c)
+		return
+	}
+	c.lastProgress = now
+	switch {
+	case c.state == tcpSynSent:
+		u.sendSegment(c, tcpSYN, c.iss, nil)
+	case c.state == tcpSynReceived:
+		u.sendSegment(c, tcpSYN|tcpACK, c.iss, nil)
+	case len(c.unacked) > 0:
+		n := len(c.unacked)
+		if n > c.mss {
+			n = c.mss
+		}
+		u.sendSegment(c, tcpACK|tcpPSH, c.sndUna, c.unacked[:n])
+	default:
+		u.sendSegment(c, tcpFIN|tcpACK, c.sndNxt-1, nil)
+	}
+}
@@ -0,0 +1,135 @@
+package task
+
+// Volumes are host directories or files bind mounted inside the jail.
+// Unprivileged tasks mount them in their mount namespace before the
+// pivot root, privileged ones in the host until the task is closed.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Volume is a host path bind mounted with its submounts inside the jail
+type Volume struct {
+	// HostPath is the absolute path of the directory or file in the host
+	HostPath string
+	// Path inside the jail, created if it does not exist
+	Path string
+	// ReadOnly mounts it read-only, submounts included
+	ReadOnly bool
+}
+
+// ParseVolume returns the volume from its host:container[:ro|rw] form.
+// A relative host path is relative to the working directory.
+func ParseVolume(spec string) (v Volume, err error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return v, fmt.Errorf("Invalid volume %q, expected host:container[:ro]", spec)
+	}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			v.ReadOnly = true
+		case "rw":
+		default:
+			return v, fmt.Errorf("Invalid volume %q, unknown mode %s", spec, parts[2])
+		}
+	}
+	if v.HostPath, err = filepath.Abs(parts[0]); err != nil {
+		return v, err
+	}
+	v.Path = parts[1]
+	return v, v.validate()
+}
+
+func (v Volume) String() string {
+	spec := v.HostPath + ":" + v.Path
+	if v.ReadOnly {
+		spec += ":ro"
+	}
+	return spec
+}
+
+// validate checks the paths of the volume
+func (v Volume) validate() error {
+	if v.HostPath == "" || !filepath.IsAbs(v.HostPath) {
+		return fmt.Errorf("Invalid volume %s, the host path must be absolute", v)
+	}
+	if strings.ContainsAny(v.HostPath+v.Path, ":,") {
+		return fmt.Errorf("Invalid volume %s, paths cannot contain : or ,", v)
+	}
+	if err := checkJailPath(v.Path); err != nil {
+		return fmt.Errorf("Invalid volume %s: %v", v, err)
+	}
+	return nil
+}
+
+// mountVolumes bind mounts the volumes inside root, the parent paths
+// first. It returns the paths of the ones mounted until the first error.
+func mountVolumes(root string, volumes []Volume) (mounted []string, err error) {
+	volumes = append([]Volume(nil), volumes...)
+	sort.SliceStable(volumes, func(i, j int) bool {
+		return depth(volumes[i].Path) < depth(volumes[j].Path)
+	})
+	for _, v := range volumes {
+		if err = v.validate(); err != nil {
+			return mounted, err
+		}
+		fi, err := os.Stat(v.HostPath)
+		if err != nil {
+			return mounted, fmt.Errorf("Volume %s: %v", v, err)
+		}
+		if err = bindMount(root, v.HostPath, v.Path, fi.IsDir()); err != nil {
+			return mounted, err
+		}
+		path := filepath.Join(root, v.Path)
+		mounted = append(mounted, path)
+		if v.ReadOnly {
+			if err = remountReadOnlyTree(root, v.Path, fi.IsDir()); err != nil {
+				return mounted, fmt.Errorf("Volume %s: %v", v, err)
+			}
+		}
+	}
+	return mounted, nil
+}
+
+// unmountVolumes unmounts the volumes mounted at paths in the reverse
+// order, ignoring the ones already unmounted. It returns false if any
+// of them is still mounted.
+func unmountVolumes(paths []string) bool {
+	unmounted := true
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := syscall.Unmount(paths[i], syscall.MNT_DETACH); err != nil && err != syscall.EINVAL && err != syscall.ENOENT {
+			log.Printf("WARN: Impossible to unmount the volume at %s: %v", paths[i], err)
+			unmounted = false
+		}
+	}
+	return unmounted
+}
+
+// checkJailPath checks that a path inside the jail is absolute, not
+// the root and without .. components to stay in the root filesystem
+func checkJailPath(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("Path %s inside the jail must be absolute", path)
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == ".." {
+			return fmt.Errorf("Path %s inside the jail cannot contain ..", path)
+		}
+	}
+	if filepath.Clean(path) == "/" {
+		return errors.New("The root filesystem cannot be replaced")
+	}
+	return nil
+}
+
+func depth(path string) int {
+	return strings.Count(filepath.Clean(path), "/")
+}
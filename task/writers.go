@@ -0,0 +1,191 @@
+package task
+
+// Pool of workers writing the bodies of the extracted regular files.
+// The tar stream is read sequentially, so the bodies are buffered in
+// chunks within a memory budget and written concurrently while the
+// next entries are read. Every file is closed as soon as its last
+// chunk is written.
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+const (
+	// bodyChunk is the size of the largest part of a body written by
+	// a worker, larger bodies are split
+	bodyChunk = 1 << 20
+	// bodiesBudget bounds the memory used by the buffered chunks
+	bodiesBudget = 64 << 20
+)
+
+// bodyFile is an extracted file written in chunks and completed by
+// done before closing it once all of them are written
+type bodyFile struct {
+	f    *os.File
+	done func(f *os.File) error
+
+	mu sync.Mutex
+	// references of the chunks not written yet and of the reader
+	refs int
+	err  error
+}
+
+// release drops a reference with the error writing its chunk. The
+// last one completes and closes the file.
+func (b *bodyFile) release(err error) error {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.refs--
+	last, err := b.refs == 0, b.err
+	b.mu.Unlock()
+	if !last {
+		return nil
+	}
+	if err == nil {
+		err = b.done(b.f)
+	}
+	if cerr := b.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// bodyJob is a chunk of a body to write at an offset of its file
+type bodyJob struct {
+	file   *bodyFile
+	offset int64
+	chunk  []byte
+}
+
+// bodyWriters is a pool of workers writing bodies
+type bodyWriters struct {
+	jobs chan bodyJob
+	wg   sync.WaitGroup
+
+	mu sync.Mutex
+	// released when buffered chunks are written
+	released *sync.Cond
+	inflight int64
+	err      error
+}
+
+// newBodyWriters starts n workers, runtime.NumCPU() if n is zero. It is
+// nil with a single worker as the bodies are written while read.
+func newBodyWriters(n int) *bodyWriters {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	if n == 1 {
+		return nil
+	}
+	w := &bodyWriters{jobs: make(chan bodyJob, n)}
+	w.released = sync.NewCond(&w.mu)
+	w.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go w.work()
+	}
+	return w
+}
+
+func (w *bodyWriters) work() {
+	defer w.wg.Done()
+	for job := range w.jobs {
+		err := w.Err()
+		if err == nil {
+			_, err = job.file.f.WriteAt(job.chunk, job.offset)
+		}
+		err = job.file.release(err)
+		w.mu.Lock()
+		w.inflight -= int64(len(job.chunk))
+		if w.err == nil {
+			w.err = err
+		}
+		w.released.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+// Err returns the first error writing a body
+func (w *bodyWriters) Err() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// write copies the body of the current entry in f, which is closed
+// once done completes it. It is written in chunks by the pool.
+func (w *bodyWriters) write(f *os.File, body io.Reader, hdr *tar.Header, done func(f *os.File) error) error {
+	if w == nil {
+		_, err := io.Copy(f, body)
+		if err == nil {
+			err = done(f)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	file := &bodyFile{f: f, done: done, refs: 1}
+	var offset int64
+	var err error
+	// Empty bodies are a single empty chunk
+	for first := true; err == nil && (first || offset < hdr.Size); first = false {
+		size := hdr.Size - offset
+		if size > bodyChunk {
+			size = bodyChunk
+		}
+		err = w.reserve(size)
+		chunk := make([]byte, size)
+		if err == nil {
+			_, err = io.ReadFull(body, chunk)
+		}
+		if err != nil {
+			w.mu.Lock()
+			w.inflight -= size
+			w.released.Broadcast()
+			w.mu.Unlock()
+			break
+		}
+		file.mu.Lock()
+		file.refs++
+		file.mu.Unlock()
+		w.jobs <- bodyJob{file: file, offset: offset, chunk: chunk}
+		offset += size
+	}
+	if rerr := file.release(err); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// reserve waits until size bytes fit in the memory budget and takes
+// them. It returns the first error writing a body.
+func (w *bodyWriters) reserve(size int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.inflight > 0 && w.inflight+size > bodiesBudget && w.err == nil {
+		w.released.Wait()
+	}
+	w.inflight += size
+	return w.err
+}
+
+// Close waits for the pending bodies and stops the workers. It returns
+// the first error writing them.
+func (w *bodyWriters) Close() error {
+	if w == nil {
+		return nil
+	}
+	close(w.jobs)
+	w.wg.Wait()
+	return w.err
+}